@@ -0,0 +1,273 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// attachmentsByCategory returns the files of a product as the product page
+// shows them, keyed by category: files of revision scoped categories are
+// those of the current revision. Given a category, only that one is listed.
+func attachmentsByCategory(p *Product, category string) map[string][]FileInfo {
+	files := map[string][]FileInfo{}
+	for _, c := range attachmentCategories {
+		if category != "" && c != category {
+			continue
+		}
+		files[c] = p.filesFor(c)
+		if files[c] == nil {
+			files[c] = []FileInfo{}
+		}
+	}
+	return files
+}
+
+// apiAttachmentsHandler serves the files of product p under
+// /api/products/{partNo}/attachments: GET lists them by category and POST
+// uploads files. ref is the rest of the path; with an attachment id there,
+// GET downloads the file, PUT replaces its content and DELETE removes it.
+func apiAttachmentsHandler(w http.ResponseWriter, r *http.Request, p Product, ref string) {
+	if ref == "" {
+		switch r.Method {
+		case http.MethodGet:
+			category := r.URL.Query().Get("category")
+			if category != "" && !isAttachmentCategory(category) {
+				writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %q is not an attachment category", category), nil)
+				return
+			}
+			writeJSON(w, http.StatusOK, attachmentsByCategory(&p, category))
+		case http.MethodPost:
+			apiUploadAttachments(w, r, p)
+		default:
+			writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed", nil)
+		}
+		return
+	}
+
+	id, err := strconv.ParseInt(ref, 10, 64)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "Attachment not found", nil)
+		return
+	}
+	f, err := scanAttachment(db.QueryRow("SELECT "+attachmentColumns+" FROM attachments WHERE id = ? AND product_id = ?", id, p.ID))
+	if err == sql.ErrNoRows {
+		writeAPIError(w, http.StatusNotFound, "Attachment not found", nil)
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Error getting attachment: "+err.Error(), nil)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		serveAttachment(w, r, f)
+	case http.MethodPut:
+		apiReplaceAttachment(w, r, f)
+	case http.MethodDelete:
+		if err := removeAttachment(f); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "Error removing attachment: "+err.Error(), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status":  "success",
+			"message": "File removed successfully",
+			"file":    f,
+		})
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed", nil)
+	}
+}
+
+// serveAttachment sends the content of an attachment as a download. The
+// checksum serves as ETag, so unchanged files are not sent again.
+func serveAttachment(w http.ResponseWriter, r *http.Request, f FileInfo) {
+	file, err := os.Open(filepath.Join(uploadDir, filepath.FromSlash(f.Path)))
+	if os.IsNotExist(err) {
+		writeAPIError(w, http.StatusNotFound, "File "+f.Name+" is missing from the uploads folder", nil)
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Error opening file: "+err.Error(), nil)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Error opening file: "+err.Error(), nil)
+		return
+	}
+
+	if f.Type != "" {
+		w.Header().Set("Content-Type", f.Type)
+	}
+	if f.Checksum != "" {
+		w.Header().Set("ETag", `"`+f.Checksum+`"`)
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": f.Name}))
+	http.ServeContent(w, r, f.Name, info.ModTime(), file)
+}
+
+// apiUploadAttachments stores the files of a multipart upload, posted in
+// fields named after their category as on the product forms. The action
+// field chooses what happens to a file of the same name: keepBoth (the
+// default) stores the upload under a numbered name, replace overwrites it.
+// Drawings, CAD and CNC files go to the current revision. When no file can be
+// written the upload fails with 500; otherwise the files that could not be
+// written are listed under failed.
+func apiUploadAttachments(w http.ResponseWriter, r *http.Request, p Product) {
+	if err := r.ParseMultipartForm(100 << 20); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Invalid request: "+err.Error(), nil)
+		return
+	}
+
+	problems := map[string]string{}
+	switch strings.ToLower(strings.TrimSpace(r.FormValue("action"))) {
+	case "", "keepboth", "replace":
+	default:
+		problems["action"] = fmt.Sprintf("%q is not keepBoth or replace", r.FormValue("action"))
+	}
+	action := defaultAction(r.FormValue("action"))
+	uploads := 0
+	for field, files := range r.MultipartForm.File {
+		if !isAttachmentCategory(field) {
+			problems[field] = "not an attachment category"
+		}
+		uploads += len(files)
+	}
+	if uploads == 0 {
+		problems["files"] = "no file uploaded; post files in fields named " + strings.Join(attachmentCategories, ", ")
+	}
+	if len(problems) > 0 {
+		writeAPIError(w, http.StatusUnprocessableEntity, "Invalid upload", problems)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	defer tx.Rollback()
+	var batch uploadBatch
+	defer batch.discard()
+
+	revisionID, revision, err := currentRevision(tx, p.ID)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Error selecting revision: "+err.Error(), nil)
+		return
+	}
+	stored := []FileInfo{}
+	failed := []uploadFailure{}
+	var fileChanges []AuditChange
+	for _, category := range attachmentCategories {
+		subDir := category
+		var fileRevisionID int64
+		if isRevisionCategory(category) {
+			subDir = revisionDir(revision, category)
+			fileRevisionID = revisionID
+		}
+		files, failures := saveUploads(r, category, subDir, p.PartNo, action, &batch)
+		failed = append(failed, failures...)
+		changes, err := storeAttachments(tx, p.ID, fileRevisionID, category, files, action)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "Error saving attachments: "+err.Error(), nil)
+			return
+		}
+		stored = append(stored, files...)
+		fileChanges = append(fileChanges, changes...)
+	}
+	if len(stored) == 0 {
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"status":  "error",
+			"message": fmt.Sprintf("None of the %d files could be stored", uploads),
+			"failed":  failed,
+		})
+		return
+	}
+	if err := batch.commit(); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Error saving attachments: "+err.Error(), nil)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Error saving attachments: "+err.Error(), nil)
+		return
+	}
+	auditFiles(p.ID, fileChanges)
+
+	status := "success"
+	if len(failed) > 0 {
+		status = "partial"
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"status":  status,
+		"message": fmt.Sprintf("%d of %d files stored", len(stored), uploads),
+		"files":   stored,
+		"failed":  failed,
+	})
+}
+
+// apiReplaceAttachment overwrites the content of an attachment with the file
+// uploaded in the multipart field file. The attachment keeps its id, name
+// and place; its size, type, checksum and upload date are updated. The stored
+// file is only overwritten once the upload has been written in full.
+func apiReplaceAttachment(w http.ResponseWriter, r *http.Request, f FileInfo) {
+	if err := r.ParseMultipartForm(100 << 20); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Invalid request: "+err.Error(), nil)
+		return
+	}
+	uploads := r.MultipartForm.File["file"]
+	if len(uploads) != 1 {
+		writeAPIError(w, http.StatusUnprocessableEntity, "Invalid upload",
+			map[string]string{"file": "upload exactly one file"})
+		return
+	}
+
+	fullPath := filepath.Join(uploadDir, filepath.FromSlash(f.Path))
+	if err := os.MkdirAll(filepath.Dir(fullPath), os.ModePerm); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Error creating directory: "+err.Error(), nil)
+		return
+	}
+	var batch uploadBatch
+	defer batch.discard()
+	size, checksum, err := batch.write(uploads[0], fullPath)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Error saving file: "+err.Error(), nil)
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+		UPDATE attachments SET size = ?, mime_type = ?, checksum = ?, uploaded_at = CURRENT_TIMESTAMP
+		WHERE id = ?`, size, uploadMimeType(uploads[0]), checksum, f.ID)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Error updating database: "+err.Error(), nil)
+		return
+	}
+	if err := batch.commit(); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Error saving file: "+err.Error(), nil)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Error updating database: "+err.Error(), nil)
+		return
+	}
+
+	replaced, err := scanAttachment(db.QueryRow("SELECT "+attachmentColumns+" FROM attachments WHERE id = ?", f.ID))
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Error getting attachment: "+err.Error(), nil)
+		return
+	}
+	auditFiles(f.ProductID, []AuditChange{{Field: f.Category, Old: auditFileLabel(f), New: auditFileLabel(replaced)}})
+	writeJSON(w, http.StatusOK, replaced)
+}
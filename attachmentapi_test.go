@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// uploadFiles posts files, keyed by field and then by name, to the
+// attachments of partNo.
+func uploadFiles(t *testing.T, partNo string, files map[string]map[string]string) (int, map[string]interface{}) {
+	t.Helper()
+	return sendFiles(t, http.MethodPost, "/api/products/"+partNo+"/attachments", nil, files)
+}
+
+// sendFiles sends a multipart request of form values and files, given by
+// field and file name, and decodes the JSON reply.
+func sendFiles(t *testing.T, method, target string, values map[string]string, files map[string]map[string]string) (int, map[string]interface{}) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for field, value := range values {
+		mw.WriteField(field, value)
+	}
+	for field, named := range files {
+		for name, content := range named {
+			fw, err := mw.CreateFormFile(field, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fw.Write([]byte(content))
+		}
+	}
+	mw.Close()
+	w := serve(method, target, mw.FormDataContentType(), &body)
+	var reply map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Fatalf("upload reply %q: %v", w.Body, err)
+	}
+	return w.Code, reply
+}
+
+// TestUploadAttachmentsFailures checks that files which cannot be written are
+// reported, and that an upload storing none of its files fails.
+func TestUploadAttachmentsFailures(t *testing.T) {
+	setupTestDB(t)
+	if w := serve(http.MethodPost, "/api/products", "application/json", strings.NewReader(`{"partNo": "P1"}`)); w.Code != http.StatusCreated {
+		t.Fatalf("creating product: %d %s", w.Code, w.Body)
+	}
+	// A file in place of the photos folder makes photo uploads fail.
+	photos := filepath.Join(uploadDir, "p1", "photos")
+	if err := os.RemoveAll(photos); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(photos, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	code, reply := uploadFiles(t, "P1", map[string]map[string]string{"photos": {"a.jpg": "jpg", "b.jpg": "jpg"}})
+	if code != http.StatusInternalServerError || reply["status"] != "error" {
+		t.Fatalf("upload of failing files: %d %v", code, reply)
+	}
+	if failed, _ := reply["failed"].([]interface{}); len(failed) != 2 {
+		t.Errorf("failed = %v, want both photos", reply["failed"])
+	}
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM attachments").Scan(&n)
+	if n != 0 {
+		t.Errorf("%d attachments stored, want none", n)
+	}
+
+	code, reply = uploadFiles(t, "P1", map[string]map[string]string{"photos": {"a.jpg": "jpg"}, "cnc": {"o1.nc": "G0"}})
+	if code != http.StatusCreated || reply["status"] != "partial" || reply["message"] != "1 of 2 files stored" {
+		t.Fatalf("partial upload: %d %v", code, reply)
+	}
+	failed, _ := reply["failed"].([]interface{})
+	if len(failed) != 1 || failed[0].(map[string]interface{})["name"] != "a.jpg" {
+		t.Errorf("failed = %v, want a.jpg", reply["failed"])
+	}
+	if files, _ := reply["files"].([]interface{}); len(files) != 1 || files[0].(map[string]interface{})["name"] != "o1.nc" {
+		t.Errorf("files = %v, want o1.nc", reply["files"])
+	}
+
+	code, reply = uploadFiles(t, "P1", map[string]map[string]string{"cnc": {"o2.nc": "G1"}})
+	if code != http.StatusCreated || reply["status"] != "success" {
+		t.Errorf("upload: %d %v", code, reply)
+	}
+}
+
+// TestReplaceAttachmentFailures replaces a stored file by uploads that cannot
+// be recorded: the stored file keeps its content and no upload is left in the
+// folder.
+func TestReplaceAttachmentFailures(t *testing.T) {
+	setupTestDB(t)
+	if w := serve(http.MethodPost, "/api/products", "application/json", strings.NewReader(`{"partNo": "P1"}`)); w.Code != http.StatusCreated {
+		t.Fatalf("creating product: %d %s", w.Code, w.Body)
+	}
+	if code, reply := uploadFiles(t, "P1", map[string]map[string]string{"invoice": {"i.pdf": "old"}}); code != http.StatusCreated {
+		t.Fatalf("upload: %d %v", code, reply)
+	}
+	folder := filepath.Join(uploadDir, "p1", "invoice")
+	check := func(content string) {
+		t.Helper()
+		entries, err := os.ReadDir(folder)
+		if err != nil || len(entries) != 1 {
+			t.Fatalf("invoice folder holds %v, %v", entries, err)
+		}
+		data, err := os.ReadFile(filepath.Join(folder, "i.pdf"))
+		if err != nil || string(data) != content {
+			t.Errorf("i.pdf holds %q %v, want %q", data, err, content)
+		}
+		var checksum string
+		db.QueryRow("SELECT checksum FROM attachments").Scan(&checksum)
+		if sum := sha256.Sum256(data); checksum != hex.EncodeToString(sum[:]) {
+			t.Errorf("checksum %q does not match i.pdf", checksum)
+		}
+	}
+
+	_, err := db.Exec(`
+		CREATE TEMP TRIGGER fail_update BEFORE UPDATE ON attachments BEGIN SELECT RAISE(ABORT, 'update failed'); END;
+		CREATE TEMP TRIGGER fail_insert BEFORE INSERT ON attachments BEGIN SELECT RAISE(ABORT, 'insert failed'); END`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, reply := sendFiles(t, http.MethodPut, "/api/products/P1/attachments/1", nil, map[string]map[string]string{"file": {"i.pdf": "new"}})
+	if code != http.StatusInternalServerError {
+		t.Errorf("PUT: %d %v", code, reply)
+	}
+	check("old")
+	code, reply = sendFiles(t, http.MethodPost, "/api/products/P1/attachments", map[string]string{"action": "replace"},
+		map[string]map[string]string{"invoice": {"i.pdf": "new"}})
+	if code != http.StatusInternalServerError {
+		t.Errorf("upload with replace: %d %v", code, reply)
+	}
+	check("old")
+
+	if _, err := db.Exec("DROP TRIGGER fail_update; DROP TRIGGER fail_insert"); err != nil {
+		t.Fatal(err)
+	}
+	code, reply = sendFiles(t, http.MethodPut, "/api/products/P1/attachments/1", nil, map[string]map[string]string{"file": {"i.pdf": "new"}})
+	if code != http.StatusOK {
+		t.Errorf("PUT: %d %v", code, reply)
+	}
+	check("new")
+	code, reply = sendFiles(t, http.MethodPost, "/api/products/P1/attachments", map[string]string{"action": "replace"},
+		map[string]map[string]string{"invoice": {"i.pdf": "newer"}})
+	if code != http.StatusCreated {
+		t.Errorf("upload with replace: %d %v", code, reply)
+	}
+	check("newer")
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// attachmentCategories lists the attachment categories in display order. A
+// category name is also the upload form field and the sub folder used under
+// uploads/<partNo>/.
+var attachmentCategories = []string{"photos", "drawings", "cad", "cnc", "invoice"}
+
+// legacyAttachmentColumns maps the JSON text columns that used to hold
+// attachments on the products table to their category.
+var legacyAttachmentColumns = []struct {
+	Column   string
+	Category string
+}{
+	{"photos", "photos"},
+	{"drawing_2d", "drawings"},
+	{"cad_3d", "cad"},
+	{"cnc_code", "cnc"},
+	{"invoice", "invoice"},
+}
+
+func isAttachmentCategory(category string) bool {
+	for _, c := range attachmentCategories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// filesFor returns the attachments of the given category.
+func (p *Product) filesFor(category string) []FileInfo {
+	switch category {
+	case "photos":
+		return p.Photos
+	case "drawings":
+		return p.Drawing2D
+	case "cad":
+		return p.Cad3D
+	case "cnc":
+		return p.CncCode
+	case "invoice":
+		return p.Invoice
+	}
+	return nil
+}
+
+func (p *Product) addFile(f FileInfo) {
+	switch f.Category {
+	case "photos":
+		p.Photos = append(p.Photos, f)
+	case "drawings":
+		p.Drawing2D = append(p.Drawing2D, f)
+	case "cad":
+		p.Cad3D = append(p.Cad3D, f)
+	case "cnc":
+		p.CncCode = append(p.CncCode, f)
+	case "invoice":
+		p.Invoice = append(p.Invoice, f)
+	}
+}
+
+const attachmentColumns = "id, product_id, revision_id, category, name, path, size, mime_type, uploaded_at, checksum"
+
+func scanAttachment(s interface{ Scan(...any) error }) (FileInfo, error) {
+	var f FileInfo
+	var mimeType, checksum sql.NullString
+	var revisionID sql.NullInt64
+	var uploadedAt time.Time
+	err := s.Scan(&f.ID, &f.ProductID, &revisionID, &f.Category, &f.Name, &f.Path, &f.Bytes, &mimeType, &uploadedAt, &checksum)
+	if err != nil {
+		return f, err
+	}
+	f.RevisionID = revisionID.Int64
+	f.Type = mimeType.String
+	f.Checksum = checksum.String
+	f.Size = formatFileSize(f.Bytes)
+	f.Date = uploadedAt.Local().Format("2006-01-02 15:04")
+	return f, nil
+}
+
+// loadAttachments fills in the revisions and attachment lists of every
+// product in the slice. Revision scoped files are listed on their revision
+// and, for the current revision, on the product itself. Invoice files carry
+// their invoice details.
+func loadAttachments(products []Product) error {
+	if len(products) == 0 {
+		return nil
+	}
+
+	if err := loadRevisions(products); err != nil {
+		return err
+	}
+	type revisionRef struct{ product, revision int }
+	revisions := make(map[int64]revisionRef)
+	for i := range products {
+		for j, rev := range products[i].Revisions {
+			revisions[rev.ID] = revisionRef{i, j}
+		}
+	}
+
+	index := make(map[int]int, len(products))
+	placeholders := make([]string, len(products))
+	args := make([]interface{}, len(products))
+	for i, p := range products {
+		index[p.ID] = i
+		placeholders[i] = "?"
+		args[i] = p.ID
+	}
+
+	rows, err := db.Query("SELECT "+attachmentColumns+" FROM attachments WHERE product_id IN ("+
+		strings.Join(placeholders, ",")+") ORDER BY uploaded_at, id", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		f, err := scanAttachment(rows)
+		if err != nil {
+			return err
+		}
+		if f.RevisionID != 0 {
+			ref, ok := revisions[f.RevisionID]
+			if !ok {
+				continue
+			}
+			rev := &products[ref.product].Revisions[ref.revision]
+			rev.addFile(f)
+			if !rev.IsCurrent {
+				continue
+			}
+		}
+		if i, ok := index[f.ProductID]; ok {
+			products[i].addFile(f)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return loadInvoiceDetails(products)
+}
+
+// loadProductAttachments is loadAttachments for a single product.
+func loadProductAttachments(p *Product) error {
+	products := []Product{*p}
+	if err := loadAttachments(products); err != nil {
+		return err
+	}
+	*p = products[0]
+	return nil
+}
+
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func insertAttachment(e execer, productID int, f FileInfo) (int64, error) {
+	revisionID := sql.NullInt64{Int64: f.RevisionID, Valid: f.RevisionID != 0}
+	res, err := e.Exec(`
+		INSERT INTO attachments(product_id, revision_id, category, name, path, size, mime_type, checksum)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?)`,
+		productID, revisionID, f.Category, f.Name, f.Path, f.Bytes, f.Type, f.Checksum)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// storeAttachments records freshly uploaded files, attached to revisionID
+// when it is not zero. With the replace action an existing attachment of the
+// same category, revision and (case-insensitive) name is superseded by the new
+// upload, matching the file that was overwritten on disk. The stored files are
+// returned as audit changes, naming the file each one replaced, and their
+// ids, category and revision are set in files.
+func storeAttachments(tx *sql.Tx, productID int, revisionID int64, category string, files []FileInfo, action string) ([]AuditChange, error) {
+	var changes []AuditChange
+	for i := range files {
+		f := &files[i]
+		change := AuditChange{Field: category}
+		if action == "replace" {
+			row := tx.QueryRow("SELECT "+attachmentColumns+` FROM attachments
+				WHERE product_id = ? AND IFNULL(revision_id, 0) = ? AND category = ? AND LOWER(name) = LOWER(?)`,
+				productID, revisionID, category, f.Name)
+			old, err := scanAttachment(row)
+			if err == nil {
+				change.Old = auditFileLabel(old)
+			} else if err != sql.ErrNoRows {
+				return nil, err
+			}
+			_, err = tx.Exec(`
+				DELETE FROM attachments
+				WHERE product_id = ? AND IFNULL(revision_id, 0) = ? AND category = ? AND LOWER(name) = LOWER(?)`,
+				productID, revisionID, category, f.Name)
+			if err != nil {
+				return nil, err
+			}
+		}
+		f.Category = category
+		f.RevisionID = revisionID
+		id, err := insertAttachment(tx, productID, *f)
+		if err != nil {
+			return nil, err
+		}
+		f.ID = id
+		change.New = auditFileLabel(*f)
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// writeUpload copies an uploaded file to fullPath and returns the number of
+// bytes written and the SHA-256 checksum of the content.
+func writeUpload(fileHeader *multipart.FileHeader, fullPath string) (int64, string, error) {
+	src, err := fileHeader.Open()
+	if err != nil {
+		return 0, "", err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(fullPath) // truncates if exists
+	if err != nil {
+		return 0, "", err
+	}
+	defer dst.Close()
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(dst, hash), src)
+	if err != nil {
+		return n, "", err
+	}
+	return n, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// uploadBatch tracks the files an upload writes until the attachments
+// recording them are stored. A file replacing a stored one is written to a
+// temporary file beside it and only moved over it by commit, so an upload
+// that fails leaves the stored file as it was; discard removes every file
+// the batch wrote. A nil batch writes files in place.
+type uploadBatch struct {
+	created []string
+	staged  []stagedUpload
+}
+
+// stagedUpload is a temporary file waiting to replace path.
+type stagedUpload struct {
+	tmp, path string
+}
+
+// write copies an uploaded file to fullPath, or to a temporary file beside it
+// when fullPath exists, like writeUpload.
+func (b *uploadBatch) write(fileHeader *multipart.FileHeader, fullPath string) (int64, string, error) {
+	if b == nil {
+		return writeUpload(fileHeader, fullPath)
+	}
+	if _, err := os.Stat(fullPath); err != nil {
+		b.created = append(b.created, fullPath)
+		return writeUpload(fileHeader, fullPath)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(fullPath), "."+filepath.Base(fullPath)+".*.upload")
+	if err != nil {
+		return 0, "", err
+	}
+	tmp.Close()
+	b.staged = append(b.staged, stagedUpload{tmp.Name(), fullPath})
+	return writeUpload(fileHeader, tmp.Name())
+}
+
+// commit moves the staged files over the files they replace. It is the last
+// step before the attachments are committed, which it fails by returning an
+// error.
+func (b *uploadBatch) commit() error {
+	for len(b.staged) > 0 {
+		s := b.staged[0]
+		if err := os.Rename(s.tmp, s.path); err != nil {
+			return fmt.Errorf("replacing %s: %w", filepath.Base(s.path), err)
+		}
+		b.staged = b.staged[1:]
+	}
+	b.created = nil
+	return nil
+}
+
+// discard removes the files written by an upload that was not stored. It
+// does nothing after commit.
+func (b *uploadBatch) discard() {
+	for _, s := range b.staged {
+		os.Remove(s.tmp)
+	}
+	for _, path := range b.created {
+		os.Remove(path)
+	}
+	b.staged, b.created = nil, nil
+}
+
+func fileChecksum(fullPath string) (string, error) {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func uploadMimeType(fileHeader *multipart.FileHeader) string {
+	if t := fileHeader.Header.Get("Content-Type"); t != "" && t != "application/octet-stream" {
+		return t
+	}
+	return mime.TypeByExtension(strings.ToLower(filepath.Ext(fileHeader.Filename)))
+}
+
+// parseFileSize reverses formatFileSize for legacy records whose file is no
+// longer on disk.
+func parseFileSize(s string) int64 {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return 0
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0
+	}
+	multiplier := map[string]float64{"Bytes": 1, "KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30}[fields[1]]
+	return int64(value * multiplier)
+}
+
+// migrateAttachmentsFromJSON moves the JSON attachment columns of products
+// into the attachments table. Size and checksum are taken from the file on
+// disk where it still exists. A column that is not valid JSON is recorded in
+// migration_reports and skipped.
+func migrateAttachmentsFromJSON(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE attachments (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+			category TEXT NOT NULL,
+			name TEXT NOT NULL,
+			path TEXT NOT NULL,
+			size INTEGER NOT NULL DEFAULT 0,
+			mime_type TEXT,
+			uploaded_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			checksum TEXT
+		);
+		CREATE INDEX idx_attachments_product ON attachments(product_id, category);
+	`)
+	if err != nil {
+		return err
+	}
+
+	type legacyRow struct {
+		id      int
+		columns []sql.NullString
+	}
+	selectCols := make([]string, len(legacyAttachmentColumns))
+	for i, c := range legacyAttachmentColumns {
+		selectCols[i] = c.Column
+	}
+
+	rows, err := tx.Query("SELECT id, " + strings.Join(selectCols, ", ") + " FROM products")
+	if err != nil {
+		return err
+	}
+	var legacy []legacyRow
+	for rows.Next() {
+		r := legacyRow{columns: make([]sql.NullString, len(legacyAttachmentColumns))}
+		dest := []any{&r.id}
+		for i := range r.columns {
+			dest = append(dest, &r.columns[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			return err
+		}
+		legacy = append(legacy, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, r := range legacy {
+		for i, col := range r.columns {
+			if !col.Valid || col.String == "" || col.String == "null" {
+				continue
+			}
+			var files []FileInfo
+			if err := json.Unmarshal([]byte(col.String), &files); err != nil {
+				column := legacyAttachmentColumns[i].Column
+				log.Printf("Could not parse %s of product %d: %v", column, r.id, err)
+				if err := reportMigrationIssue(tx, 2, r.id, column, col.String, err.Error()); err != nil {
+					return err
+				}
+				continue
+			}
+			for _, f := range files {
+				uploadedAt := time.Now()
+				if t, err := time.ParseInLocation("2006-01-02 15:04", f.Date, time.Local); err == nil {
+					uploadedAt = t
+				}
+
+				f.Bytes = parseFileSize(f.Size)
+				fullPath := filepath.Join(uploadDir, filepath.FromSlash(f.Path))
+				if fi, err := os.Stat(fullPath); err == nil {
+					f.Bytes = fi.Size()
+					if f.Date == "" {
+						uploadedAt = fi.ModTime()
+					}
+					if sum, err := fileChecksum(fullPath); err == nil {
+						f.Checksum = sum
+					}
+				}
+				if f.Type == "" {
+					f.Type = mime.TypeByExtension(strings.ToLower(filepath.Ext(f.Name)))
+				}
+
+				_, err := tx.Exec(`
+					INSERT INTO attachments(product_id, category, name, path, size, mime_type, uploaded_at, checksum)
+					VALUES(?, ?, ?, ?, ?, ?, ?, ?)`,
+					r.id, legacyAttachmentColumns[i].Category, f.Name, f.Path, f.Bytes, f.Type,
+					uploadedAt.UTC().Format("2006-01-02 15:04:05"), f.Checksum)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, c := range legacyAttachmentColumns {
+		if _, err := tx.Exec("ALTER TABLE products DROP COLUMN " + c.Column); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+// TestMigrateAttachmentsMalformedJSON migrates a database of the original
+// layout in which one attachment column holds malformed JSON: the value is
+// reported and the other files of the product are still migrated.
+func TestMigrateAttachmentsMalformedJSON(t *testing.T) {
+	skipWithoutFTS5(t)
+	legacy, path := openLegacyDB(t, `
+		INSERT INTO products(partNo, photos, cnc_code) VALUES(
+			'A-1',
+			'[{"name":"a.jpg","size":"1.00 KB"',
+			'[{"name":"p.nc","size":"2.00 KB","path":"a-1/cnc/p.nc"}]')`)
+	if err := migrateDB(legacy, path); err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+
+	var name string
+	if err := legacy.QueryRow("SELECT name FROM attachments WHERE category = 'cnc'").Scan(&name); err != nil || name != "p.nc" {
+		t.Errorf("cnc attachment: %q %v", name, err)
+	}
+	var n int
+	legacy.QueryRow("SELECT COUNT(*) FROM attachments").Scan(&n)
+	if n != 1 {
+		t.Errorf("%d attachments migrated, want 1", n)
+	}
+	var field, value string
+	err := legacy.QueryRow("SELECT field, value FROM migration_reports WHERE migration = 2 AND product_id = 1").Scan(&field, &value)
+	if err != nil || field != "photos" || value != `[{"name":"a.jpg","size":"1.00 KB"` {
+		t.Errorf("migration report: %q %q %v", field, value, err)
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// auditActions lists what the audit log records, with the label shown on the
+// product timeline.
+var auditActions = []struct{ Code, Label string }{
+	{"create", "Created"},
+	{"update", "Updated"},
+	{"delete", "Deleted"},
+	{"restore", "Restored"},
+	{"file_upload", "File uploaded"},
+	{"file_replace", "File replaced"},
+	{"file_remove", "File removed"},
+}
+
+func auditActionLabel(code string) string {
+	for _, a := range auditActions {
+		if a.Code == code {
+			return a.Label
+		}
+	}
+	return code
+}
+
+// auditFieldOrder is the order changed fields are listed in. Custom fields,
+// recorded as field.<name>, follow in name order.
+var auditFieldOrder = []string{
+	"partNo", "partName", "description", "currency", "cost",
+	"material", "materialSize", "materialCost", "materialSupplier",
+	"finishingType", "finishes", "finishingCost", "finishingSupplier",
+	"category", "tags", "currentRevision",
+}
+
+// AuditChange is one field changed by an audited action. For files the field
+// is the attachment category and the values name the file.
+type AuditChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// AuditEvent is one entry of a product's audit trail. Events outlive the
+// product, so ProductID may name a product that has been deleted.
+type AuditEvent struct {
+	ID        int64         `json:"id"`
+	ProductID int           `json:"productId"`
+	PartNo    string        `json:"partNo"`
+	Action    string        `json:"action"`
+	User      string        `json:"user,omitempty"`
+	CreatedAt string        `json:"createdAt"`
+	Changes   []AuditChange `json:"changes,omitempty"`
+}
+
+// auditValues returns the audited fields of a product as text, keyed as in
+// auditFieldOrder. A product that does not exist has no values.
+func auditValues(productID int) (map[string]string, error) {
+	var p Product
+	err := scanProduct(db.QueryRow("SELECT "+productColumns+" FROM products WHERE id = ?", productID), &p)
+	if err == sql.ErrNoRows {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := loadProductAttachments(&p); err != nil {
+		return nil, err
+	}
+	products := []Product{p}
+	if err := loadFieldValues(products); err != nil {
+		return nil, err
+	}
+	if err := loadTagsAndCategories(products); err != nil {
+		return nil, err
+	}
+	p = products[0]
+	if p.Finishes, err = loadFinishSteps(p.ID); err != nil {
+		return nil, err
+	}
+
+	var finishes []string
+	for _, f := range p.Finishes {
+		finishes = append(finishes, f.Name)
+	}
+	values := map[string]string{
+		"partNo":            p.PartNo,
+		"partName":          p.PartName,
+		"description":       p.Description,
+		"currency":          p.Currency,
+		"cost":              formatAmount(p.Cost, p.Currency),
+		"material":          p.Material,
+		"materialSize":      p.MaterialSize,
+		"materialCost":      formatAmount(p.MaterialCost, p.Currency),
+		"materialSupplier":  p.MaterialSupplier,
+		"finishingType":     p.FinishingType,
+		"finishes":          strings.Join(finishes, " > "),
+		"finishingCost":     formatAmount(p.FinishingCost, p.Currency),
+		"finishingSupplier": p.FinishingSupplier,
+		"category":          p.Category,
+		"tags":              strings.Join(p.Tags, ", "),
+		"currentRevision":   p.CurrentRevision,
+	}
+	for name, value := range p.Fields {
+		values[customFieldPrefix+name] = value
+	}
+	return values, nil
+}
+
+// diffAuditValues lists the fields whose value differs between two results
+// of auditValues.
+func diffAuditValues(old, new map[string]string) []AuditChange {
+	var changes []AuditChange
+	seen := map[string]bool{}
+	add := func(field string) {
+		if seen[field] {
+			return
+		}
+		seen[field] = true
+		if old[field] != new[field] {
+			changes = append(changes, AuditChange{Field: field, Old: old[field], New: new[field]})
+		}
+	}
+	for _, field := range auditFieldOrder {
+		add(field)
+	}
+	var custom []string
+	for _, m := range []map[string]string{old, new} {
+		for field := range m {
+			if strings.HasPrefix(field, customFieldPrefix) {
+				custom = append(custom, field)
+			}
+		}
+	}
+	sort.Strings(custom)
+	for _, field := range custom {
+		add(field)
+	}
+	return changes
+}
+
+// recordAudit appends an event to the audit log. An empty PartNo is taken
+// from the product, and an empty User is the account the application runs
+// under.
+func recordAudit(e AuditEvent) error {
+	if e.User == "" {
+		e.User = currentUsername()
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		INSERT INTO audit_events(product_id, part_no, action, created_by)
+		VALUES (?, COALESCE(NULLIF(?, ''), (SELECT partNo FROM products WHERE id = ?), ''), ?, ?)`,
+		e.ProductID, e.PartNo, e.ProductID, e.Action, e.User)
+	if err != nil {
+		return err
+	}
+	eventID, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	for _, c := range e.Changes {
+		_, err := tx.Exec("INSERT INTO audit_changes(event_id, field, old_value, new_value) VALUES (?, ?, ?, ?)",
+			eventID, c.Field, c.Old, c.New)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// auditProductChange records the difference between a product's values
+// before a change and its values now. Nothing is recorded for an update that
+// changed no audited field.
+func auditProductChange(productID int, action string, before map[string]string) {
+	after, err := auditValues(productID)
+	if err != nil {
+		log.Printf("Error reading product %d for the audit log: %v", productID, err)
+		return
+	}
+	changes := diffAuditValues(before, after)
+	if action == "update" && len(changes) == 0 {
+		return
+	}
+	e := AuditEvent{ProductID: productID, PartNo: after["partNo"], Action: action, Changes: changes}
+	if action == "delete" {
+		e.PartNo = before["partNo"]
+	}
+	if err := recordAudit(e); err != nil {
+		log.Printf("Error recording %s of product %d in the audit log: %v", action, productID, err)
+	}
+}
+
+// auditSnapshot reads the values auditProductChange compares against,
+// logging rather than failing the request when they cannot be read.
+func auditSnapshot(productID int) map[string]string {
+	values, err := auditValues(productID)
+	if err != nil {
+		log.Printf("Error reading product %d for the audit log: %v", productID, err)
+		return map[string]string{}
+	}
+	return values
+}
+
+// auditFiles records one event per uploaded file. Changes come from
+// storeAttachments; a change with an old value replaced an existing file.
+func auditFiles(productID int, changes []AuditChange) {
+	for _, c := range changes {
+		action := "file_upload"
+		if c.Old != "" {
+			action = "file_replace"
+		}
+		if err := recordAudit(AuditEvent{ProductID: productID, Action: action, Changes: []AuditChange{c}}); err != nil {
+			log.Printf("Error recording upload of %s in the audit log: %v", c.New, err)
+		}
+	}
+}
+
+// auditFileLabel describes an attachment in the audit log.
+func auditFileLabel(f FileInfo) string {
+	return fmt.Sprintf("%s (%s)", f.Name, formatFileSize(f.Bytes))
+}
+
+// auditQuery selects audit events; zero values leave a condition out. From
+// and To are inclusive dates.
+type auditQuery struct {
+	ProductID int
+	From, To  time.Time
+	Action    string
+}
+
+func loadAuditEvents(q auditQuery) ([]AuditEvent, error) {
+	var conditions []string
+	var args []interface{}
+	if q.ProductID != 0 {
+		conditions = append(conditions, "product_id = ?")
+		args = append(args, q.ProductID)
+	}
+	if !q.From.IsZero() {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, q.From.Format("2006-01-02"))
+	}
+	if !q.To.IsZero() {
+		conditions = append(conditions, "created_at < DATE(?, '+1 day')")
+		args = append(args, q.To.Format("2006-01-02"))
+	}
+	if q.Action != "" {
+		conditions = append(conditions, "action = ?")
+		args = append(args, q.Action)
+	}
+	var where string
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	rows, err := db.Query(`
+		SELECT id, product_id, part_no, action, COALESCE(created_by, ''), created_at
+		FROM audit_events`+where+" ORDER BY id DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	var events []AuditEvent
+	index := map[int64]int{}
+	for rows.Next() {
+		var e AuditEvent
+		if err := rows.Scan(&e.ID, &e.ProductID, &e.PartNo, &e.Action, &e.User, &e.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		index[e.ID] = len(events)
+		events = append(events, e)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil || len(events) == 0 {
+		return events, err
+	}
+
+	rows, err = db.Query(`
+		SELECT event_id, field, COALESCE(old_value, ''), COALESCE(new_value, '')
+		FROM audit_changes
+		WHERE event_id IN (SELECT id FROM audit_events`+where+`)
+		ORDER BY rowid`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var eventID int64
+		var c AuditChange
+		if err := rows.Scan(&eventID, &c.Field, &c.Old, &c.New); err != nil {
+			return nil, err
+		}
+		if i, ok := index[eventID]; ok {
+			events[i].Changes = append(events[i].Changes, c)
+		}
+	}
+	return events, rows.Err()
+}
+
+// parseAuditDate reads a from or to parameter, given as a date.
+func parseAuditDate(name, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return t, fmt.Errorf("%s: expected a date as YYYY-MM-DD", name)
+	}
+	return t, nil
+}
+
+// apiAuditHandler returns audit events, newest first, optionally limited to
+// a product, an action and a date range.
+func apiAuditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+
+	var q auditQuery
+	var err error
+	if id := query.Get("productId"); id != "" {
+		if q.ProductID, err = strconv.Atoi(id); err != nil {
+			http.Error(w, "Invalid product ID", http.StatusBadRequest)
+			return
+		}
+	}
+	if partNo := query.Get("partNo"); partNo != "" {
+		// A deleted product is found through the events recorded for it.
+		var id sql.NullInt64
+		err := db.QueryRow(`
+			SELECT COALESCE(
+				(SELECT id FROM products WHERE partNo = ?1),
+				(SELECT product_id FROM audit_events WHERE part_no = ?1 ORDER BY id DESC LIMIT 1))`,
+			partNo).Scan(&id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !id.Valid {
+			http.Error(w, "Product not found", http.StatusNotFound)
+			return
+		}
+		q.ProductID = int(id.Int64)
+	}
+	if q.From, err = parseAuditDate("from", query.Get("from")); err == nil {
+		q.To, err = parseAuditDate("to", query.Get("to"))
+	}
+	if err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !q.From.IsZero() && !q.To.IsZero() && q.To.Before(q.From) {
+		http.Error(w, "Invalid request: to is before from", http.StatusBadRequest)
+		return
+	}
+	q.Action = query.Get("action")
+	if q.Action != "" && auditActionLabel(q.Action) == q.Action {
+		http.Error(w, "Invalid request: unknown action "+q.Action, http.StatusBadRequest)
+		return
+	}
+
+	events, err := loadAuditEvents(q)
+	if err != nil {
+		http.Error(w, "Error loading audit log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if events == nil {
+		events = []AuditEvent{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// maxBOMDepth bounds the recursive BOM queries. Cycles are rejected when a
+// link is added, so this only guards against a corrupted database.
+const maxBOMDepth = 50
+
+// BOMLine is one row of an exploded bill of materials or of a where-used
+// list. Quantity is per immediate parent; ExtendedQty is per one top-level
+// assembly (or, for where-used, how many of the part one assembly needs).
+type BOMLine struct {
+	Level       int     `json:"level"`
+	ParentID    int     `json:"parentId"`
+	ProductID   int     `json:"productId"`
+	PartNo      string  `json:"partNo"`
+	PartName    string  `json:"partName"`
+	Quantity    float64 `json:"quantity"`
+	ExtendedQty float64 `json:"extendedQty"`
+}
+
+// explodeBOM returns the multi-level bill of materials of an assembly in
+// depth-first order.
+func explodeBOM(productID int) ([]BOMLine, error) {
+	rows, err := db.Query(`
+		WITH RECURSIVE tree(level, parent_id, child_id, quantity, extended, path) AS (
+			SELECT 1, parent_id, child_id, quantity, quantity, printf('%010d', id)
+			FROM bom_items WHERE parent_id = ?
+			UNION ALL
+			SELECT t.level + 1, b.parent_id, b.child_id, b.quantity, t.extended * b.quantity,
+				   t.path || '/' || printf('%010d', b.id)
+			FROM bom_items b JOIN tree t ON b.parent_id = t.child_id
+			WHERE t.level < ?
+		)
+		SELECT t.level, t.parent_id, p.id, p.partNo, p.partName, t.quantity, t.extended
+		FROM tree t JOIN products p ON p.id = t.child_id
+		ORDER BY t.path`, productID, maxBOMDepth)
+	if err != nil {
+		return nil, err
+	}
+	return scanBOMLines(rows)
+}
+
+// whereUsed returns every assembly that contains the product, directly
+// (level 1) or through sub-assemblies.
+func whereUsed(productID int) ([]BOMLine, error) {
+	rows, err := db.Query(`
+		WITH RECURSIVE used(level, child_id, parent_id, quantity, extended, path) AS (
+			SELECT 1, child_id, parent_id, quantity, quantity, printf('%010d', id)
+			FROM bom_items WHERE child_id = ?
+			UNION ALL
+			SELECT u.level + 1, b.child_id, b.parent_id, b.quantity, u.extended * b.quantity,
+				   u.path || '/' || printf('%010d', b.id)
+			FROM bom_items b JOIN used u ON b.child_id = u.parent_id
+			WHERE u.level < ?
+		)
+		SELECT u.level, u.child_id, p.id, p.partNo, p.partName, u.quantity, u.extended
+		FROM used u JOIN products p ON p.id = u.parent_id
+		ORDER BY u.path`, productID, maxBOMDepth)
+	if err != nil {
+		return nil, err
+	}
+	return scanBOMLines(rows)
+}
+
+func scanBOMLines(rows *sql.Rows) ([]BOMLine, error) {
+	defer rows.Close()
+	var lines []BOMLine
+	for rows.Next() {
+		var l BOMLine
+		var partName sql.NullString
+		if err := rows.Scan(&l.Level, &l.ParentID, &l.ProductID, &l.PartNo, &partName, &l.Quantity, &l.ExtendedQty); err != nil {
+			return nil, err
+		}
+		l.PartName = partName.String
+		lines = append(lines, l)
+	}
+	return lines, rows.Err()
+}
+
+// createsBOMCycle reports whether making childID a component of parentID
+// would make an assembly contain itself.
+func createsBOMCycle(q rowQuerier, parentID, childID int) (bool, error) {
+	if parentID == childID {
+		return true, nil
+	}
+	var cycle bool
+	err := q.QueryRow(`
+		WITH RECURSIVE descendants(id) AS (
+			SELECT ?
+			UNION
+			SELECT b.child_id FROM bom_items b JOIN descendants d ON b.parent_id = d.id
+		)
+		SELECT EXISTS(SELECT 1 FROM descendants WHERE id = ?)`, childID, parentID).Scan(&cycle)
+	return cycle, err
+}
+
+// bomAddHandler adds a component to an assembly, or changes its quantity if
+// it is already listed.
+func bomAddHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		ParentID    int     `json:"parentId"`
+		ChildPartNo string  `json:"childPartNo"`
+		Quantity    float64 `json:"quantity"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.Quantity <= 0 {
+		http.Error(w, "Quantity must be greater than zero", http.StatusBadRequest)
+		return
+	}
+
+	var parentExists bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM products WHERE id = ?)", request.ParentID).Scan(&parentExists); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !parentExists {
+		http.Error(w, "Assembly not found", http.StatusNotFound)
+		return
+	}
+
+	var childID int
+	err := db.QueryRow("SELECT id FROM products WHERE partNo = ?", strings.TrimSpace(request.ChildPartNo)).Scan(&childID)
+	if err == sql.ErrNoRows {
+		http.Error(w, fmt.Sprintf("Part %q not found", request.ChildPartNo), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The check and the insert share a transaction, so a concurrent add of
+	// the reverse line cannot slip in between them.
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	cycle, err := createsBOMCycle(tx, request.ParentID, childID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if cycle {
+		http.Error(w, fmt.Sprintf("Adding %s would make the assembly contain itself", request.ChildPartNo), http.StatusConflict)
+		return
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO bom_items(parent_id, child_id, quantity) VALUES(?, ?, ?)
+		ON CONFLICT(parent_id, child_id) DO UPDATE SET quantity = excluded.quantity`,
+		request.ParentID, childID, request.Quantity)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("BOM: product %d uses %g x %s", request.ParentID, request.Quantity, request.ChildPartNo)
+	if _, err := recalculateCostsWithParents(request.ParentID); err != nil {
+		log.Printf("Error costing product %d: %v", request.ParentID, err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "success",
+		"message": "Component saved",
+	})
+}
+
+func bomRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		ParentID int `json:"parentId"`
+		ChildID  int `json:"childId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM bom_items WHERE parent_id = ? AND child_id = ?", request.ParentID, request.ChildID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Component not found", http.StatusNotFound)
+		return
+	}
+	if _, err := recalculateCostsWithParents(request.ParentID); err != nil {
+		log.Printf("Error costing product %d: %v", request.ParentID, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "success",
+		"message": "Component removed",
+	})
+}
+
+// writeBOMSheet adds a "BOM" sheet listing the exploded bill of materials of
+// every assembly.
+func writeBOMSheet(f *excelize.File, headerStyle int) error {
+	sheetName := "BOM"
+	if _, err := f.NewSheet(sheetName); err != nil {
+		return err
+	}
+
+	headers := []string{"Assembly PartNo", "Assembly Name", "Level", "Component PartNo", "Component Name",
+		"Qty Per Parent", "Qty Per Assembly"}
+	for i, header := range headers {
+		cell := fmt.Sprintf("%c1", 'A'+i)
+		f.SetCellValue(sheetName, cell, header)
+		f.SetCellStyle(sheetName, cell, cell, headerStyle)
+	}
+
+	rows, err := db.Query(`
+		SELECT id, partNo, partName FROM products
+		WHERE id IN (SELECT parent_id FROM bom_items) ORDER BY partNo`)
+	if err != nil {
+		return err
+	}
+	type assembly struct {
+		id       int
+		partNo   string
+		partName sql.NullString
+	}
+	var assemblies []assembly
+	for rows.Next() {
+		var a assembly
+		if err := rows.Scan(&a.id, &a.partNo, &a.partName); err != nil {
+			rows.Close()
+			return err
+		}
+		assemblies = append(assemblies, a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rowNum := 2
+	for _, a := range assemblies {
+		lines, err := explodeBOM(a.id)
+		if err != nil {
+			return err
+		}
+		for _, l := range lines {
+			f.SetCellValue(sheetName, fmt.Sprintf("A%d", rowNum), a.partNo)
+			f.SetCellValue(sheetName, fmt.Sprintf("B%d", rowNum), a.partName.String)
+			f.SetCellValue(sheetName, fmt.Sprintf("C%d", rowNum), l.Level)
+			f.SetCellValue(sheetName, fmt.Sprintf("D%d", rowNum), strings.Repeat("  ", l.Level-1)+l.PartNo)
+			f.SetCellValue(sheetName, fmt.Sprintf("E%d", rowNum), l.PartName)
+			f.SetCellValue(sheetName, fmt.Sprintf("F%d", rowNum), l.Quantity)
+			f.SetCellValue(sheetName, fmt.Sprintf("G%d", rowNum), l.ExtendedQty)
+			rowNum++
+		}
+	}
+
+	f.SetColWidth(sheetName, "A", "A", 18)
+	f.SetColWidth(sheetName, "B", "B", 30)
+	f.SetColWidth(sheetName, "D", "D", 22)
+	f.SetColWidth(sheetName, "E", "E", 30)
+	f.SetColWidth(sheetName, "F", "G", 16)
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestBOMAddRejectsCycles adds the two lines of a cycle one after the other
+// and at the same time: at most one of them is stored.
+func TestBOMAddRejectsCycles(t *testing.T) {
+	setupTestDB(t)
+	db.SetMaxOpenConns(4)
+	add := func(parentID int, childPartNo string) int {
+		body := fmt.Sprintf(`{"parentId": %d, "childPartNo": %q, "quantity": 1}`, parentID, childPartNo)
+		return serve(http.MethodPost, "/bom/add", "application/json", strings.NewReader(body)).Code
+	}
+	product := func(partNo string) int {
+		res, err := db.Exec("INSERT INTO products(partNo) VALUES(?)", partNo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := res.LastInsertId()
+		return int(id)
+	}
+
+	a, b := product("A"), product("B")
+	if code := add(a, "B"); code != http.StatusOK {
+		t.Fatalf("adding B to A: %d", code)
+	}
+	if code := add(b, "A"); code != http.StatusConflict {
+		t.Errorf("adding A to B: %d, want %d", code, http.StatusConflict)
+	}
+	if code := add(a, "A"); code != http.StatusConflict {
+		t.Errorf("adding A to A: %d, want %d", code, http.StatusConflict)
+	}
+
+	for i := 0; i < 20; i++ {
+		c, d := product(fmt.Sprintf("C%d", i)), product(fmt.Sprintf("D%d", i))
+		var wg sync.WaitGroup
+		codes := make([]int, 2)
+		wg.Add(2)
+		go func() { defer wg.Done(); codes[0] = add(c, fmt.Sprintf("D%d", i)) }()
+		go func() { defer wg.Done(); codes[1] = add(d, fmt.Sprintf("C%d", i)) }()
+		wg.Wait()
+		var lines int
+		db.QueryRow("SELECT COUNT(*) FROM bom_items WHERE parent_id IN (?, ?)", c, d).Scan(&lines)
+		if lines > 1 {
+			t.Fatalf("concurrent adds stored both lines of a cycle: %v", codes)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Category groups products. Categories form a tree, e.g. Fixtures containing
+// Vises containing Soft jaws; Path is the chain of names from the top level
+// down, e.g. "Fixtures > Vises > Soft jaws".
+type Category struct {
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	ParentID int64  `json:"parentId,omitempty"`
+	Path     string `json:"path"`
+	Depth    int    `json:"depth"`
+}
+
+// categoryPathsCTE names every category with its path and depth. Queries
+// using it can select from category_paths.
+const categoryPathsCTE = `
+	WITH RECURSIVE category_paths(id, name, parent_id, path, depth) AS (
+		SELECT id, name, parent_id, name, 0 FROM categories WHERE parent_id IS NULL
+		UNION ALL
+		SELECT c.id, c.name, c.parent_id, cp.path || ' > ' || c.name, cp.depth + 1
+		FROM categories c JOIN category_paths cp ON c.parent_id = cp.id
+	)`
+
+// loadCategories returns all categories in tree order.
+func loadCategories() ([]Category, error) {
+	rows, err := db.Query(categoryPathsCTE + `
+		SELECT id, name, parent_id, path, depth FROM category_paths ORDER BY path COLLATE NOCASE`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var categories []Category
+	for rows.Next() {
+		var c Category
+		var parentID sql.NullInt64
+		if err := rows.Scan(&c.ID, &c.Name, &parentID, &c.Path, &c.Depth); err != nil {
+			return nil, err
+		}
+		c.ParentID = parentID.Int64
+		categories = append(categories, c)
+	}
+	return categories, rows.Err()
+}
+
+// inCategoryFilter restricts a product query to products in a category or
+// any category below it.
+const inCategoryFilter = `category_id IN (
+	WITH RECURSIVE sub(id) AS (
+		SELECT ?
+		UNION
+		SELECT c.id FROM categories c JOIN sub ON c.parent_id = sub.id
+	)
+	SELECT id FROM sub)`
+
+// taggedFilter restricts a product query to products carrying a tag.
+const taggedFilter = `id IN (
+	SELECT pt.product_id FROM product_tags pt JOIN tags t ON t.id = pt.tag_id
+	WHERE t.name = ?)`
+
+// saveCategory inserts c, or updates it when c.ID is set. A category cannot
+// be moved below itself.
+func saveCategory(c Category) error {
+	if c.Name == "" {
+		return fmt.Errorf("Name: category name is required")
+	}
+	if strings.Contains(c.Name, ">") {
+		return fmt.Errorf("Name: category name %q must not contain '>'", c.Name)
+	}
+	parent := sql.NullInt64{Int64: c.ParentID, Valid: c.ParentID != 0}
+
+	var err error
+	if c.ID == 0 {
+		_, err = db.Exec("INSERT INTO categories(name, parent_id) VALUES(?, ?)", c.Name, parent)
+	} else {
+		var cycle bool
+		err = db.QueryRow(`
+			WITH RECURSIVE sub(id) AS (
+				SELECT ?
+				UNION
+				SELECT c.id FROM categories c JOIN sub ON c.parent_id = sub.id
+			)
+			SELECT EXISTS(SELECT 1 FROM sub WHERE id = ?)`, c.ID, c.ParentID).Scan(&cycle)
+		if err != nil {
+			return err
+		}
+		if cycle {
+			return fmt.Errorf("Inside: a category cannot be moved into itself")
+		}
+		var res sql.Result
+		res, err = db.Exec("UPDATE categories SET name = ?, parent_id = ? WHERE id = ?", c.Name, parent, c.ID)
+		if err == nil {
+			if n, _ := res.RowsAffected(); n == 0 {
+				return fmt.Errorf("category %d does not exist", c.ID)
+			}
+		}
+	}
+	if err != nil && strings.Contains(err.Error(), "UNIQUE") {
+		return fmt.Errorf("Name: %s already exists there", c.Name)
+	}
+	if err != nil && strings.Contains(err.Error(), "FOREIGN KEY") {
+		return fmt.Errorf("Inside: category %d does not exist", c.ParentID)
+	}
+	return err
+}
+
+// deleteCategory removes a category. Its products are left uncategorised;
+// a category with subcategories cannot be deleted.
+func deleteCategory(id int64) error {
+	_, err := db.Exec("DELETE FROM categories WHERE id = ?", id)
+	if err != nil && strings.Contains(err.Error(), "FOREIGN KEY") {
+		return fmt.Errorf("the category has subcategories; move or delete them first")
+	}
+	return err
+}
+
+// parseTags reads a comma separated tag list, dropping blanks and repeats.
+func parseTags(s string) []string {
+	var tags []string
+	seen := map[string]bool{}
+	for _, t := range strings.Split(s, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" || seen[strings.ToLower(t)] {
+			continue
+		}
+		seen[strings.ToLower(t)] = true
+		tags = append(tags, t)
+	}
+	return tags
+}
+
+// tagID returns the id of a tag, creating the tag if it is new.
+func tagID(tx *sql.Tx, name string) (int64, error) {
+	if _, err := tx.Exec("INSERT INTO tags(name) VALUES(?) ON CONFLICT(name) DO NOTHING", name); err != nil {
+		return 0, err
+	}
+	var id int64
+	err := tx.QueryRow("SELECT id FROM tags WHERE name = ?", name).Scan(&id)
+	return id, err
+}
+
+func addProductTags(tx *sql.Tx, productID int, tags []string) error {
+	for _, name := range tags {
+		id, err := tagID(tx, name)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT OR IGNORE INTO product_tags(product_id, tag_id) VALUES(?, ?)", productID, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func removeProductTags(tx *sql.Tx, productID int, tags []string) error {
+	for _, name := range tags {
+		_, err := tx.Exec("DELETE FROM product_tags WHERE product_id = ? AND tag_id = (SELECT id FROM tags WHERE name = ?)",
+			productID, name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveProductTags replaces the tags of a product.
+func saveProductTags(tx *sql.Tx, productID int, tags []string) error {
+	if _, err := tx.Exec("DELETE FROM product_tags WHERE product_id = ?", productID); err != nil {
+		return err
+	}
+	return addProductTags(tx, productID, tags)
+}
+
+// loadTagsAndCategories fills in the category path and the tags of every
+// product in the slice.
+func loadTagsAndCategories(products []Product) error {
+	if len(products) == 0 {
+		return nil
+	}
+	categories, err := loadCategories()
+	if err != nil {
+		return err
+	}
+	paths := make(map[int64]string, len(categories))
+	for _, c := range categories {
+		paths[c.ID] = c.Path
+	}
+
+	index := make(map[int]int, len(products))
+	placeholders := make([]string, len(products))
+	args := make([]interface{}, len(products))
+	for i, p := range products {
+		products[i].Category = paths[p.CategoryID]
+		index[p.ID] = i
+		placeholders[i] = "?"
+		args[i] = p.ID
+	}
+
+	rows, err := db.Query(`
+		SELECT pt.product_id, t.name FROM product_tags pt JOIN tags t ON t.id = pt.tag_id
+		WHERE pt.product_id IN (`+strings.Join(placeholders, ",")+`)
+		ORDER BY t.name COLLATE NOCASE`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var productID int
+		var name string
+		if err := rows.Scan(&productID, &name); err != nil {
+			return err
+		}
+		if i, ok := index[productID]; ok {
+			products[i].Tags = append(products[i].Tags, name)
+		}
+	}
+	return rows.Err()
+}
+
+// loadAllTags returns the tags of every product, keyed by product id, for the
+// export.
+func loadAllTags() (map[int][]string, error) {
+	rows, err := db.Query(`
+		SELECT pt.product_id, t.name FROM product_tags pt JOIN tags t ON t.id = pt.tag_id
+		ORDER BY t.name COLLATE NOCASE`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := map[int][]string{}
+	for rows.Next() {
+		var productID int
+		var name string
+		if err := rows.Scan(&productID, &name); err != nil {
+			return nil, err
+		}
+		tags[productID] = append(tags[productID], name)
+	}
+	return tags, rows.Err()
+}
+
+// productsBulkHandler sets the category of, or adds and removes tags on, a
+// selection of products at once. A null or missing categoryId leaves the
+// categories alone; 0 clears them.
+func productsBulkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		ProductIDs []int    `json:"productIds"`
+		CategoryID *int64   `json:"categoryId"`
+		AddTags    []string `json:"addTags"`
+		RemoveTags []string `json:"removeTags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(request.ProductIDs) == 0 {
+		http.Error(w, "No products selected", http.StatusBadRequest)
+		return
+	}
+	addTags := parseTags(strings.Join(request.AddTags, ","))
+	removeTags := parseTags(strings.Join(request.RemoveTags, ","))
+
+	before := make(map[int]map[string]string, len(request.ProductIDs))
+	for _, id := range request.ProductIDs {
+		before[id] = auditSnapshot(id)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if request.CategoryID != nil && *request.CategoryID != 0 {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM categories WHERE id = ?)", *request.CategoryID).Scan(&exists); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Category not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	for _, id := range request.ProductIDs {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM products WHERE id = ?)", id).Scan(&exists); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, fmt.Sprintf("Product %d not found", id), http.StatusNotFound)
+			return
+		}
+		if request.CategoryID != nil {
+			category := sql.NullInt64{Int64: *request.CategoryID, Valid: *request.CategoryID != 0}
+			if _, err := tx.Exec("UPDATE products SET category_id = ? WHERE id = ?", category, id); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := addProductTags(tx, id, addTags); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := removeProductTags(tx, id, removeTags); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for _, id := range request.ProductIDs {
+		auditProductChange(id, "update", before[id])
+	}
+
+	log.Printf("Bulk update of %d products", len(request.ProductIDs))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "success",
+		"message": fmt.Sprintf("Updated %d products", len(request.ProductIDs)),
+	})
+}
+
+// categoriesHandler lists the category tree (GET) and adds a category,
+// updates the one named by the id field or, with delete set, removes it
+// (POST).
+func categoriesHandler(w http.ResponseWriter, r *http.Request) {
+	var formError string
+	if r.Method == http.MethodPost {
+		c := Category{
+			ID:   parseOptionalID(r.FormValue("id")).Int64,
+			Name: strings.TrimSpace(r.FormValue("name")),
+		}
+		c.ParentID, _ = strconv.ParseInt(r.FormValue("parentId"), 10, 64)
+
+		var err error
+		if r.FormValue("delete") != "" && c.ID != 0 {
+			err = deleteCategory(c.ID)
+		} else {
+			err = saveCategory(c)
+		}
+		if err == nil {
+			http.Redirect(w, r, "/categories", http.StatusSeeOther)
+			return
+		}
+		formError = err.Error()
+		w.WriteHeader(http.StatusBadRequest)
+	}
+
+	categories, err := loadCategories()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tmpl := template.Must(template.New("categories.html").Funcs(funcMap).ParseFiles("templates/categories.html"))
+	err = tmpl.Execute(w, struct {
+		Categories []Category
+		Error      string
+	}{categories, formError})
+	if err != nil {
+		log.Printf("Error rendering categories: %v", err)
+	}
+}
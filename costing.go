@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// costDriftTolerance is how far, as a fraction of the computed unit cost, the
+// typed Part Cost may differ before it is flagged.
+const costDriftTolerance = 0.05
+
+// CostBreakdown is the unit cost of a part rolled up from its material,
+// finishing, routing and components, for a batch of BatchSize parts. Setup is
+// the batch's setup cost spread over the batch. Amounts that cannot be added
+// up (a work center or component in another currency, a component without a
+// cost) are left out and described in Problems.
+type CostBreakdown struct {
+	ProductID  int             `json:"productId"`
+	BatchSize  int             `json:"batchSize"`
+	Currency   string          `json:"currency"`
+	Material   Amount          `json:"materialMinor"`
+	Finishing  Amount          `json:"finishingMinor"`
+	Setup      Amount          `json:"setupMinor"`
+	Machining  Amount          `json:"machiningMinor"`
+	Components Amount          `json:"componentsMinor"`
+	Total      Amount          `json:"totalMinor"`
+	Operations []OperationCost `json:"operations,omitempty"`
+	Children   []ComponentCost `json:"components,omitempty"`
+	Problems   []string        `json:"problems,omitempty"`
+}
+
+// OperationCost is the share of one routing operation in a unit cost.
+type OperationCost struct {
+	OpNo       int    `json:"opNo"`
+	WorkCenter string `json:"workCenter"`
+	Setup      Amount `json:"setupMinor"`
+	Cycle      Amount `json:"cycleMinor"`
+}
+
+// ComponentCost is one direct component of an assembly. A component without
+// a routing or components of its own is Purchased: its Part Cost is what it
+// is bought for. Cost is UnitCost times Quantity.
+type ComponentCost struct {
+	ProductID int     `json:"productId"`
+	PartNo    string  `json:"partNo"`
+	PartName  string  `json:"partName"`
+	Quantity  float64 `json:"quantity"`
+	Purchased bool    `json:"purchased"`
+	UnitCost  Amount  `json:"unitCostMinor"`
+	Cost      Amount  `json:"costMinor"`
+}
+
+// costDrifts reports whether the typed cost differs from the computed one by
+// more than costDriftTolerance. Nothing is flagged until both are known.
+func costDrifts(typed, computed Amount) bool {
+	if !typed.Valid || !computed.Valid || computed.Minor == 0 {
+		return false
+	}
+	return math.Abs(float64(typed.Minor-computed.Minor)) > costDriftTolerance*float64(computed.Minor)
+}
+
+// CostDrift reports whether the Part Cost has drifted from the unit cost last
+// computed by recalculateCosts.
+func (p Product) CostDrift() bool {
+	return costDrifts(p.Cost, p.ComputedCost)
+}
+
+// costKey identifies a roll-up already done while costing an assembly.
+type costKey struct {
+	productID int
+	batchSize int
+}
+
+// rollUpCost computes the unit cost of a product made in batches of
+// batchSize.
+func rollUpCost(productID, batchSize int) (CostBreakdown, error) {
+	return rollUp(productID, batchSize, 0, map[costKey]CostBreakdown{})
+}
+
+func rollUp(productID, batchSize, depth int, done map[costKey]CostBreakdown) (CostBreakdown, error) {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	key := costKey{productID, batchSize}
+	if b, ok := done[key]; ok {
+		return b, nil
+	}
+
+	b := CostBreakdown{ProductID: productID, BatchSize: batchSize}
+	var materialCost, finishingCost Amount
+	err := db.QueryRow("SELECT currency, material_cost_minor, finishing_cost_minor FROM products WHERE id = ?",
+		productID).Scan(&b.Currency, &materialCost, &finishingCost)
+	if err != nil {
+		return b, err
+	}
+	b.Material = Amount{Minor: materialCost.Minor, Valid: true}
+	b.Finishing = Amount{Minor: finishingCost.Minor, Valid: true}
+	b.Setup = Amount{Valid: true}
+	b.Machining = Amount{Valid: true}
+	b.Components = Amount{Valid: true}
+
+	ops, err := loadRouting(productID)
+	if err != nil {
+		return b, err
+	}
+	for _, o := range ops {
+		if o.Currency != b.Currency {
+			b.Problems = append(b.Problems, fmt.Sprintf("Op %d: work center %s is priced in %s, not %s", o.OpNo, o.WorkCenter, o.Currency, b.Currency))
+			continue
+		}
+		oc := OperationCost{
+			OpNo:       o.OpNo,
+			WorkCenter: o.WorkCenter,
+			Setup:      Amount{Minor: int64(math.Round(float64(o.SetupCost().Minor) / float64(batchSize))), Valid: true},
+			Cycle:      Amount{Minor: o.CycleCost().Minor, Valid: true},
+		}
+		b.Setup.Minor += oc.Setup.Minor
+		b.Machining.Minor += oc.Cycle.Minor
+		b.Operations = append(b.Operations, oc)
+	}
+
+	if depth < maxBOMDepth {
+		children, err := loadComponents(productID)
+		if err != nil {
+			return b, err
+		}
+		for _, c := range children {
+			// The batch needs this many of the component, so that is the
+			// component's own batch size.
+			childBatch := int(math.Ceil(float64(batchSize) * c.Quantity))
+			cb, err := rollUp(c.ProductID, childBatch, depth+1, done)
+			if err != nil {
+				return b, err
+			}
+			var typed Amount
+			if err := db.QueryRow("SELECT cost_minor FROM products WHERE id = ?", c.ProductID).Scan(&typed); err != nil {
+				return b, err
+			}
+			// Problems mean operations or components were left out, so the
+			// part is still made rather than bought.
+			c.Purchased = len(cb.Operations) == 0 && len(cb.Children) == 0 && len(cb.Problems) == 0
+			c.UnitCost = cb.Total
+			if c.Purchased && typed.Valid {
+				c.UnitCost = typed
+			}
+			switch {
+			case cb.Currency != b.Currency:
+				b.Problems = append(b.Problems, fmt.Sprintf("Component %s is priced in %s, not %s", c.PartNo, cb.Currency, b.Currency))
+				continue
+			case c.UnitCost.Minor == 0:
+				b.Problems = append(b.Problems, fmt.Sprintf("Component %s has no cost", c.PartNo))
+			}
+			for _, p := range cb.Problems {
+				b.Problems = append(b.Problems, c.PartNo+": "+p)
+			}
+			c.Cost = Amount{Minor: int64(math.Round(float64(c.UnitCost.Minor) * c.Quantity)), Valid: true}
+			b.Components.Minor += c.Cost.Minor
+			b.Children = append(b.Children, c)
+		}
+	}
+
+	b.Total = Amount{
+		Minor: b.Material.Minor + b.Finishing.Minor + b.Setup.Minor + b.Machining.Minor + b.Components.Minor,
+		Valid: true,
+	}
+	done[key] = b
+	return b, nil
+}
+
+// loadComponents returns the direct components of an assembly.
+func loadComponents(productID int) ([]ComponentCost, error) {
+	rows, err := db.Query(`
+		SELECT p.id, p.partNo, IFNULL(p.partName, ''), b.quantity
+		FROM bom_items b JOIN products p ON p.id = b.child_id
+		WHERE b.parent_id = ?
+		ORDER BY b.id`, productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var children []ComponentCost
+	for rows.Next() {
+		var c ComponentCost
+		if err := rows.Scan(&c.ProductID, &c.PartNo, &c.PartName, &c.Quantity); err != nil {
+			return nil, err
+		}
+		children = append(children, c)
+	}
+	return children, rows.Err()
+}
+
+// recalculateCosts rolls up and stores the unit cost of the given products,
+// or of every product when ids is empty, each at its standard batch size.
+// It returns the number of products costed.
+func recalculateCosts(ids ...int) (int, error) {
+	query := "SELECT p.id, IFNULL(c.batch_size, 1) FROM products p LEFT JOIN product_costs c ON c.product_id = p.id"
+	var args []interface{}
+	if len(ids) > 0 {
+		query += " WHERE p.id IN (?" + strings.Repeat(", ?", len(ids)-1) + ")"
+		for _, id := range ids {
+			args = append(args, id)
+		}
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	var keys []costKey
+	for rows.Next() {
+		var k costKey
+		if err := rows.Scan(&k.productID, &k.batchSize); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		keys = append(keys, k)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	done := map[costKey]CostBreakdown{}
+	for _, k := range keys {
+		b, err := rollUp(k.productID, k.batchSize, 0, done)
+		if err != nil {
+			return 0, fmt.Errorf("costing product %d: %w", k.productID, err)
+		}
+		if err := storeComputedCost(b); err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), nil
+}
+
+// recalculateCostsWithParents recalculates the given products and every
+// assembly that uses them, directly or through sub-assemblies, whose roll-up
+// includes their cost. It returns the number of products costed.
+func recalculateCostsWithParents(ids ...int) (int, error) {
+	seen := map[int]bool{}
+	var affected []int
+	for _, id := range ids {
+		parents, err := whereUsed(id)
+		if err != nil {
+			return 0, err
+		}
+		for _, candidate := range append([]int{id}, parentIDs(parents)...) {
+			if !seen[candidate] {
+				seen[candidate] = true
+				affected = append(affected, candidate)
+			}
+		}
+	}
+	if len(affected) == 0 {
+		return 0, nil
+	}
+	return recalculateCosts(affected...)
+}
+
+// recalculateCostsWhere recalculates the products selected by where, and the
+// assemblies using them, after a catalog entry they are costed from changed.
+func recalculateCostsWhere(where string, args ...any) (int, error) {
+	rows, err := db.Query("SELECT id FROM products WHERE "+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	return recalculateCostsWithParents(ids...)
+}
+
+// parentIDs returns the assemblies of where-used lines.
+func parentIDs(lines []BOMLine) []int {
+	ids := make([]int, len(lines))
+	for i, l := range lines {
+		ids[i] = l.ProductID
+	}
+	return ids
+}
+
+func storeComputedCost(b CostBreakdown) error {
+	_, err := db.Exec(`
+		INSERT INTO product_costs(product_id, batch_size, unit_cost_minor, currency, computed_at)
+		VALUES(?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(product_id) DO UPDATE SET
+			batch_size = excluded.batch_size, unit_cost_minor = excluded.unit_cost_minor,
+			currency = excluded.currency, computed_at = excluded.computed_at`,
+		b.ProductID, b.BatchSize, b.Total, b.Currency)
+	return err
+}
+
+// costsRecalculateHandler is the "recalculate all" job. With a productId it
+// only recalculates that product, after making batchSize its standard batch
+// size when one is given.
+func costsRecalculateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		ProductID int `json:"productId"`
+		BatchSize int `json:"batchSize"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if request.BatchSize < 0 {
+		http.Error(w, "Batch size must be greater than zero", http.StatusBadRequest)
+		return
+	}
+
+	var n int
+	var err error
+	if request.ProductID == 0 {
+		n, err = recalculateCosts()
+	} else {
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM products WHERE id = ?)", request.ProductID).Scan(&exists); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Product not found", http.StatusNotFound)
+			return
+		}
+		if request.BatchSize > 0 {
+			var b CostBreakdown
+			if b, err = rollUpCost(request.ProductID, request.BatchSize); err == nil {
+				err = storeComputedCost(b)
+				n = 1
+			}
+		} else {
+			n, err = recalculateCosts(request.ProductID)
+		}
+	}
+	if err != nil {
+		http.Error(w, "Error recalculating costs: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Costs: recalculated %d products", n)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "success",
+		"message": fmt.Sprintf("Recalculated %d products", n),
+	})
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestStoredCostsFollowChanges checks that the stored unit costs of a part
+// and of the assembly using it are recalculated when the part's routing, the
+// work center rate or the bill of materials changes.
+func TestStoredCostsFollowChanges(t *testing.T) {
+	setupTestDB(t)
+	post := func(target, body string) {
+		t.Helper()
+		if w := serve(http.MethodPost, target, "application/json", strings.NewReader(body)); w.Code >= 300 {
+			t.Fatalf("POST %s: %d %s", target, w.Code, w.Body)
+		}
+	}
+	workCenter := func(values url.Values) {
+		t.Helper()
+		if w := postForm("/work-centers", values); w.Code != http.StatusSeeOther {
+			t.Fatalf("saving work center: %d %s", w.Code, w.Body)
+		}
+	}
+	check := func(step string, part, assembly int64) {
+		t.Helper()
+		for id, want := range map[int]int64{1: part, 2: assembly} {
+			var got int64
+			if err := db.QueryRow("SELECT unit_cost_minor FROM product_costs WHERE product_id = ?", id).Scan(&got); err != nil {
+				t.Fatalf("%s: product %d: %v", step, id, err)
+			}
+			if got != want {
+				t.Errorf("%s: product %d costs %d, want %d", step, id, got, want)
+			}
+		}
+	}
+
+	post("/api/products", `{"partNo": "C", "materialCostMinor": 1000}`)
+	post("/api/products", `{"partNo": "A"}`)
+	post("/bom/add", `{"parentId": 2, "childPartNo": "C", "quantity": 2}`)
+	check("component added", 1000, 2000)
+
+	workCenter(url.Values{"code": {"MILL"}, "rate": {"60.00"}})
+	post("/routing/add", `{"productId": 1, "opNo": 10, "workCenterId": 1, "cycleMinutes": 30}`)
+	check("operation added", 4000, 8000)
+
+	workCenter(url.Values{"id": {"1"}, "code": {"MILL"}, "rate": {"120.00"}})
+	check("rate changed", 7000, 14000)
+
+	post("/routing/remove", `{"productId": 1, "opNo": 10}`)
+	check("operation removed", 1000, 2000)
+
+	post("/bom/remove", `{"parentId": 2, "childId": 1}`)
+	check("component removed", 1000, 0)
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// customFieldTypes lists the kinds of value a custom field can hold.
+var customFieldTypes = []struct {
+	Code  string
+	Label string
+}{
+	{"text", "Text"},
+	{"number", "Number"},
+	{"date", "Date"},
+	{"select", "Select list"},
+	{"boolean", "Yes/No"},
+}
+
+func isCustomFieldType(code string) bool {
+	for _, t := range customFieldTypes {
+		if t.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// customFieldPrefix marks the query parameters and sort keys of
+// /api/products that name a custom field, e.g. field.Customer=ACME.
+const customFieldPrefix = "field."
+
+// CustomField is an extra product attribute defined on the /fields page.
+// Options are the choices of a select list.
+type CustomField struct {
+	ID       int64    `json:"id"`
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Options  []string `json:"options,omitempty"`
+	Position int      `json:"position"`
+}
+
+// SortKey is the sort parameter that orders the product list by the field.
+func (f CustomField) SortKey() string {
+	return customFieldPrefix + f.Name
+}
+
+// InputName is the name of the field's input on the product forms.
+func (f CustomField) InputName() string {
+	return fmt.Sprintf("field_%d", f.ID)
+}
+
+// Display formats a stored value for the product pages.
+func (f CustomField) Display(value string) string {
+	if f.Type == "boolean" {
+		if value == "1" {
+			return "Yes"
+		}
+		return "No"
+	}
+	return value
+}
+
+// normalize checks a value typed for the field and returns it in the form it
+// is stored in. An empty value clears the field.
+func (f CustomField) normalize(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", nil
+	}
+	switch f.Type {
+	case "number":
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", fmt.Errorf("%q is not a number", value)
+		}
+		return strconv.FormatFloat(n, 'f', -1, 64), nil
+	case "date":
+		if _, err := time.Parse("2006-01-02", value); err != nil {
+			return "", fmt.Errorf("%q is not a date (YYYY-MM-DD)", value)
+		}
+	case "select":
+		for _, o := range f.Options {
+			if o == value {
+				return value, nil
+			}
+		}
+		return "", fmt.Errorf("%q is not one of the choices", value)
+	case "boolean":
+		switch strings.ToLower(value) {
+		case "1", "true", "yes", "on":
+			return "1", nil
+		case "0", "false", "no", "off":
+			return "", nil
+		}
+		return "", fmt.Errorf("%q is not yes or no", value)
+	}
+	return value, nil
+}
+
+// valueColumn is the SQL expression reading the field's value of the
+// product in the current row, typed so numbers sort numerically.
+func (f CustomField) valueColumn() string {
+	column := fmt.Sprintf("(SELECT value FROM product_field_values WHERE product_id = products.id AND field_id = %d)", f.ID)
+	if f.Type == "number" {
+		column = "CAST(" + column + " AS REAL)"
+	}
+	return column
+}
+
+func scanCustomField(s rowScanner) (CustomField, error) {
+	var f CustomField
+	var options string
+	if err := s.Scan(&f.ID, &f.Name, &f.Type, &options, &f.Position); err != nil {
+		return f, err
+	}
+	f.Options = splitFieldOptions(options)
+	return f, nil
+}
+
+// splitFieldOptions reads the choices of a select list, one per line.
+func splitFieldOptions(s string) []string {
+	var options []string
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			options = append(options, line)
+		}
+	}
+	return options
+}
+
+const customFieldColumns = "id, name, type, IFNULL(options, ''), position"
+
+func loadCustomFields() ([]CustomField, error) {
+	rows, err := db.Query("SELECT " + customFieldColumns + " FROM custom_fields ORDER BY position, name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var fields []CustomField
+	for rows.Next() {
+		f, err := scanCustomField(rows)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+	return fields, rows.Err()
+}
+
+// findCustomFieldByName looks a field up by its name, ignoring case.
+func findCustomFieldByName(name string) (CustomField, error) {
+	return scanCustomField(db.QueryRow("SELECT "+customFieldColumns+" FROM custom_fields WHERE name = ?", name))
+}
+
+// customFieldSortColumn returns the ORDER BY expression for a sort key made
+// with CustomField.SortKey.
+func customFieldSortColumn(sortBy string) (string, bool) {
+	name, ok := strings.CutPrefix(sortBy, customFieldPrefix)
+	if !ok {
+		return "", false
+	}
+	f, err := findCustomFieldByName(name)
+	if err != nil {
+		return "", false
+	}
+	return f.valueColumn(), true
+}
+
+// customFieldFilters turns the field.<name>=value parameters of a product
+// query into conditions. Text fields match on part of the value, the other
+// types on the whole value.
+func customFieldFilters(params url.Values) ([]string, []interface{}, error) {
+	var conditions []string
+	var args []interface{}
+	for key, values := range params {
+		name, ok := strings.CutPrefix(key, customFieldPrefix)
+		if !ok {
+			continue
+		}
+		f, err := findCustomFieldByName(name)
+		if err == sql.ErrNoRows {
+			return nil, nil, fmt.Errorf("Unknown custom field %q", name)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, v := range values {
+			if f.Type == "text" {
+				conditions = append(conditions, f.valueColumn()+" LIKE ?")
+				args = append(args, "%"+v+"%")
+				continue
+			}
+			value, err := f.normalize(v)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %v", f.Name, err)
+			}
+			if f.Type == "boolean" && value == "" {
+				conditions = append(conditions, f.valueColumn()+" IS NULL")
+				continue
+			}
+			if f.Type == "number" {
+				conditions = append(conditions, f.valueColumn()+" = CAST(? AS REAL)")
+			} else {
+				conditions = append(conditions, f.valueColumn()+" = ?")
+			}
+			args = append(args, value)
+		}
+	}
+	return conditions, args, nil
+}
+
+// loadFieldValues fills in the custom field values of the products.
+func loadFieldValues(products []Product) error {
+	if len(products) == 0 {
+		return nil
+	}
+	index := make(map[int]int, len(products))
+	placeholders := make([]string, len(products))
+	args := make([]interface{}, len(products))
+	for i, p := range products {
+		index[p.ID] = i
+		placeholders[i] = "?"
+		args[i] = p.ID
+	}
+
+	rows, err := db.Query(`
+		SELECT v.product_id, f.name, v.value
+		FROM product_field_values v JOIN custom_fields f ON f.id = v.field_id
+		WHERE v.product_id IN (`+strings.Join(placeholders, ",")+`)`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var productID int
+		var name, value string
+		if err := rows.Scan(&productID, &name, &value); err != nil {
+			return err
+		}
+		p := &products[index[productID]]
+		if p.Fields == nil {
+			p.Fields = map[string]string{}
+		}
+		p.Fields[name] = value
+	}
+	return rows.Err()
+}
+
+// parseCustomFieldValues reads the custom field inputs of the product forms.
+// The values are keyed by field name, as in Product.Fields, and hold what was
+// typed even when err is set, so the form can be shown again.
+func parseCustomFieldValues(r *http.Request) ([]CustomField, map[string]string, error) {
+	fields, err := loadCustomFields()
+	if err != nil {
+		return nil, nil, err
+	}
+	values := map[string]string{}
+	var problems []string
+	for _, f := range fields {
+		typed := r.FormValue(f.InputName())
+		value, err := f.normalize(typed)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", f.Name, err))
+			value = typed
+		}
+		if value != "" {
+			values[f.Name] = value
+		}
+	}
+	if len(problems) > 0 {
+		return fields, values, fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return fields, values, nil
+}
+
+// saveCustomFieldValues stores the values parsed by parseCustomFieldValues,
+// clearing the fields left empty.
+func saveCustomFieldValues(tx *sql.Tx, productID int, fields []CustomField, values map[string]string) error {
+	for _, f := range fields {
+		var err error
+		if value, ok := values[f.Name]; ok {
+			_, err = tx.Exec(`
+				INSERT INTO product_field_values(product_id, field_id, value) VALUES(?, ?, ?)
+				ON CONFLICT(product_id, field_id) DO UPDATE SET value = excluded.value`,
+				productID, f.ID, value)
+		} else {
+			_, err = tx.Exec("DELETE FROM product_field_values WHERE product_id = ? AND field_id = ?", productID, f.ID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadAllFieldValues returns the custom field values of every product, keyed
+// by product id and then field id, for the export.
+func loadAllFieldValues() (map[int]map[int64]string, error) {
+	rows, err := db.Query("SELECT product_id, field_id, value FROM product_field_values")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := map[int]map[int64]string{}
+	for rows.Next() {
+		var productID int
+		var fieldID int64
+		var value string
+		if err := rows.Scan(&productID, &fieldID, &value); err != nil {
+			return nil, err
+		}
+		if values[productID] == nil {
+			values[productID] = map[int64]string{}
+		}
+		values[productID][fieldID] = value
+	}
+	return values, rows.Err()
+}
+
+// saveCustomField inserts f, or updates it when f.ID is set. The type of a
+// field cannot be changed once products use it, and a choice cannot be
+// dropped from a select list while a product has it.
+func saveCustomField(f CustomField) error {
+	if f.Name == "" {
+		return fmt.Errorf("Name: field name is required")
+	}
+	if strings.ContainsAny(f.Name, "\n\r") {
+		return fmt.Errorf("Name: field name must be on one line")
+	}
+	if !isCustomFieldType(f.Type) {
+		return fmt.Errorf("Type: %q is not a field type", f.Type)
+	}
+	if f.Type == "select" && len(f.Options) == 0 {
+		return fmt.Errorf("Choices: a select list needs at least one choice")
+	}
+
+	var err error
+	if f.ID == 0 {
+		_, err = db.Exec("INSERT INTO custom_fields(name, type, options, position) VALUES(?, ?, ?, ?)",
+			f.Name, f.Type, strings.Join(f.Options, "\n"), f.Position)
+	} else {
+		var old CustomField
+		old, err = scanCustomField(db.QueryRow("SELECT "+customFieldColumns+" FROM custom_fields WHERE id = ?", f.ID))
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("custom field %d does not exist", f.ID)
+		}
+		if err != nil {
+			return err
+		}
+		var used []string
+		rows, err := db.Query("SELECT DISTINCT value FROM product_field_values WHERE field_id = ?", f.ID)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var v string
+			if err := rows.Scan(&v); err != nil {
+				rows.Close()
+				return err
+			}
+			used = append(used, v)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if f.Type != old.Type && len(used) > 0 {
+			return fmt.Errorf("Type: %s is in use, its type cannot be changed", old.Name)
+		}
+		if f.Type == "select" {
+			for _, v := range used {
+				if _, err := f.normalize(v); err != nil {
+					return fmt.Errorf("Choices: %q is still used by products", v)
+				}
+			}
+		}
+		_, err = db.Exec("UPDATE custom_fields SET name = ?, type = ?, options = ?, position = ? WHERE id = ?",
+			f.Name, f.Type, strings.Join(f.Options, "\n"), f.Position, f.ID)
+	}
+	if err != nil && strings.Contains(err.Error(), "UNIQUE") {
+		return fmt.Errorf("Name: a field named %s already exists", f.Name)
+	}
+	return err
+}
+
+// customFieldsHandler lists the custom fields (GET) and adds one, updates the
+// one named by the id field or, with delete set, removes it together with its
+// values (POST).
+func customFieldsHandler(w http.ResponseWriter, r *http.Request) {
+	var formError string
+	if r.Method == http.MethodPost {
+		f := CustomField{
+			ID:      parseOptionalID(r.FormValue("id")).Int64,
+			Name:    strings.TrimSpace(r.FormValue("name")),
+			Type:    r.FormValue("type"),
+			Options: splitFieldOptions(r.FormValue("options")),
+		}
+		f.Position, _ = strconv.Atoi(r.FormValue("position"))
+
+		var err error
+		if r.FormValue("delete") != "" && f.ID != 0 {
+			_, err = db.Exec("DELETE FROM custom_fields WHERE id = ?", f.ID)
+		} else {
+			err = saveCustomField(f)
+		}
+		if err == nil {
+			http.Redirect(w, r, "/fields", http.StatusSeeOther)
+			return
+		}
+		formError = err.Error()
+		w.WriteHeader(http.StatusBadRequest)
+	}
+
+	fields, err := loadCustomFields()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tmpl := template.Must(template.New("fields.html").Funcs(funcMap).ParseFiles("templates/fields.html"))
+	err = tmpl.Execute(w, struct {
+		Fields []CustomField
+		Error  string
+	}{fields, formError})
+	if err != nil {
+		log.Printf("Error rendering custom fields: %v", err)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// facetFilter is a condition of a product listing set by one of its facets.
+// Facet counts are computed with the filters of every other facet, so the
+// values not chosen yet still show how many products they would add.
+type facetFilter struct {
+	facet     string
+	condition string
+	args      []interface{}
+}
+
+// FacetCount is a value of a facet with the number of products listed that
+// have it.
+type FacetCount struct {
+	Value    string `json:"value"`
+	Count    int    `json:"count"`
+	Selected bool   `json:"selected,omitempty"`
+}
+
+// PresenceCount is the number of products listed with and without a file in
+// an attachment category. Filter is "with" or "without" when the listing is
+// limited to either.
+type PresenceCount struct {
+	Category string `json:"category"`
+	With     int    `json:"with"`
+	Without  int    `json:"without"`
+	Filter   string `json:"filter,omitempty"`
+}
+
+// Facets are the value counts of a product listing, with the range filters
+// it was given.
+type Facets struct {
+	Material      []FacetCount    `json:"material"`
+	FinishingType []FacetCount    `json:"finishingType"`
+	Has           []PresenceCount `json:"has"`
+	QtyMin        string          `json:"qtyMin,omitempty"`
+	QtyMax        string          `json:"qtyMax,omitempty"`
+	CreatedFrom   string          `json:"createdFrom,omitempty"`
+	CreatedTo     string          `json:"createdTo,omitempty"`
+	UpdatedFrom   string          `json:"updatedFrom,omitempty"`
+	UpdatedTo     string          `json:"updatedTo,omitempty"`
+}
+
+// valueFacets are the facets counting the values of a products column. A
+// product matches a facet given several values when it has any of them.
+var valueFacets = []struct{ Param, Column string }{
+	{"material", "material"},
+	{"finishing_type", "finishing_type"},
+}
+
+// facetParams are the parameters read by parseFacetFilters.
+var facetParams = []string{"material", "finishing_type", "has", "qty_min", "qty_max",
+	"created_from", "created_to", "updated_from", "updated_to"}
+
+func isFacetParam(name string) bool {
+	for _, p := range facetParams {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseFacetFilters reads the facet parameters of a product listing:
+// material and finishing_type, has=<category> or has=-<category> for
+// products with or without a file in an attachment category, qty_min and
+// qty_max, and created_from, created_to, updated_from and updated_to as
+// inclusive dates. Empty values are ignored.
+func parseFacetFilters(params url.Values) ([]facetFilter, Facets, error) {
+	var filters []facetFilter
+	var ranges Facets
+
+	for _, f := range valueFacets {
+		values := nonEmptyValues(params[f.Param])
+		if len(values) == 0 {
+			continue
+		}
+		args := make([]interface{}, len(values))
+		for i, v := range values {
+			args[i] = v
+		}
+		filters = append(filters, facetFilter{f.Param,
+			f.Column + " IN (?" + strings.Repeat(", ?", len(values)-1) + ")", args})
+	}
+
+	for _, v := range nonEmptyValues(params["has"]) {
+		category, without := strings.CutPrefix(v, "-")
+		if !isAttachmentCategory(category) {
+			return nil, ranges, fmt.Errorf("has: %q is not an attachment category", category)
+		}
+		condition := "EXISTS (SELECT 1 FROM attachments WHERE product_id = products.id AND category = ?)"
+		if without {
+			condition = "NOT " + condition
+		}
+		filters = append(filters, facetFilter{"has", condition, []interface{}{category}})
+	}
+
+	ranges.QtyMin = strings.TrimSpace(params.Get("qty_min"))
+	ranges.QtyMax = strings.TrimSpace(params.Get("qty_max"))
+	for _, r := range []struct{ param, value, op string }{
+		{"qty_min", ranges.QtyMin, ">="},
+		{"qty_max", ranges.QtyMax, "<="},
+	} {
+		if r.value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(r.value)
+		if err != nil {
+			return nil, ranges, fmt.Errorf("%s: %q is not a whole number", r.param, r.value)
+		}
+		filters = append(filters, facetFilter{"qty", "qty " + r.op + " ?", []interface{}{n}})
+	}
+
+	ranges.CreatedFrom = strings.TrimSpace(params.Get("created_from"))
+	ranges.CreatedTo = strings.TrimSpace(params.Get("created_to"))
+	ranges.UpdatedFrom = strings.TrimSpace(params.Get("updated_from"))
+	ranges.UpdatedTo = strings.TrimSpace(params.Get("updated_to"))
+	for _, r := range []struct{ param, value, column, condition string }{
+		{"created_from", ranges.CreatedFrom, "created_at", " >= ?"},
+		{"created_to", ranges.CreatedTo, "created_at", " < DATE(?, '+1 day')"},
+		{"updated_from", ranges.UpdatedFrom, "updated_at", " >= ?"},
+		{"updated_to", ranges.UpdatedTo, "updated_at", " < DATE(?, '+1 day')"},
+	} {
+		if r.value == "" {
+			continue
+		}
+		d, err := time.Parse("2006-01-02", r.value)
+		if err != nil {
+			return nil, ranges, fmt.Errorf("%s: %q is not a date (YYYY-MM-DD)", r.param, r.value)
+		}
+		filters = append(filters, facetFilter{r.column, r.column + r.condition, []interface{}{d.Format("2006-01-02")}})
+	}
+	return filters, ranges, nil
+}
+
+func nonEmptyValues(values []string) []string {
+	var out []string
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// facets counts the material, finishing and attachment values of the
+// products the listing matches. Chosen values are listed even when no
+// product matching the other filters has them, so they can be cleared.
+func (l productListing) facets() (Facets, error) {
+	f := l.ranges
+	for _, vf := range valueFacets {
+		query, args := l.source(vf.Column + ", COUNT(*)")
+		where, whereArgs := l.filter(vf.Param, vf.Column+" <> ''")
+		rows, err := db.Query(query+where+" GROUP BY "+vf.Column+" ORDER BY COUNT(*) DESC, "+vf.Column,
+			append(args, whereArgs...)...)
+		if err != nil {
+			return f, err
+		}
+		var counts []FacetCount
+		for rows.Next() {
+			var c FacetCount
+			if err := rows.Scan(&c.Value, &c.Count); err != nil {
+				rows.Close()
+				return f, err
+			}
+			counts = append(counts, c)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return f, err
+		}
+
+		for _, v := range nonEmptyValues(l.params[vf.Param]) {
+			found := false
+			for i := range counts {
+				if counts[i].Value == v {
+					counts[i].Selected, found = true, true
+				}
+			}
+			if !found {
+				counts = append(counts, FacetCount{Value: v, Selected: true})
+			}
+		}
+		if counts == nil {
+			counts = []FacetCount{}
+		}
+		if vf.Param == "material" {
+			f.Material = counts
+		} else {
+			f.FinishingType = counts
+		}
+	}
+
+	columns := "COUNT(*)"
+	for range attachmentCategories {
+		columns += ", IFNULL(SUM(EXISTS (SELECT 1 FROM attachments WHERE product_id = products.id AND category = ?)), 0)"
+	}
+	query, args := l.source(columns)
+	for _, c := range attachmentCategories {
+		args = append(args, c)
+	}
+	where, whereArgs := l.filter("has")
+	total := 0
+	with := make([]int, len(attachmentCategories))
+	dest := []interface{}{&total}
+	for i := range with {
+		dest = append(dest, &with[i])
+	}
+	if err := db.QueryRow(query+where, append(args, whereArgs...)...).Scan(dest...); err != nil {
+		return f, err
+	}
+	selected := map[string]string{}
+	for _, v := range nonEmptyValues(l.params["has"]) {
+		if category, without := strings.CutPrefix(v, "-"); without {
+			selected[category] = "without"
+		} else {
+			selected[category] = "with"
+		}
+	}
+	for i, c := range attachmentCategories {
+		f.Has = append(f.Has, PresenceCount{Category: c, With: with[i], Without: total - with[i], Filter: selected[c]})
+	}
+	return f, nil
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// finishPricings lists how a finishing process can be priced. The rate is per
+// dm² of surface, per kg of part weight, or per batch of parts.
+var finishPricings = []struct {
+	Code  string
+	Label string
+}{
+	{"area", "per dm²"},
+	{"weight", "per kg"},
+	{"batch", "per batch"},
+}
+
+func finishPricingLabel(code string) string {
+	for _, p := range finishPricings {
+		if p.Code == code {
+			return p.Label
+		}
+	}
+	return code
+}
+
+// Finish is a finishing process in the catalog, such as anodising or powder
+// coating. Parts are sent BatchSize at a time and a batch is never charged
+// less than Minimum.
+type Finish struct {
+	ID         int64  `json:"id"`
+	Name       string `json:"name"`
+	Pricing    string `json:"pricing"`
+	Rate       Amount `json:"rateMinor"`
+	BatchSize  int    `json:"batchSize"`
+	Minimum    Amount `json:"minimumMinor"`
+	Currency   string `json:"currency"`
+	SupplierID int64  `json:"supplierId,omitempty"`
+	Supplier   string `json:"supplier,omitempty"`
+}
+
+// FinishStep is one finishing process applied to a product, in the order
+// the steps are carried out. Basis describes what the cost was computed from,
+// e.g. "2.36 dm²".
+type FinishStep struct {
+	Step     int    `json:"step"`
+	FinishID int64  `json:"finishId"`
+	Name     string `json:"name"`
+	Pricing  string `json:"pricing"`
+	Basis    string `json:"basis,omitempty"`
+	Cost     Amount `json:"costMinor"`
+}
+
+// partGeometry is what finishing prices are computed from: the stock size,
+// when it can be read, and the density of the catalog material, if any.
+type partGeometry struct {
+	Size    *StockSize
+	SizeErr error
+	Density float64
+}
+
+func loadPartGeometry(q rowQuerier, materialSize string, materialID sql.NullInt64) (partGeometry, error) {
+	var g partGeometry
+	var form string
+	if materialID.Valid {
+		err := q.QueryRow("SELECT form, density FROM materials WHERE id = ?", materialID.Int64).Scan(&form, &g.Density)
+		if err != nil && err != sql.ErrNoRows {
+			return g, err
+		}
+	}
+	size, err := parseMaterialSize(materialSize, form)
+	if err != nil {
+		g.SizeErr = err
+		return g, nil
+	}
+	g.Size = &size
+	return g, nil
+}
+
+// CostFor computes the cost per part of this process for a part with the
+// given geometry, in the product currency.
+func (f Finish) CostFor(g partGeometry, currency string) (Amount, string, error) {
+	if !f.Rate.Valid {
+		return Amount{}, "", fmt.Errorf("%s has no price", f.Name)
+	}
+	if f.Currency != currency {
+		return Amount{}, "", fmt.Errorf("%s is priced in %s, the product uses %s", f.Name, f.Currency, currency)
+	}
+
+	batch := float64(f.BatchSize)
+	var perBatch float64
+	var basis string
+	switch f.Pricing {
+	case "area":
+		if g.Size == nil {
+			return Amount{}, "", fmt.Errorf("%s is priced per dm² and the material size cannot be read: %v", f.Name, g.SizeErr)
+		}
+		area := g.Size.Area() / 1e4
+		perBatch = area * batch * float64(f.Rate.Minor)
+		basis = fmt.Sprintf("%.2f dm²", area)
+	case "weight":
+		if g.Size == nil {
+			return Amount{}, "", fmt.Errorf("%s is priced per kg and the material size cannot be read: %v", f.Name, g.SizeErr)
+		}
+		if g.Density == 0 {
+			return Amount{}, "", fmt.Errorf("%s is priced per kg; choose a catalog material so the weight is known", f.Name)
+		}
+		weight := g.Size.Weight(g.Density)
+		perBatch = weight * batch * float64(f.Rate.Minor)
+		basis = fmt.Sprintf("%.3f kg", weight)
+	case "batch":
+		perBatch = float64(f.Rate.Minor)
+		basis = fmt.Sprintf("1/%d batch", f.BatchSize)
+	default:
+		return Amount{}, "", fmt.Errorf("%s has unknown pricing %q", f.Name, f.Pricing)
+	}
+	if f.Minimum.Valid && perBatch < float64(f.Minimum.Minor) {
+		perBatch = float64(f.Minimum.Minor)
+		basis += ", minimum charge"
+	}
+	return Amount{Minor: int64(math.Round(perBatch / batch)), Valid: true}, basis, nil
+}
+
+const finishColumns = `f.id, f.name, f.pricing, f.rate_minor, f.batch_size, f.minimum_minor, f.currency,
+	f.supplier_id, s.name`
+
+const finishFrom = ` FROM finishes f LEFT JOIN suppliers s ON s.id = f.supplier_id `
+
+func scanFinish(s rowScanner, f *Finish) error {
+	var supplierID sql.NullInt64
+	var supplier sql.NullString
+	err := s.Scan(&f.ID, &f.Name, &f.Pricing, &f.Rate, &f.BatchSize, &f.Minimum, &f.Currency, &supplierID, &supplier)
+	f.SupplierID, f.Supplier = supplierID.Int64, supplier.String
+	return err
+}
+
+// loadFinishes returns the finishing catalog ordered by name. It is also
+// available to templates as "finishes".
+func loadFinishes() ([]Finish, error) {
+	rows, err := db.Query("SELECT " + finishColumns + finishFrom + "ORDER BY f.name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var finishes []Finish
+	for rows.Next() {
+		var f Finish
+		if err := scanFinish(rows, &f); err != nil {
+			return nil, err
+		}
+		finishes = append(finishes, f)
+	}
+	return finishes, rows.Err()
+}
+
+func findFinish(q rowQuerier, id int64) (Finish, error) {
+	var f Finish
+	err := scanFinish(q.QueryRow("SELECT "+finishColumns+finishFrom+"WHERE f.id = ?", id), &f)
+	return f, err
+}
+
+// parseFinishIDs reads the finishing steps chosen on a product form, in
+// order. Blank selections are skipped.
+func parseFinishIDs(r *http.Request) []int64 {
+	var ids []int64
+	for _, v := range r.Form["finishId"] {
+		if id := parseOptionalID(v); id.Valid {
+			ids = append(ids, id.Int64)
+		}
+	}
+	return ids
+}
+
+// priceFinishSteps prices each chosen process for a part with the given
+// geometry.
+func priceFinishSteps(q rowQuerier, finishIDs []int64, g partGeometry, currency string) ([]FinishStep, error) {
+	var steps []FinishStep
+	for i, id := range finishIDs {
+		f, err := findFinish(q, id)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("finishing process %d does not exist", id)
+		}
+		if err != nil {
+			return nil, err
+		}
+		cost, basis, err := f.CostFor(g, currency)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, FinishStep{
+			Step: i + 1, FinishID: f.ID, Name: f.Name, Pricing: f.Pricing, Basis: basis, Cost: cost,
+		})
+	}
+	return steps, nil
+}
+
+// applyFinishSteps prices the finishing steps chosen on a product form and
+// fills in the finishing type, the total finishing cost and (if none was
+// chosen) the finishing supplier of the first step. With no steps chosen the
+// typed finishing fields are kept.
+func applyFinishSteps(finishIDs []int64, finishingType *string, materialSize string, materialID sql.NullInt64,
+	costs *productCosts, supplierID *sql.NullInt64) ([]FinishStep, error) {
+	if len(finishIDs) == 0 {
+		return nil, nil
+	}
+	g, err := loadPartGeometry(db, materialSize, materialID)
+	if err != nil {
+		return nil, err
+	}
+	steps, err := priceFinishSteps(db, finishIDs, g, costs.Currency)
+	if err != nil {
+		return nil, fmt.Errorf("Finishing: %v", err)
+	}
+
+	*finishingType, costs.FinishingCost = summarizeFinishSteps(steps)
+	if !supplierID.Valid {
+		var first sql.NullInt64
+		if err := db.QueryRow("SELECT supplier_id FROM finishes WHERE id = ?", finishIDs[0]).Scan(&first); err != nil {
+			return nil, err
+		}
+		*supplierID = first
+	}
+	return steps, nil
+}
+
+// summarizeFinishSteps returns the finishing type shown for a chain of steps,
+// e.g. "Bead Blast + Anodise", and their total cost.
+func summarizeFinishSteps(steps []FinishStep) (string, Amount) {
+	names := make([]string, len(steps))
+	var total int64
+	for i, s := range steps {
+		names[i] = s.Name
+		total += s.Cost.Minor
+	}
+	return strings.Join(names, " + "), Amount{Minor: total, Valid: true}
+}
+
+// saveFinishSteps replaces the finishing steps stored for a product.
+func saveFinishSteps(tx *sql.Tx, productID int, steps []FinishStep) error {
+	if _, err := tx.Exec("DELETE FROM product_finishes WHERE product_id = ?", productID); err != nil {
+		return err
+	}
+	for _, s := range steps {
+		_, err := tx.Exec(`
+			INSERT INTO product_finishes(product_id, step, finish_id, basis, cost_minor)
+			VALUES(?, ?, ?, ?, ?)`, productID, s.Step, s.FinishID, s.Basis, s.Cost)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadFinishSteps returns the finishing steps of a product in order.
+func loadFinishSteps(productID int) ([]FinishStep, error) {
+	rows, err := db.Query(`
+		SELECT pf.step, pf.finish_id, f.name, f.pricing, IFNULL(pf.basis, ''), pf.cost_minor
+		FROM product_finishes pf JOIN finishes f ON f.id = pf.finish_id
+		WHERE pf.product_id = ?
+		ORDER BY pf.step`, productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var steps []FinishStep
+	for rows.Next() {
+		var s FinishStep
+		if err := rows.Scan(&s.Step, &s.FinishID, &s.Name, &s.Pricing, &s.Basis, &s.Cost); err != nil {
+			return nil, err
+		}
+		steps = append(steps, s)
+	}
+	return steps, rows.Err()
+}
+
+// repriceFinishing recomputes the finishing steps and total finishing cost of
+// the products selected by where, after a finishing process or the material
+// they are made of changed. Products that can no longer be priced keep their
+// costs.
+func repriceFinishing(tx *sql.Tx, where string, args ...any) (int, error) {
+	type pricedProduct struct {
+		id                     int
+		partNo, size, currency string
+		materialID             sql.NullInt64
+	}
+	rows, err := tx.Query(`
+		SELECT id, partNo, IFNULL(material_size, ''), currency, material_id FROM products
+		WHERE id IN (SELECT product_id FROM product_finishes) AND `+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	var products []pricedProduct
+	for rows.Next() {
+		var p pricedProduct
+		if err := rows.Scan(&p.id, &p.partNo, &p.size, &p.currency, &p.materialID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		products = append(products, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	updated := 0
+	for _, p := range products {
+		ids, err := queryIDs(tx, "SELECT finish_id FROM product_finishes WHERE product_id = ? ORDER BY step", p.id)
+		if err != nil {
+			return updated, err
+		}
+		g, err := loadPartGeometry(tx, p.size, p.materialID)
+		if err != nil {
+			return updated, err
+		}
+		steps, err := priceFinishSteps(tx, ids, g, p.currency)
+		if err != nil {
+			log.Printf("Finishing cost of %s not updated: %v", p.partNo, err)
+			continue
+		}
+		if err := saveFinishSteps(tx, p.id, steps); err != nil {
+			return updated, err
+		}
+		finishingType, total := summarizeFinishSteps(steps)
+		_, err = tx.Exec("UPDATE products SET finishing_type = ?, finishing_cost_minor = ? WHERE id = ?",
+			finishingType, total, p.id)
+		if err != nil {
+			return updated, err
+		}
+		updated++
+	}
+	return updated, nil
+}
+
+// queryIDs runs a query returning one id column.
+func queryIDs(tx *sql.Tx, query string, args ...any) ([]int64, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// parseFinishForm validates the catalog fields posted by the finishing pages.
+func parseFinishForm(r *http.Request) (Finish, error) {
+	f := Finish{
+		Name:     strings.TrimSpace(r.FormValue("name")),
+		Pricing:  r.FormValue("pricing"),
+		Currency: strings.ToUpper(strings.TrimSpace(r.FormValue("currency"))),
+	}
+	var problems []string
+	if f.Name == "" {
+		problems = append(problems, "Name: name is required")
+	}
+	if finishPricingLabel(f.Pricing) == f.Pricing {
+		problems = append(problems, fmt.Sprintf("Pricing: %q is not a known pricing", f.Pricing))
+	}
+	if f.Currency == "" {
+		f.Currency = defaultCurrency
+	}
+	if !isCurrency(f.Currency) {
+		problems = append(problems, fmt.Sprintf("Currency: %q is not supported", f.Currency))
+		f.Currency = defaultCurrency
+	}
+	var err error
+	if f.Rate, err = parseAmount(r.FormValue("rate"), f.Currency); err != nil {
+		problems = append(problems, "Rate: "+err.Error())
+	}
+	if f.Minimum, err = parseAmount(r.FormValue("minimum"), f.Currency); err != nil {
+		problems = append(problems, "Minimum Charge: "+err.Error())
+	}
+	f.BatchSize = 1
+	if v := strings.TrimSpace(r.FormValue("batchSize")); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			problems = append(problems, "Batch Size: enter a whole number of parts, at least 1")
+		}
+		f.BatchSize = n
+	}
+	f.SupplierID = parseOptionalID(r.FormValue("supplierId")).Int64
+
+	if len(problems) > 0 {
+		return f, errors.New(strings.Join(problems, "; "))
+	}
+	return f, nil
+}
+
+// saveFinish inserts f, or updates it and reprices the products using it when
+// f.ID is set, recalculating their unit costs. It returns the number of
+// products repriced.
+func saveFinish(f *Finish) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	supplierID := sql.NullInt64{Int64: f.SupplierID, Valid: f.SupplierID != 0}
+	if f.ID == 0 {
+		var res sql.Result
+		res, err = tx.Exec(`
+			INSERT INTO finishes(name, pricing, rate_minor, batch_size, minimum_minor, currency, supplier_id)
+			VALUES(?, ?, ?, ?, ?, ?, ?)`,
+			f.Name, f.Pricing, f.Rate, f.BatchSize, f.Minimum, f.Currency, supplierID)
+		if err == nil {
+			f.ID, err = res.LastInsertId()
+		}
+	} else {
+		_, err = tx.Exec(`
+			UPDATE finishes SET name = ?, pricing = ?, rate_minor = ?, batch_size = ?, minimum_minor = ?,
+				currency = ?, supplier_id = ?
+			WHERE id = ?`,
+			f.Name, f.Pricing, f.Rate, f.BatchSize, f.Minimum, f.Currency, supplierID, f.ID)
+	}
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			return 0, fmt.Errorf("Name: %s is already in the catalog", f.Name)
+		}
+		return 0, err
+	}
+
+	updated, err := repriceFinishing(tx, "id IN (SELECT product_id FROM product_finishes WHERE finish_id = ?)", f.ID)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	if _, err := recalculateCostsWhere("id IN (SELECT product_id FROM product_finishes WHERE finish_id = ?)", f.ID); err != nil {
+		log.Printf("Error costing the products finished with %s: %v", f.Name, err)
+	}
+	return updated, nil
+}
+
+// finishesHandler lists the finishing catalog (GET) and adds a process from
+// the form on the same page (POST).
+func finishesHandler(w http.ResponseWriter, r *http.Request) {
+	var formError string
+	if r.Method == http.MethodPost {
+		f, err := parseFinishForm(r)
+		if err == nil {
+			_, err = saveFinish(&f)
+		}
+		if err == nil {
+			http.Redirect(w, r, "/finishes", http.StatusSeeOther)
+			return
+		}
+		formError = err.Error()
+		w.WriteHeader(http.StatusBadRequest)
+	}
+
+	finishes, err := loadFinishes()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tmpl := template.Must(template.New("finishes.html").Funcs(funcMap).ParseFiles("templates/finishes.html"))
+	err = tmpl.Execute(w, struct {
+		Finishes []Finish
+		Error    string
+	}{finishes, formError})
+	if err != nil {
+		log.Printf("Error rendering finishes: %v", err)
+	}
+}
+
+// finishHandler edits one finishing process. Saving reprices every product
+// using it.
+func finishHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/finish/"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid finishing process id", http.StatusBadRequest)
+		return
+	}
+
+	data := struct {
+		Finish
+		Error    string
+		Message  string
+		Products []Product
+	}{}
+	data.Finish, err = findFinish(db, id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Finishing process not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		f, err := parseFinishForm(r)
+		f.ID = id
+		var updated int
+		if err == nil {
+			updated, err = saveFinish(&f)
+		}
+		if err == nil {
+			log.Printf("Finishing process %s saved, %d products repriced", f.Name, updated)
+			http.Redirect(w, r, fmt.Sprintf("/finish/%d?updated=%d", id, updated), http.StatusSeeOther)
+			return
+		}
+		data.Finish, data.Error = f, err.Error()
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	if updated := r.URL.Query().Get("updated"); updated != "" {
+		data.Message = "Saved. Finishing cost updated on " + updated + " product(s)."
+	}
+
+	rows, err := db.Query(`SELECT `+productColumns+` FROM products
+		WHERE id IN (SELECT product_id FROM product_finishes WHERE finish_id = ?) ORDER BY partNo`, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p Product
+		if err := scanProduct(rows, &p); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data.Products = append(data.Products, p)
+	}
+
+	tmpl := template.Must(template.New("finish.html").Funcs(funcMap).ParseFiles("templates/finish.html"))
+	if err := tmpl.Execute(w, data); err != nil {
+		log.Printf("Error rendering finishing process: %v", err)
+	}
+}
@@ -5,6 +5,7 @@ go 1.24.0
 require (
 	github.com/mattn/go-sqlite3 v1.14.32
 	github.com/webview/webview_go v0.0.0-20240831120633-6173450d4dd6
+	github.com/xuri/excelize/v2 v2.9.1
 )
 
 require (
@@ -13,7 +14,6 @@ require (
 	github.com/tiendc/go-deepcopy v1.6.0 // indirect
 	github.com/webview/webview v0.0.0-20250911035254-55b438dc11d0 // indirect
 	github.com/xuri/efp v0.0.1 // indirect
-	github.com/xuri/excelize/v2 v2.9.1 // indirect
 	github.com/xuri/nfp v0.0.1 // indirect
 	golang.org/x/crypto v0.38.0 // indirect
 	golang.org/x/net v0.40.0 // indirect
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultLocationCode is the location stock is booked to when no location is
+// given. Stock that existed before locations were introduced was moved there.
+const defaultLocationCode = "MAIN"
+
+// Location is a place stock is kept. Locations form a hierarchy, e.g. a
+// warehouse containing shelves containing bins. Path is the chain of codes
+// from the top level location down, e.g. "WH1 / A / 03".
+type Location struct {
+	ID       int64  `json:"id"`
+	Code     string `json:"code"`
+	Name     string `json:"name,omitempty"`
+	ParentID int64  `json:"parentId,omitempty"`
+	Path     string `json:"path"`
+	Depth    int    `json:"depth"`
+}
+
+// StockLevel is the on-hand quantity of a product at one location.
+type StockLevel struct {
+	LocationID int64  `json:"locationId"`
+	Location   string `json:"location"`
+	Qty        int    `json:"qty"`
+}
+
+// locationPathsCTE names every location with its path and depth. Queries
+// using it can select from location_paths.
+const locationPathsCTE = `
+	WITH RECURSIVE location_paths(id, code, name, parent_id, path, depth) AS (
+		SELECT id, code, name, parent_id, code, 0 FROM locations WHERE parent_id IS NULL
+		UNION ALL
+		SELECT l.id, l.code, l.name, l.parent_id, lp.path || ' / ' || l.code, lp.depth + 1
+		FROM locations l JOIN location_paths lp ON l.parent_id = lp.id
+	)`
+
+// loadLocations returns all locations in tree order.
+func loadLocations() ([]Location, error) {
+	rows, err := db.Query(locationPathsCTE + `
+		SELECT id, code, name, parent_id, path, depth FROM location_paths ORDER BY path`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var locations []Location
+	for rows.Next() {
+		var l Location
+		var name sql.NullString
+		var parentID sql.NullInt64
+		if err := rows.Scan(&l.ID, &l.Code, &name, &parentID, &l.Path, &l.Depth); err != nil {
+			return nil, err
+		}
+		l.Name, l.ParentID = name.String, parentID.Int64
+		locations = append(locations, l)
+	}
+	return locations, rows.Err()
+}
+
+type rowQuerier interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// findLocation resolves a location given by code or by id. A matching code
+// wins over a matching id.
+func findLocation(q rowQuerier, ref string) (int64, error) {
+	ref = strings.TrimSpace(ref)
+	var id int64
+	err := q.QueryRow(`
+		SELECT id FROM locations WHERE code = ? OR CAST(id AS TEXT) = ?
+		ORDER BY code = ? DESC LIMIT 1`, ref, ref, ref).Scan(&id)
+	return id, err
+}
+
+// createLocation adds a location below parentID, or at the top level when
+// parentID is zero.
+func createLocation(code, name string, parentID int64) (int64, error) {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return 0, fmt.Errorf("location code is required")
+	}
+	if strings.Contains(code, "/") {
+		return 0, fmt.Errorf("location code %q must not contain '/'", code)
+	}
+	parent := sql.NullInt64{Int64: parentID, Valid: parentID != 0}
+	res, err := db.Exec("INSERT INTO locations(code, name, parent_id) VALUES(?, ?, ?)",
+		code, strings.TrimSpace(name), parent)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			return 0, fmt.Errorf("location %s already exists", code)
+		}
+		if strings.Contains(err.Error(), "FOREIGN KEY") {
+			return 0, fmt.Errorf("parent location %d does not exist", parentID)
+		}
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// loadStockLevels fills in the per-location stock of every product in the
+// slice. Locations with nothing on hand are left out.
+func loadStockLevels(products []Product) error {
+	if len(products) == 0 {
+		return nil
+	}
+	index := make(map[int]int, len(products))
+	placeholders := make([]string, len(products))
+	args := make([]interface{}, len(products))
+	for i, p := range products {
+		index[p.ID] = i
+		placeholders[i] = "?"
+		args[i] = p.ID
+		products[i].Stock = nil
+	}
+
+	rows, err := db.Query(locationPathsCTE+`
+		SELECT m.product_id, m.location_id, lp.path, SUM(m.quantity)
+		FROM stock_movements m JOIN location_paths lp ON lp.id = m.location_id
+		WHERE m.product_id IN (`+strings.Join(placeholders, ",")+`)
+		GROUP BY m.product_id, m.location_id
+		HAVING SUM(m.quantity) <> 0
+		ORDER BY lp.path`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var productID int
+		var s StockLevel
+		if err := rows.Scan(&productID, &s.LocationID, &s.Location, &s.Qty); err != nil {
+			return err
+		}
+		if i, ok := index[productID]; ok {
+			products[i].Stock = append(products[i].Stock, s)
+		}
+	}
+	return rows.Err()
+}
+
+// stockAtLocationFilter restricts a product query to products with stock at
+// a location or any location below it.
+const stockAtLocationFilter = `id IN (
+	SELECT product_id FROM stock_movements
+	WHERE location_id IN (
+		WITH RECURSIVE sub(id) AS (
+			SELECT ?
+			UNION
+			SELECT l.id FROM locations l JOIN sub ON l.parent_id = sub.id
+		)
+		SELECT id FROM sub
+	)
+	GROUP BY product_id HAVING SUM(quantity) > 0)`
+
+// transferStock moves qty of a product from one location to another as a
+// pair of transfer movements. A zero id is the default location.
+func transferStock(tx *sql.Tx, m StockMovement, fromID, toID int64) error {
+	fromID, err := stockLocation(tx, fromID)
+	if err != nil {
+		return err
+	}
+	if toID, err = stockLocation(tx, toID); err != nil {
+		return err
+	}
+	if fromID == toID {
+		return fmt.Errorf("source and destination are the same location")
+	}
+	out := m
+	out.Type, out.LocationID, out.Quantity = "transfer", fromID, -m.Quantity
+	if _, err := recordStockMovement(tx, out); err != nil {
+		return err
+	}
+	in := m
+	in.Type, in.LocationID = "transfer", toID
+	_, err = recordStockMovement(tx, in)
+	return err
+}
+
+func locationsHandler(w http.ResponseWriter, r *http.Request) {
+	var formError string
+	if r.Method == http.MethodPost {
+		parentID, _ := strconv.ParseInt(r.FormValue("parentId"), 10, 64)
+		_, err := createLocation(r.FormValue("code"), r.FormValue("name"), parentID)
+		if err == nil {
+			http.Redirect(w, r, "/locations", http.StatusSeeOther)
+			return
+		}
+		formError = err.Error()
+		w.WriteHeader(http.StatusBadRequest)
+	}
+
+	locations, err := loadLocations()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tmpl := template.Must(template.New("locations.html").Funcs(funcMap).ParseFiles("templates/locations.html"))
+	err = tmpl.Execute(w, struct {
+		Locations []Location
+		Error     string
+	}{locations, formError})
+	if err != nil {
+		log.Printf("Error rendering locations: %v", err)
+	}
+}
+
+// apiLocationsHandler lists locations (GET) or creates one from a JSON body
+// with code, name and an optional parentId (POST).
+func apiLocationsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		locations, err := loadLocations()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(locations)
+
+	case http.MethodPost:
+		var request struct {
+			Code     string `json:"code"`
+			Name     string `json:"name"`
+			ParentID int64  `json:"parentId"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		id, err := createLocation(request.Code, request.Name, request.ParentID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"id":     id,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// stockTransferHandler moves stock of a product between two locations.
+func stockTransferHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		ProductID      int    `json:"productId"`
+		FromLocationID int64  `json:"fromLocationId"`
+		ToLocationID   int64  `json:"toLocationId"`
+		Quantity       int    `json:"quantity"`
+		Reason         string `json:"reason"`
+		Reference      string `json:"reference"`
+		User           string `json:"user"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.Quantity <= 0 {
+		http.Error(w, "Invalid transfer: quantity must be positive", http.StatusBadRequest)
+		return
+	}
+
+	m := StockMovement{
+		ProductID: request.ProductID,
+		Quantity:  request.Quantity,
+		Reason:    strings.TrimSpace(request.Reason),
+		Reference: strings.TrimSpace(request.Reference),
+		CreatedBy: strings.TrimSpace(request.User),
+	}
+	if m.CreatedBy == "" {
+		m.CreatedBy = currentUsername()
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	err = transferStock(tx, m, request.FromLocationID, request.ToLocationID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errUnknownLocation) {
+		http.Error(w, "Invalid transfer: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errInsufficientStock) {
+		http.Error(w, "Invalid transfer: "+err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Invalid transfer: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Transferred %d of product %d from location %d to %d",
+		request.Quantity, request.ProductID, request.FromLocationID, request.ToLocationID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "success",
+		"message": "Stock transferred",
+	})
+}
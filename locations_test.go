@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+// TestTransferToSameLocation checks that a transfer whose two ends are the
+// same location is rejected, including when one end is given as zero for the
+// default location.
+func TestTransferToSameLocation(t *testing.T) {
+	setupTestDB(t)
+	res, err := db.Exec("INSERT INTO products(partNo) VALUES('T-1')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	productID, _ := res.LastInsertId()
+	mainID, err := findLocation(db, defaultLocationCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shelfID, err := createLocation("SHELF", "Shelf", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		from, to int64
+		ok       bool
+	}{
+		{0, mainID, false},
+		{mainID, 0, false},
+		{0, 0, false},
+		{shelfID, shelfID, false},
+		{0, shelfID, true},
+		{mainID, shelfID, true},
+	} {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := StockMovement{ProductID: int(productID), Type: "receipt", Quantity: 5}
+		if _, err := recordStockMovement(tx, m); err != nil {
+			t.Fatal(err)
+		}
+		m.Quantity = 2
+		err = transferStock(tx, m, tc.from, tc.to)
+		var n int
+		tx.QueryRow("SELECT COUNT(*) FROM stock_movements WHERE type = 'transfer'").Scan(&n)
+		tx.Rollback()
+
+		name := strconv.FormatInt(tc.from, 10) + " to " + strconv.FormatInt(tc.to, 10)
+		if tc.ok && (err != nil || n != 2) {
+			t.Errorf("transfer %s: %v, %d movements", name, err, n)
+		}
+		if !tc.ok && (err == nil || n != 0) {
+			t.Errorf("transfer %s: %v, %d movements, want it rejected", name, err, n)
+		}
+	}
+}
@@ -1,13 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -22,70 +25,165 @@ import (
 
 // FileInfo represents information about uploaded files
 type FileInfo struct {
-	Name string `json:"name"`
-	Size string `json:"size"`
-	Type string `json:"type"`
-	Path string `json:"path"`
-	Date string `json:"date,omitempty"`
+	ID         int64  `json:"id,omitempty"`
+	ProductID  int    `json:"-"`
+	RevisionID int64  `json:"revisionId,omitempty"`
+	Category   string `json:"category,omitempty"`
+	Name       string `json:"name"`
+	Size       string `json:"size"`
+	Bytes      int64  `json:"bytes"`
+	Type       string `json:"type"`
+	Path       string `json:"path"`
+	Date       string `json:"date,omitempty"`
+	Checksum   string `json:"checksum,omitempty"`
+
+	// InvoiceDetails is set on invoice attachments that have been tagged.
+	InvoiceDetails *InvoiceDetails `json:"invoiceDetails,omitempty"`
 }
 
 type Product struct {
-	ID            int            `json:"id"`
-	PartNo        string         `json:"partNo"`
-	PartName      string         `json:"partName"`
-	Description   string         `json:"description"`
-	Cost          string         `json:"cost"`
-	Qty           int            `json:"qty"`
-	Material      string         `json:"material"`
-	MaterialSize  string         `json:"materialSize"`
-	MaterialCost  string         `json:"materialCost"`
-	FinishingType string         `json:"finishingType"`
-	FinishingCost string         `json:"finishingCost"`
-	Photos        sql.NullString `json:"-"`
-	Drawing2D     sql.NullString `json:"-"`
-	Cad3D         sql.NullString `json:"-"`
-	CncCode       sql.NullString `json:"-"`
-	Invoice       sql.NullString `json:"-"`
-	CreatedAt     string         `json:"createdAt"`
-	UpdatedAt     string         `json:"updatedAt"`
-	PhotoFiles    []FileInfo     `json:"photos,omitempty"`
+	ID                  int               `json:"id"`
+	PartNo              string            `json:"partNo"`
+	PartName            string            `json:"partName"`
+	Description         string            `json:"description"`
+	Cost                Amount            `json:"costMinor"`
+	Qty                 int               `json:"qty"`
+	Material            string            `json:"material"`
+	MaterialSize        string            `json:"materialSize"`
+	MaterialCost        Amount            `json:"materialCostMinor"`
+	FinishingType       string            `json:"finishingType"`
+	FinishingCost       Amount            `json:"finishingCostMinor"`
+	Currency            string            `json:"currency"`
+	MaterialSupplierID  int64             `json:"materialSupplierId,omitempty"`
+	MaterialSupplier    string            `json:"materialSupplier,omitempty"`
+	FinishingSupplierID int64             `json:"finishingSupplierId,omitempty"`
+	FinishingSupplier   string            `json:"finishingSupplier,omitempty"`
+	MaterialID          int64             `json:"materialId,omitempty"`
+	ComputedCost        Amount            `json:"computedCostMinor"`
+	CostBatchSize       int               `json:"costBatchSize,omitempty"`
+	Finishes            []FinishStep      `json:"finishes,omitempty"`
+	Fields              map[string]string `json:"fields,omitempty"`
+	CategoryID          int64             `json:"categoryId,omitempty"`
+	Category            string            `json:"category,omitempty"`
+	Tags                []string          `json:"tags,omitempty"`
+	Snippet             template.HTML     `json:"snippet,omitempty"`
+	Photos              []FileInfo        `json:"photos,omitempty"`
+	Drawing2D           []FileInfo        `json:"drawings,omitempty"`
+	Cad3D               []FileInfo        `json:"cad,omitempty"`
+	CncCode             []FileInfo        `json:"cnc,omitempty"`
+	Invoice             []FileInfo        `json:"invoice,omitempty"`
+	Revisions           []Revision        `json:"revisions,omitempty"`
+	CurrentRevision     string            `json:"currentRevision,omitempty"`
+	CurrentRevisionID   int64             `json:"-"`
+	Stock               []StockLevel      `json:"stock,omitempty"`
+	CreatedAt           string            `json:"createdAt"`
+	UpdatedAt           string            `json:"updatedAt"`
 }
 
 type TemplateData struct {
 	Products    []Product
+	Fields      []CustomField
+	Categories  []Category
+	Category    int64
 	SearchQuery string
 	SortBy      string
 	SortOrder   string
+	Error       string
+	Views       []SavedView
+	View        *SavedView
+	PageSize    int
+	ExportURL   string
+	Facets      Facets
+	Params      url.Values
+	TotalCount  int
+	NextURL     string
+}
+
+// Shows reports whether the list column with the given key is shown, which
+// is every column unless a view chooses them.
+func (d TemplateData) Shows(column string) bool {
+	return d.View == nil || d.View.Shows(column)
 }
 
 type PaginatedResponse struct {
 	Products    []Product `json:"products"`
 	HasMore     bool      `json:"hasMore"`
+	Next        string    `json:"next,omitempty"`
+	Rows        string    `json:"rows,omitempty"`
 	TotalCount  int       `json:"totalCount"`
 	CurrentPage int       `json:"currentPage"`
+	Facets      Facets    `json:"facets"`
+}
+
+// addPageData is rendered by add.html, either empty or refilled with the
+// submitted values when saving failed.
+type addPageData struct {
+	Error         string
+	Warning       string
+	PartNo        string
+	PartName      string
+	Description   string
+	Cost          string
+	Qty           int
+	Material      string
+	MaterialSize  string
+	MaterialCost  string
+	FinishingType string
+	FinishingCost string
+	Currency      string
+	Revision      string
+
+	MaterialSupplierID  int64
+	FinishingSupplierID int64
+	MaterialID          int64
+	FinishIDs           []int64
+
+	// Fields holds the custom field values, keyed by field name.
+	Fields     map[string]string
+	CategoryID int64
+	Tags       string
+}
+
+// modifyPageData is rendered by modify.html. The cost inputs are kept as
+// text so an invalid entry can be shown back to the user.
+type modifyPageData struct {
+	Product
+	Error              string
+	Warning            string
+	CostInput          string
+	MaterialCostInput  string
+	FinishingCostInput string
+}
+
+// detailPageData is rendered by detail.html.
+type detailPageData struct {
+	Product
+	BOM       []BOMLine
+	WhereUsed []BOMLine
+	Movements []StockMovement
+	Locations []Location
+	Routing   []Operation
+	Costing   CostBreakdown
+	History   []AuditEvent
+
+	// WorkCenters offers the work centers for new routing operations.
+	WorkCenters []WorkCenter
+
+	// Size is the material size read by parseMaterialSize, shown in Unit.
+	// Density is set when a catalog material gives one, for the weight.
+	Size      *StockSize
+	SizeError string
+	Unit      string
+	Density   float64
 }
 
 var db *sql.DB
 var uploadDir string
 
+const dbPath = "./products.db"
+
 // Template functions
 var funcMap = template.FuncMap{
-	"parseJSON": func(s string) []FileInfo {
-		var result []FileInfo
-		if s == "" {
-			return result
-		}
-		json.Unmarshal([]byte(s), &result)
-		return result
-	},
-	"parseNullJSON": func(ns sql.NullString) []FileInfo {
-		var result []FileInfo
-		if !ns.Valid || ns.String == "" {
-			return result
-		}
-		json.Unmarshal([]byte(ns.String), &result)
-		return result
-	},
 	"formatDate": func(date string) string {
 		t, err := time.Parse("2006-01-02T15:04:05Z", date)
 		if err != nil {
@@ -96,76 +194,139 @@ var funcMap = template.FuncMap{
 	"subtract": func(a, b int) int {
 		return a - b
 	},
-	"hasFiles": hasFiles,
-	"hasNullFiles": func(ns sql.NullString) bool {
-		if !ns.Valid || ns.String == "" || ns.String == "null" {
-			return false
+	"formatMoney":        formatMoney,
+	"nextRevision":       nextRevisionLabel,
+	"formatAmount":       formatAmount,
+	"suppliers":          loadSuppliers,
+	"materials":          loadMaterials,
+	"materialFormLabel":  materialFormLabel,
+	"finishes":           loadFinishes,
+	"finishPricingLabel": finishPricingLabel,
+	"costDrifts":         costDrifts,
+	"customFields":       loadCustomFields,
+	"categories":         loadCategories,
+	"join":               strings.Join,
+	"auditActionLabel":   auditActionLabel,
+	"customFieldTypes": func() interface{} {
+		return customFieldTypes
+	},
+	"listColumns": func() interface{} {
+		return listColumns
+	},
+	"isFacetParam": isFacetParam,
+	// routingNextOp suggests the number of the next operation: 10, 20, ...
+	"routingNextOp": func(ops []Operation) int {
+		if len(ops) == 0 {
+			return 10
 		}
-		var arr []map[string]interface{}
-		if err := json.Unmarshal([]byte(ns.String), &arr); err != nil {
-			return false
+		return (ops[len(ops)-1].OpNo/10 + 1) * 10
+	},
+	"finishPricings": func() interface{} {
+		return finishPricings
+	},
+	// finishSlots pads the chosen finishing steps with empty selections so
+	// the product forms always offer at least one more step.
+	"finishSlots": func(ids []int64) []int64 {
+		slots := append([]int64{}, ids...)
+		for len(slots) < 3 || len(slots) == len(ids) {
+			slots = append(slots, 0)
 		}
-		return len(arr) > 0
+		return slots
 	},
-	"nullString": func(ns sql.NullString) string {
-		if ns.Valid {
-			return ns.String
+	"finishIDs": func(steps []FinishStep) []int64 {
+		ids := make([]int64, len(steps))
+		for i, s := range steps {
+			ids[i] = s.FinishID
 		}
-		return ""
+		return ids
 	},
-	"fileModDate": func(p string) string {
-		full := filepath.Join(uploadDir, p)
-		if fi, err := os.Stat(full); err == nil {
-			return fi.ModTime().Format("2006-01-02 15:04")
+	"materialForms": func() interface{} {
+		return materialForms
+	},
+	"currencies": func() []string {
+		codes := make([]string, len(currencies))
+		for i, c := range currencies {
+			codes[i] = c.Code
 		}
-		return ""
+		return codes
 	},
 }
 
+// productColumns is the column list scanned by scanProduct.
+const productColumns = `id, partNo, partName, description, cost_minor, qty, material,
+	material_size, material_cost_minor, finishing_type, finishing_cost_minor,
+	currency, material_supplier_id, (SELECT name FROM suppliers WHERE id = material_supplier_id),
+	finishing_supplier_id, (SELECT name FROM suppliers WHERE id = finishing_supplier_id),
+	material_id, (SELECT unit_cost_minor FROM product_costs WHERE product_id = products.id AND currency = products.currency),
+	(SELECT batch_size FROM product_costs WHERE product_id = products.id),
+	category_id, created_at, updated_at`
+
+// productSortColumns maps the sort parameter accepted by the list views to
+// the column it orders by.
+var productSortColumns = map[string]string{
+	"id":             "id",
+	"partNo":         "partNo",
+	"partName":       "partName",
+	"description":    "description",
+	"cost":           "cost_minor",
+	"qty":            "qty",
+	"material":       "material",
+	"material_size":  "material_size",
+	"material_cost":  "material_cost_minor",
+	"finishing_type": "finishing_type",
+	"finishing_cost": "finishing_cost_minor",
+	"created_at":     "created_at",
+	"updated_at":     "updated_at",
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanProduct(s rowScanner, p *Product) error {
+	var materialSupplierID, finishingSupplierID, materialID, batchSize, categoryID sql.NullInt64
+	var materialSupplier, finishingSupplier sql.NullString
+	err := s.Scan(
+		&p.ID,
+		&p.PartNo,
+		&p.PartName,
+		&p.Description,
+		&p.Cost,
+		&p.Qty,
+		&p.Material,
+		&p.MaterialSize,
+		&p.MaterialCost,
+		&p.FinishingType,
+		&p.FinishingCost,
+		&p.Currency,
+		&materialSupplierID,
+		&materialSupplier,
+		&finishingSupplierID,
+		&finishingSupplier,
+		&materialID,
+		&p.ComputedCost,
+		&batchSize,
+		&categoryID,
+		&p.CreatedAt,
+		&p.UpdatedAt,
+	)
+	p.MaterialSupplierID, p.MaterialSupplier = materialSupplierID.Int64, materialSupplier.String
+	p.FinishingSupplierID, p.FinishingSupplier = finishingSupplierID.Int64, finishingSupplier.String
+	p.MaterialID = materialID.Int64
+	p.CostBatchSize = int(batchSize.Int64)
+	p.CategoryID = categoryID.Int64
+	return err
+}
+
 func initDB() {
 	var err error
-	db, err = sql.Open("sqlite3", "./products.db")
+	db, err = sql.Open("sqlite3", dbPath+"?_foreign_keys=on")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	createTableSQL := `
-	CREATE TABLE IF NOT EXISTS products (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		partNo TEXT UNIQUE,
-		partName TEXT,
-		description TEXT,
-		cost TEXT,
-		qty INTEGER DEFAULT 0,
-		material TEXT,
-		material_size TEXT,
-		material_cost TEXT,
-		finishing_type TEXT,
-		finishing_cost TEXT,
-		photos TEXT,
-		drawing_2d TEXT,
-		cad_3d TEXT,
-		cnc_code TEXT,
-		invoice TEXT,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
-	);
-	`
-	triggerSQL := `
-	CREATE TRIGGER IF NOT EXISTS update_products_timestamp 
-	AFTER UPDATE ON products
-	BEGIN
-		UPDATE products SET updated_at = DATETIME('now') 
-		WHERE id = NEW.id;
-	END;
-	`
-	_, err = db.Exec(createTableSQL)
-	if err != nil {
-		log.Fatal(err)
-	}
-	_, err = db.Exec(triggerSQL)
-	if err != nil {
-		log.Fatal(err)
+	if err := migrateDB(db, dbPath); err != nil {
+		log.Fatal("Database migration failed: ", err)
 	}
 
 	fmt.Println("Database initialized successfully")
@@ -184,29 +345,85 @@ func init() {
 	}
 
 	fmt.Println("Upload directory set to:", uploadDir)
+
+	trashDir = filepath.Join(currentDir, "trash")
+	if err := os.MkdirAll(trashDir, os.ModePerm); err != nil {
+		log.Fatal("Error creating trash directory:", err)
+	}
+}
+
+// routes are the pages and endpoints of the application. Endpoints that
+// answer with JSON are marked json and described in static/openapi.json,
+// under their pattern or, for a pattern ending in /, under the path templates
+// listed in paths; openapi_test.go fails when one is not.
+var routes = []struct {
+	pattern string
+	handler http.HandlerFunc
+	json    bool
+	paths   []string
+}{
+	{"/", indexHandler, false, nil},
+	{"/add", addHandler, false, nil},
+	{"/save", saveHandler, false, nil},
+	{"/modify/", modifyHandler, false, nil},
+	{"/update", updateHandler, false, nil},
+	{"/remove-file", removeFileHandler, true, nil},
+	{"/delete/", deleteHandler, false, nil},
+	{"/search", searchHandler, false, nil},
+	{"/detail/", detailHandler, false, nil},
+	{"/export", exportHandler, false, nil},
+	{"/open-folder", openFolderHandler, false, nil},
+	{"/api/products", apiProductsHandler, true, nil},
+	{"/api/products/", apiProductHandler, true, []string{
+		"/api/products/{partNo}",
+		"/api/products/{partNo}/attachments",
+		"/api/products/{partNo}/attachments/{id}",
+	}},
+	{"/open-file", openFileHandler, true, nil},
+	{"/set-current-revision", setCurrentRevisionHandler, true, nil},
+	{"/bom/add", bomAddHandler, true, nil},
+	{"/bom/remove", bomRemoveHandler, true, nil},
+	{"/api/stock-movements", stockMovementHandler, true, nil},
+	{"/api/stock-transfers", stockTransferHandler, true, nil},
+	{"/locations", locationsHandler, false, nil},
+	{"/api/locations", apiLocationsHandler, true, nil},
+	{"/suppliers", suppliersHandler, false, nil},
+	{"/supplier/", supplierHandler, false, nil},
+	{"/api/invoice-details", invoiceDetailsHandler, true, nil},
+	{"/materials", materialsHandler, false, nil},
+	{"/material/", materialHandler, false, nil},
+	{"/units", unitsHandler, false, nil},
+	{"/finishes", finishesHandler, false, nil},
+	{"/finish/", finishHandler, false, nil},
+	{"/work-centers", workCentersHandler, false, nil},
+	{"/routing/add", routingAddHandler, true, nil},
+	{"/routing/remove", routingRemoveHandler, true, nil},
+	{"/costs/recalculate", costsRecalculateHandler, true, nil},
+	{"/fields", customFieldsHandler, false, nil},
+	{"/categories", categoriesHandler, false, nil},
+	{"/products/bulk", productsBulkHandler, true, nil},
+	{"/trash", trashHandler, false, nil},
+	{"/api/audit", apiAuditHandler, true, nil},
+	{"/views", viewsHandler, false, nil},
+	{"/api/openapi.json", openAPIHandler, true, nil},
 }
 
 func main() {
 	initDB()
 	defer db.Close()
 
+	if n, err := purgeTrash(); err != nil {
+		log.Printf("Error purging trash: %v", err)
+	} else if n > 0 {
+		log.Printf("Purged %d products from the trash", n)
+	}
+
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
 	http.Handle("/uploads/", http.StripPrefix("/uploads/", http.FileServer(http.Dir(uploadDir))))
 
-	// Routes
-	http.HandleFunc("/", indexHandler)
-	http.HandleFunc("/add", addHandler)
-	http.HandleFunc("/save", saveHandler)
-	http.HandleFunc("/modify/", modifyHandler)
-	http.HandleFunc("/update", updateHandler)
-	http.HandleFunc("/remove-file", removeFileHandler)
-	http.HandleFunc("/delete/", deleteHandler)
-	http.HandleFunc("/search", searchHandler)
-	http.HandleFunc("/detail/", detailHandler)
-	http.HandleFunc("/export", exportHandler)
-	http.HandleFunc("/open-folder", openFolderHandler)
-	http.HandleFunc("/api/products", apiProductsHandler)
-	http.HandleFunc("/open-file", openFileHandler)
+	for _, route := range routes {
+		http.HandleFunc(route.pattern, route.handler)
+	}
 
 	go func() {
 		log.Println("Server starting on :8080")
@@ -227,16 +444,22 @@ func main() {
 }
 
 func apiProductsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		apiCreateProduct(w, r)
+		return
+	}
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed", nil)
 		return
 	}
 
-	query := r.URL.Query().Get("q")
-	sortBy := r.URL.Query().Get("sort")
-	sortOrder := r.URL.Query().Get("order")
-	pageStr := r.URL.Query().Get("page")
-	limitStr := r.URL.Query().Get("limit")
+	params, view, err := applySavedView(r.URL.Query(), false)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	pageStr := params.Get("page")
+	limitStr := params.Get("limit")
 
 	page := 1
 	if pageStr != "" {
@@ -245,236 +468,214 @@ func apiProductsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	limit := 5000
+	limit := defaultProductPageSize
+	if view != nil {
+		limit = view.PageSize
+	}
 	if limitStr != "" {
 		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
 			limit = l
 		}
 	}
+	if limit > maxProductPageSize {
+		limit = maxProductPageSize
+	}
 
 	offset := (page - 1) * limit
 
-	if sortBy == "" {
-		sortBy = "updated_at"
-		sortOrder = "DESC"
+	listing, err := parseProductListing(params)
+	var queryErr *QueryError
+	if errors.As(err, &queryErr) {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"status":   "error",
+			"message":  "Invalid search: " + queryErr.Message,
+			"position": queryErr.Position,
+		})
+		return
 	}
-
-	validSortColumns := map[string]bool{
-		"id":             true,
-		"partNo":         true,
-		"partName":       true,
-		"description":    true,
-		"cost":           true,
-		"qty":            true,
-		"material":       true,
-		"material_size":  true,
-		"material_cost":  true,
-		"finishing_type": true,
-		"finishing_cost": true,
-		"created_at":     true,
-		"updated_at":     true,
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error(), nil)
+		return
 	}
-	validSortOrders := map[string]bool{"ASC": true, "DESC": true}
 
-	if !validSortColumns[sortBy] {
-		sortBy = "updated_at"
-	}
-	if !validSortOrders[sortOrder] {
-		sortOrder = "DESC"
+	totalCount, err := listing.count()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Error counting products: "+err.Error(), nil)
+		return
 	}
 
-	baseQuery := `
-		SELECT id, partNo, partName, description, cost, qty, material,
-			   material_size, material_cost, finishing_type, finishing_cost,
-			   photos, drawing_2d, cad_3d, cnc_code, invoice, 
-			   created_at, updated_at 
-		FROM products 
-	`
-	countQuery := "SELECT COUNT(*) FROM products "
-	whereClause := ""
-	args := []interface{}{}
-
-	if query != "" {
-		whereClause = "WHERE partNo LIKE ? OR partName LIKE ? OR description LIKE ? OR material LIKE ?"
-		args = []interface{}{"%" + query + "%", "%" + query + "%", "%" + query + "%", "%" + query + "%"}
+	products, next, err := listing.load(limit, offset, params.Get("cursor"))
+	if errors.Is(err, errInvalidCursor) {
+		writeAPIError(w, http.StatusBadRequest, "Invalid request: "+err.Error(), nil)
+		return
 	}
-
-	var totalCount int
-	countQuery += whereClause
-	err := db.QueryRow(countQuery, args...).Scan(&totalCount)
 	if err != nil {
-		http.Error(w, "Error counting products: "+err.Error(), http.StatusInternalServerError)
+		writeAPIError(w, http.StatusInternalServerError, "Error querying products: "+err.Error(), nil)
 		return
 	}
-
-	fullQuery := baseQuery + whereClause + " ORDER BY " + sortBy + " " + sortOrder + " LIMIT ? OFFSET ?"
-	args = append(args, limit, offset)
-
-	rows, err := db.Query(fullQuery, args...)
+	facets, err := listing.facets()
 	if err != nil {
-		http.Error(w, "Error querying products: "+err.Error(), http.StatusInternalServerError)
+		writeAPIError(w, http.StatusInternalServerError, "Error counting facets: "+err.Error(), nil)
 		return
 	}
-	defer rows.Close()
 
-	var products []Product
-	for rows.Next() {
-		var p Product
-		var photosJSON sql.NullString
-
-		err := rows.Scan(
-			&p.ID,
-			&p.PartNo,
-			&p.PartName,
-			&p.Description,
-			&p.Cost,
-			&p.Qty,
-			&p.Material,
-			&p.MaterialSize,
-			&p.MaterialCost,
-			&p.FinishingType,
-			&p.FinishingCost,
-			&photosJSON,
-			&p.Drawing2D,
-			&p.Cad3D,
-			&p.CncCode,
-			&p.Invoice,
-			&p.CreatedAt,
-			&p.UpdatedAt,
-		)
-		if err != nil {
-			http.Error(w, "Error scanning product: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		if photosJSON.Valid && photosJSON.String != "" {
-			var photoFiles []FileInfo
-			if err := json.Unmarshal([]byte(photosJSON.String), &photoFiles); err == nil {
-				p.PhotoFiles = photoFiles
-			}
-		}
-
-		products = append(products, p)
+	if err := loadAttachments(products); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Error loading attachments: "+err.Error(), nil)
+		return
 	}
-
-	if err = rows.Err(); err != nil {
-		http.Error(w, "Error iterating products: "+err.Error(), http.StatusInternalServerError)
+	if err := loadFieldValues(products); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Error loading custom fields: "+err.Error(), nil)
+		return
+	}
+	if err := loadTagsAndCategories(products); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Error loading tags: "+err.Error(), nil)
+		return
+	}
+	if err := loadStockLevels(products); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Error loading stock levels: "+err.Error(), nil)
 		return
 	}
 
 	response := PaginatedResponse{
 		Products:    products,
-		HasMore:     (page * limit) < totalCount,
+		HasMore:     next != "",
+		Next:        next,
 		TotalCount:  totalCount,
 		CurrentPage: page,
+		Facets:      facets,
+	}
+	if params.Get("rows") == "html" {
+		// The list page appends these rows as it scrolls.
+		if response.Rows, err = renderProductRows(products, view); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "Error rendering products: "+err.Error(), nil)
+			return
+		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
+	writeJSON(w, http.StatusOK, response)
+}
 
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		http.Error(w, "Error encoding response: "+err.Error(), http.StatusInternalServerError)
+func indexHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Requested-With") == "XMLHttpRequest" {
+		apiProductsHandler(w, r)
 		return
 	}
+	renderProductList(w, r, true)
 }
 
-func indexHandler(w http.ResponseWriter, r *http.Request) {
+func searchHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Header.Get("X-Requested-With") == "XMLHttpRequest" {
 		apiProductsHandler(w, r)
 		return
 	}
+	renderProductList(w, r, false)
+}
 
-	query := r.URL.Query().Get("q")
-	sortBy := r.URL.Query().Get("sort")
-	sortOrder := r.URL.Query().Get("order")
-
-	if sortBy == "" {
-		sortBy = "updated_at"
-		sortOrder = "DESC"
+// renderProductList shows the first page of the listing described by the
+// request on the product list page, which loads the following pages from
+// /api/products as it is scrolled. With useDefault, a request without
+// parameters shows the default view.
+func renderProductList(w http.ResponseWriter, r *http.Request, useDefault bool) {
+	params, view, err := applySavedView(r.URL.Query(), useDefault)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if view != nil && r.URL.Query().Get("view") == "" {
+		// Show the default view at its own address, which sorting keeps.
+		http.Redirect(w, r, view.URL(), http.StatusSeeOther)
+		return
+	}
+	limit := defaultProductPageSize
+	if view != nil {
+		limit = view.PageSize
 	}
 
-	validSortColumns := map[string]bool{
-		"partNo":         true,
-		"partName":       true,
-		"description":    true,
-		"cost":           true,
-		"qty":            true,
-		"material":       true,
-		"material_size":  true,
-		"material_cost":  true,
-		"finishing_type": true,
-		"finishing_cost": true,
-		"updated_at":     true,
+	listing, err := parseProductListing(params)
+	var queryErr *QueryError
+	var products []Product
+	var next string
+	var totalCount int
+	var facets Facets
+	if errors.As(err, &queryErr) {
+		// Shown above the empty list so the query can be corrected.
+		w.WriteHeader(http.StatusBadRequest)
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if products, next, err = listing.load(limit, 0, ""); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if totalCount, err = listing.count(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if facets, err = listing.facets(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	validSortOrders := map[string]bool{"ASC": true, "DESC": true}
 
-	if !validSortColumns[sortBy] {
-		sortBy = "updated_at"
+	if err := loadAttachments(products); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	if !validSortOrders[sortOrder] {
-		sortOrder = "DESC"
+	if err := loadFieldValues(products); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-
-	limit := 500
-	querySQL := `
-		SELECT id, partNo, partName, description, cost, qty, material,
-			   material_size, material_cost, finishing_type, finishing_cost,
-			   photos, drawing_2d, cad_3d, cnc_code, invoice,
-			   created_at, updated_at
-		FROM products
-	`
-
-	args := []interface{}{}
-	if query != "" {
-		querySQL += " WHERE partNo LIKE ? OR partName LIKE ? OR description LIKE ? OR material LIKE ?"
-		args = append(args, "%"+query+"%", "%"+query+"%", "%"+query+"%", "%"+query+"%")
+	if err := loadTagsAndCategories(products); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-
-	querySQL += " ORDER BY " + sortBy + " " + sortOrder + " LIMIT ?"
-	args = append(args, limit)
-
-	rows, err := db.Query(querySQL, args...)
+	fields, err := loadCustomFields()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	categories, err := loadCategories()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	views, err := loadSavedViews()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
 
-	var products []Product
-	for rows.Next() {
-		var p Product
-		err := rows.Scan(
-			&p.ID,
-			&p.PartNo,
-			&p.PartName,
-			&p.Description,
-			&p.Cost,
-			&p.Qty,
-			&p.Material,
-			&p.MaterialSize,
-			&p.MaterialCost,
-			&p.FinishingType,
-			&p.FinishingCost,
-			&p.Photos,
-			&p.Drawing2D,
-			&p.Cad3D,
-			&p.CncCode,
-			&p.Invoice,
-			&p.CreatedAt,
-			&p.UpdatedAt,
-		)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		products = append(products, p)
+	exportURL := "/export"
+	if len(params) > 0 {
+		exportURL += "?" + params.Encode()
 	}
 
 	data := TemplateData{
 		Products:    products,
-		SearchQuery: query,
-		SortBy:      sortBy,
-		SortOrder:   sortOrder,
+		Fields:      fields,
+		Categories:  categories,
+		Category:    listing.Category.Int64,
+		SearchQuery: listing.Query,
+		SortBy:      listing.SortBy,
+		SortOrder:   listing.SortOrder,
+		Views:       views,
+		View:        view,
+		PageSize:    limit,
+		ExportURL:   exportURL,
+		Facets:      facets,
+		Params:      params,
+		TotalCount:  totalCount,
+	}
+	if next != "" {
+		more := url.Values{}
+		for key, values := range params {
+			more[key] = values
+		}
+		more.Set("limit", strconv.Itoa(limit))
+		more.Set("rows", "html")
+		more.Set("cursor", next)
+		data.NextURL = "/api/products?" + more.Encode()
+	}
+	if queryErr != nil {
+		data.Error = "Invalid search: " + queryErr.Message
 	}
 
 	tmpl := template.Must(template.New("index.html").Funcs(funcMap).ParseFiles("templates/index.html"))
@@ -485,161 +686,231 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func searchHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Header.Get("X-Requested-With") == "XMLHttpRequest" {
-		apiProductsHandler(w, r)
+// renderProductRows renders the product list rows of products, with the
+// columns of the saved view if there is one.
+func renderProductRows(products []Product, view *SavedView) (string, error) {
+	fields, err := loadCustomFields()
+	if err != nil {
+		return "", err
+	}
+	tmpl := template.Must(template.New("index.html").Funcs(funcMap).ParseFiles("templates/index.html"))
+	var buf bytes.Buffer
+	err = tmpl.ExecuteTemplate(&buf, "productRows", TemplateData{Products: products, Fields: fields, View: view})
+	return buf.String(), err
+}
+
+func addHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := template.Must(template.New("add.html").Funcs(funcMap).ParseFiles("templates/add.html"))
+	err := tmpl.Execute(w, addPageData{Currency: defaultCurrency, Revision: "A"})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+}
 
-	query := r.URL.Query().Get("q")
-	sortBy := r.URL.Query().Get("sort")
-	sortOrder := r.URL.Query().Get("order")
+func detailHandler(w http.ResponseWriter, r *http.Request) {
+	partNo := strings.TrimPrefix(r.URL.Path, "/detail/")
 
-	if sortBy == "" {
-		sortBy = "updated_at"
-		sortOrder = "DESC"
-	}
+	row := db.QueryRow("SELECT "+productColumns+" FROM products WHERE partNo = ?", partNo)
 
-	validSortColumns := map[string]bool{
-		"id":             true,
-		"partNo":         true,
-		"partName":       true,
-		"description":    true,
-		"cost":           true,
-		"qty":            true,
-		"material":       true,
-		"material_size":  true,
-		"material_cost":  true,
-		"finishing_type": true,
-		"finishing_cost": true,
-		"created_at":     true,
-		"updated_at":     true,
+	var p Product
+	err := scanProduct(row, &p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	validSortOrders := map[string]bool{"ASC": true, "DESC": true}
-
-	if !validSortColumns[sortBy] {
-		sortBy = "updated_at"
+	if err := loadProductAttachments(&p); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	if !validSortOrders[sortOrder] {
-		sortOrder = "DESC"
+	products := []Product{p}
+	if err := loadStockLevels(products); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-
-	limit := 5000
-	querySQL := `
-		SELECT id, partNo, partName, description, cost, qty, material,
-			   material_size, material_cost, finishing_type, finishing_cost,
-			   photos, drawing_2d, cad_3d, cnc_code, invoice, 
-			   created_at, updated_at 
-		FROM products 
-	`
-	args := []interface{}{}
-
-	if query != "" {
-		querySQL += "WHERE partNo LIKE ? OR partName LIKE ? OR description LIKE ? OR material LIKE ? "
-		args = append(args, "%"+query+"%", "%"+query+"%", "%"+query+"%", "%"+query+"%")
+	if err := loadFieldValues(products); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-
-	querySQL += "ORDER BY " + sortBy + " " + sortOrder + " LIMIT ?"
-	args = append(args, limit)
-
-	rows, err := db.Query(querySQL, args...)
-	if err != nil {
+	if err := loadTagsAndCategories(products); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
+	p = products[0]
+	if p.Finishes, err = loadFinishSteps(p.ID); err != nil {
+		http.Error(w, "Error loading finishing steps: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	var products []Product
-	for rows.Next() {
-		var p Product
-		err := rows.Scan(
-			&p.ID,
-			&p.PartNo,
-			&p.PartName,
-			&p.Description,
-			&p.Cost,
-			&p.Qty,
-			&p.Material,
-			&p.MaterialSize,
-			&p.MaterialCost,
-			&p.FinishingType,
-			&p.FinishingCost,
-			&p.Photos,
-			&p.Drawing2D,
-			&p.Cad3D,
-			&p.CncCode,
-			&p.Invoice,
-			&p.CreatedAt,
-			&p.UpdatedAt,
-		)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		products = append(products, p)
+	data := detailPageData{Product: p}
+	if data.BOM, err = explodeBOM(p.ID); err != nil {
+		http.Error(w, "Error loading BOM: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if data.WhereUsed, err = whereUsed(p.ID); err != nil {
+		http.Error(w, "Error loading where used: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if data.Movements, err = loadStockMovements(p.ID); err != nil {
+		http.Error(w, "Error loading stock movements: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if data.Locations, err = loadLocations(); err != nil {
+		http.Error(w, "Error loading locations: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if data.Routing, err = loadRouting(p.ID); err != nil {
+		http.Error(w, "Error loading routing: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if data.WorkCenters, err = loadWorkCenters(); err != nil {
+		http.Error(w, "Error loading work centers: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if data.History, err = loadAuditEvents(auditQuery{ProductID: p.ID}); err != nil {
+		http.Error(w, "Error loading history: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	batchSize := p.CostBatchSize
+	if n, err := strconv.Atoi(r.URL.Query().Get("batch")); err == nil && n > 0 {
+		batchSize = n
+	}
+	if data.Costing, err = rollUpCost(p.ID, batchSize); err != nil {
+		http.Error(w, "Error computing cost: "+err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	tmpl := template.Must(template.New("index.html").Funcs(funcMap).ParseFiles("templates/index.html"))
-	data := TemplateData{
-		Products:    products,
-		SearchQuery: query,
-		SortBy:      sortBy,
-		SortOrder:   sortOrder,
+	data.Unit = preferredUnit(r)
+	if strings.TrimSpace(p.MaterialSize) != "" {
+		var form string
+		if p.MaterialID != 0 {
+			m, err := findMaterial(db, p.MaterialID)
+			if err != nil {
+				http.Error(w, "Error loading material: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			form, data.Density = m.Form, m.Density
+		}
+		if size, err := parseMaterialSize(p.MaterialSize, form); err != nil {
+			data.SizeError = err.Error()
+		} else {
+			data.Size = &size
+		}
 	}
-	tmpl.Execute(w, data)
-}
 
-func addHandler(w http.ResponseWriter, r *http.Request) {
-	tmpl := template.Must(template.New("add.html").Funcs(funcMap).ParseFiles("templates/add.html"))
-	err := tmpl.Execute(w, nil)
+	tmpl := template.Must(template.New("detail.html").Funcs(funcMap).ParseFiles("templates/detail.html"))
+	err = tmpl.Execute(w, data)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
-func detailHandler(w http.ResponseWriter, r *http.Request) {
-	partNo := strings.TrimPrefix(r.URL.Path, "/detail/")
-
-	row := db.QueryRow(`
-		SELECT id, partNo, partName, description, cost, qty, material,
-			   material_size, material_cost, finishing_type, finishing_cost,
-			   photos, drawing_2d, cad_3d, cnc_code, invoice,
-			   created_at, updated_at
-		FROM products WHERE partNo = ?`, partNo)
+// productValues are the product columns set by the product forms and the
+// JSON API, once validated.
+type productValues struct {
+	PartNo        string
+	PartName      string
+	Description   string
+	Material      string
+	MaterialSize  string
+	FinishingType string
+	Costs         productCosts
+
+	MaterialSupplierID  sql.NullInt64
+	FinishingSupplierID sql.NullInt64
+	MaterialID          sql.NullInt64
+	CategoryID          sql.NullInt64
+}
 
-	var p Product
-	err := row.Scan(
-		&p.ID,
-		&p.PartNo,
-		&p.PartName,
-		&p.Description,
-		&p.Cost,
-		&p.Qty,
-		&p.Material,
-		&p.MaterialSize,
-		&p.MaterialCost,
-		&p.FinishingType,
-		&p.FinishingCost,
-		&p.Photos,
-		&p.Drawing2D,
-		&p.Cad3D,
-		&p.CncCode,
-		&p.Invoice,
-		&p.CreatedAt,
-		&p.UpdatedAt,
+// insert adds a product with the values and no stock; opening stock is
+// recorded as a stock movement.
+func (v productValues) insert(tx *sql.Tx) (int64, error) {
+	result, err := tx.Exec(`
+		INSERT INTO products(
+			partNo, partName, description, cost_minor, qty, material,
+			material_size, material_cost_minor, finishing_type, finishing_cost_minor,
+			currency, material_supplier_id, finishing_supplier_id, material_id, category_id
+		) VALUES(?, ?, ?, ?, 0, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`,
+		v.PartNo, v.PartName, v.Description, v.Costs.Cost, v.Material,
+		v.MaterialSize, v.Costs.MaterialCost, v.FinishingType, v.Costs.FinishingCost,
+		v.Costs.Currency, v.MaterialSupplierID, v.FinishingSupplierID, v.MaterialID, v.CategoryID,
 	)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return 0, partNoInUse(err, v.PartNo)
 	}
+	return result.LastInsertId()
+}
 
-	tmpl := template.Must(template.New("detail.html").Funcs(funcMap).ParseFiles("templates/detail.html"))
-	err = tmpl.Execute(w, p)
+// update stores the values over those of the product with the given id.
+func (v productValues) update(tx *sql.Tx, productID int) error {
+	_, err := tx.Exec(`
+		UPDATE products 
+		SET partNo=?, partName=?, description=?, cost_minor=?, material=?,
+			material_size=?, material_cost_minor=?, finishing_type=?, finishing_cost_minor=?,
+			currency=?, material_supplier_id=?, finishing_supplier_id=?, material_id=?, category_id=?,
+			updated_at=CURRENT_TIMESTAMP
+		WHERE id=?`,
+		v.PartNo, v.PartName, v.Description, v.Costs.Cost, v.Material,
+		v.MaterialSize, v.Costs.MaterialCost, v.FinishingType, v.Costs.FinishingCost,
+		v.Costs.Currency, v.MaterialSupplierID, v.FinishingSupplierID, v.MaterialID, v.CategoryID, productID)
+	return partNoInUse(err, v.PartNo)
+}
+
+// partNoInUse turns the UNIQUE constraint error of a part number stored
+// while another product took it into errPartNoInUse.
+func partNoInUse(err error, partNo string) error {
+	if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed: products.partNo") {
+		return fmt.Errorf("%w: %s", errPartNoInUse, partNo)
+	}
+	return err
+}
+
+// createProductDirs creates the upload folder of a part number with a
+// folder for each attachment category.
+func createProductDirs(partNo string) error {
+	partNoDir := filepath.Join(uploadDir, sanitizeFilename(partNo))
+	if err := os.MkdirAll(partNoDir, os.ModePerm); err != nil {
+		return fmt.Errorf("creating partNo directory: %w", err)
+	}
+	for _, dir := range []string{"photos", "drawings", "cad", "cnc", "invoice"} {
+		if err := os.MkdirAll(filepath.Join(partNoDir, dir), os.ModePerm); err != nil {
+			return fmt.Errorf("creating %s directory: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// moveProductDir rewrites the stored attachment paths of a product whose part
+// number changed and moves its upload folder to match. It is the last step
+// before the transaction commits: the returned function moves the folder back
+// when the commit fails. A product without a folder gets a new one.
+func moveProductDir(tx *sql.Tx, productID int, oldPartNo, newPartNo string) (func(), error) {
+	undo := func() {}
+	oldPath := filepath.Join(uploadDir, sanitizeFilename(oldPartNo))
+	newPath := filepath.Join(uploadDir, sanitizeFilename(newPartNo))
+	if _, err := os.Stat(oldPath); err != nil || oldPath == newPath {
+		return undo, createProductDirs(newPartNo)
+	}
+	_, err := tx.Exec(`
+		UPDATE attachments SET path = ? || substr(path, instr(path, '/'))
+		WHERE product_id = ? AND instr(path, '/') > 0`,
+		sanitizeFilename(newPartNo), productID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return undo, fmt.Errorf("updating attachment paths: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(newPath), os.ModePerm); err != nil {
+		return undo, fmt.Errorf("creating new directory: %w", err)
+	}
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return undo, fmt.Errorf("moving directory: %w", err)
 	}
+	return func() {
+		if err := os.Rename(newPath, oldPath); err != nil {
+			log.Printf("Error moving %s back to %s: %v", newPath, oldPath, err)
+		}
+	}, nil
 }
 
 func saveHandler(w http.ResponseWriter, r *http.Request) {
@@ -658,13 +929,47 @@ func saveHandler(w http.ResponseWriter, r *http.Request) {
 	partNo := r.FormValue("partNo")
 	partName := r.FormValue("partName")
 	description := r.FormValue("description")
-	cost := r.FormValue("cost")
 	qty, _ := strconv.Atoi(r.FormValue("qty"))
 	material := r.FormValue("material")
 	materialSize := r.FormValue("materialSize")
-	materialCost := r.FormValue("materialCost")
 	finishingType := r.FormValue("finishingType")
-	finishingCost := r.FormValue("finishingCost")
+	materialSupplierID := parseOptionalID(r.FormValue("materialSupplierId"))
+	finishingSupplierID := parseOptionalID(r.FormValue("finishingSupplierId"))
+	materialID := parseOptionalID(r.FormValue("materialId"))
+	finishIDs := parseFinishIDs(r)
+	categoryID := parseOptionalID(r.FormValue("categoryId"))
+	tags := parseTags(r.FormValue("tags"))
+
+	costs, costErr := parseProductCosts(r)
+	if costErr == nil {
+		costErr = applyCatalogMaterial(materialID, &material, materialSize, &costs, &materialSupplierID)
+	}
+	var finishSteps []FinishStep
+	if costErr == nil {
+		finishSteps, costErr = applyFinishSteps(finishIDs, &finishingType, materialSize, materialID, &costs, &finishingSupplierID)
+	}
+	fields, fieldValues, fieldErr := parseCustomFieldValues(r)
+	if fieldErr != nil && costErr == nil {
+		costErr = fieldErr
+	}
+	if qty < 0 && costErr == nil {
+		costErr = fmt.Errorf("Quantity: opening stock must not be negative")
+	}
+
+	revision := strings.TrimSpace(r.FormValue("revision"))
+	if revision == "" {
+		revision = "A"
+	}
+	if err := validateRevisionLabel(revision); err != nil && costErr == nil {
+		costErr = err
+	}
+
+	// An unreadable size is only a warning: submitting the form again with
+	// acceptSize set saves it as entered.
+	var sizeWarning error
+	if costErr == nil && r.FormValue("acceptSize") == "" {
+		sizeWarning = checkMaterialSize(materialSize, materialID)
+	}
 
 	var exists bool
 	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM products WHERE partNo = ?)", partNo).Scan(&exists)
@@ -673,118 +978,188 @@ func saveHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if exists {
-		data := struct {
-			Error         string
-			PartNo        string
-			PartName      string
-			Description   string
-			Cost          string
-			Qty           int
-			Material      string
-			MaterialSize  string
-			MaterialCost  string
-			FinishingType string
-			FinishingCost string
-		}{
-			Error:         "PartNo number already exists",
+	// showForm shows the form again with the values entered and a message.
+	showForm := func(message, warning string) {
+		data := addPageData{
 			PartNo:        partNo,
 			PartName:      partName,
 			Description:   description,
-			Cost:          cost,
+			Cost:          r.FormValue("cost"),
 			Qty:           qty,
 			Material:      material,
 			MaterialSize:  materialSize,
-			MaterialCost:  materialCost,
+			MaterialCost:  r.FormValue("materialCost"),
 			FinishingType: finishingType,
-			FinishingCost: finishingCost,
+			FinishingCost: r.FormValue("finishingCost"),
+			Currency:      r.FormValue("currency"),
+			Revision:      revision,
+
+			MaterialSupplierID:  materialSupplierID.Int64,
+			FinishingSupplierID: finishingSupplierID.Int64,
+			MaterialID:          materialID.Int64,
+			FinishIDs:           finishIDs,
+			Fields:              fieldValues,
+			CategoryID:          categoryID.Int64,
+			Tags:                r.FormValue("tags"),
+			Error:               message,
+			Warning:             warning,
+		}
+		tmpl := template.Must(template.New("add.html").Funcs(funcMap).ParseFiles("templates/add.html"))
+		if data.Error != "" {
+			w.WriteHeader(http.StatusBadRequest)
 		}
-
-		tmpl := template.Must(template.ParseFiles("templates/add.html"))
-		w.WriteHeader(http.StatusBadRequest)
 		tmpl.Execute(w, data)
+	}
+	switch {
+	case exists:
+		showForm("PartNo number already exists", "")
+		return
+	case costErr != nil:
+		showForm(costErr.Error(), "")
+		return
+	case sizeWarning != nil:
+		showForm("", sizeWarning.Error()+". Submit again to save it as entered.")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	productID, err := productValues{
+		PartNo:        partNo,
+		PartName:      partName,
+		Description:   description,
+		Material:      material,
+		MaterialSize:  materialSize,
+		FinishingType: finishingType,
+		Costs:         costs,
+
+		MaterialSupplierID:  materialSupplierID,
+		FinishingSupplierID: finishingSupplierID,
+		MaterialID:          materialID,
+		CategoryID:          categoryID,
+	}.insert(tx)
+	if errors.Is(err, errPartNoInUse) {
+		// Another product took the part number since it was checked.
+		tx.Rollback()
+		showForm("PartNo number already exists", "")
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	revisionID, err := createRevision(tx, int(productID), revision, "")
+	if err != nil {
+		http.Error(w, "Error creating revision: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := saveFinishSteps(tx, int(productID), finishSteps); err != nil {
+		http.Error(w, "Error saving finishing steps: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := saveCustomFieldValues(tx, int(productID), fields, fieldValues); err != nil {
+		http.Error(w, "Error saving custom fields: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	partNoDir := filepath.Join(uploadDir, sanitizeFilename(partNo))
-	err = os.MkdirAll(partNoDir, os.ModePerm)
-	if err != nil {
-		http.Error(w, "Error creating partNo directory: "+err.Error(), http.StatusInternalServerError)
+	if err := saveProductTags(tx, int(productID), tags); err != nil {
+		http.Error(w, "Error saving tags: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	subDirs := []string{"photos", "drawings", "cad", "cnc", "invoice"}
-	for _, dir := range subDirs {
-		dirPath := filepath.Join(partNoDir, dir)
-		err = os.MkdirAll(dirPath, os.ModePerm)
+	if qty != 0 {
+		_, err = recordStockMovement(tx, StockMovement{
+			ProductID: int(productID),
+			Type:      "adjustment",
+			Quantity:  qty,
+			Reason:    "Opening balance",
+			CreatedBy: currentUsername(),
+		})
 		if err != nil {
-			http.Error(w, "Error creating "+dir+" directory: "+err.Error(), http.StatusInternalServerError)
+			http.Error(w, "Error recording opening stock: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 	}
 
-	photoInfo := handleFileUpload(r, "photos", "photos")
-	drawingInfo := handleFileUpload(r, "drawings", "drawings")
-	cadInfo := handleFileUpload(r, "cad", "cad")
-	cncInfo := handleFileUpload(r, "cnc", "cnc")
-	invoiceInfo := handleFileUpload(r, "invoice", "invoice")
-
-	photosJSON, _ := json.Marshal(photoInfo)
-	drawingsJSON, _ := json.Marshal(drawingInfo)
-	cadJSON, _ := json.Marshal(cadInfo)
-	cncJSON, _ := json.Marshal(cncInfo)
-	invoiceJSON, _ := json.Marshal(invoiceInfo)
-
-	stmt, err := db.Prepare(`
-		INSERT INTO products(
-			partNo, partName, description, cost, qty, material,
-			material_size, material_cost, finishing_type, finishing_cost,
-			photos, drawing_2d, cad_3d, cnc_code, invoice
-		) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	var fileChanges []AuditChange
+	for _, category := range attachmentCategories {
+		var files []FileInfo
+		var fileRevisionID int64
+		if isRevisionCategory(category) {
+			files = handleFileUpload(r, category, revisionDir(revision, category))
+			fileRevisionID = revisionID
+		} else {
+			files = handleFileUpload(r, category, category)
+		}
+		changes, err := storeAttachments(tx, int(productID), fileRevisionID, category, files, "keepBoth")
+		if err != nil {
+			http.Error(w, "Error saving attachments: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fileChanges = append(fileChanges, changes...)
 	}
-	defer stmt.Close()
 
-	_, err = stmt.Exec(
-		partNo, partName, description, cost, qty, material,
-		materialSize, materialCost, finishingType, finishingCost,
-		string(photosJSON), string(drawingsJSON),
-		string(cadJSON), string(cncJSON), string(invoiceJSON),
-	)
-	if err != nil {
+	if err := tx.Commit(); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	// Uploads create the folders they need, so the product is usable
+	// without them.
+	if err := createProductDirs(partNo); err != nil {
+		log.Printf("Error creating the upload folder of %s: %v", partNo, err)
+	}
+	if _, err := recalculateCosts(int(productID)); err != nil {
+		log.Printf("Error costing product %d: %v", productID, err)
+	}
+	auditProductChange(int(productID), "create", map[string]string{})
+	auditFiles(int(productID), fileChanges)
 
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
 func modifyHandler(w http.ResponseWriter, r *http.Request) {
 	id := strings.TrimPrefix(r.URL.Path, "/modify/")
-	row := db.QueryRow(`
-		SELECT id, partNo, partName, description, cost, qty, material,
-			   material_size, material_cost, finishing_type, finishing_cost,
-			   photos, drawing_2d, cad_3d, cnc_code, invoice,
-			   created_at, updated_at
-		FROM products WHERE id = ?`, id)
+	row := db.QueryRow("SELECT "+productColumns+" FROM products WHERE id = ?", id)
 
 	var p Product
-	err := row.Scan(
-		&p.ID, &p.PartNo, &p.PartName, &p.Description, &p.Cost, &p.Qty,
-		&p.Material, &p.MaterialSize, &p.MaterialCost, &p.FinishingType, &p.FinishingCost,
-		&p.Photos, &p.Drawing2D, &p.Cad3D, &p.CncCode, &p.Invoice,
-		&p.CreatedAt, &p.UpdatedAt)
-
+	err := scanProduct(row, &p)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if err := loadProductAttachments(&p); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if p.Finishes, err = loadFinishSteps(p.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	products := []Product{p}
+	if err := loadFieldValues(products); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := loadTagsAndCategories(products); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p = products[0]
 
+	data := modifyPageData{
+		Product:            p,
+		CostInput:          formatAmount(p.Cost, p.Currency),
+		MaterialCostInput:  formatAmount(p.MaterialCost, p.Currency),
+		FinishingCostInput: formatAmount(p.FinishingCost, p.Currency),
+	}
 	tmpl := template.Must(template.New("modify.html").Funcs(funcMap).ParseFiles("templates/modify.html"))
-	err = tmpl.Execute(w, p)
+	err = tmpl.Execute(w, data)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -807,126 +1182,184 @@ func updateHandler(w http.ResponseWriter, r *http.Request) {
 	newPartNo := r.FormValue("partNo")
 	partName := r.FormValue("partName")
 	description := r.FormValue("description")
-	cost := r.FormValue("cost")
-	qty, _ := strconv.Atoi(r.FormValue("qty"))
 	material := r.FormValue("material")
 	materialSize := r.FormValue("materialSize")
-	materialCost := r.FormValue("materialCost")
 	finishingType := r.FormValue("finishingType")
-	finishingCost := r.FormValue("finishingCost")
-
-	// Action flags coming from hidden inputs in modify.html (default to keepBoth)
-	photosAction := defaultAction(r.FormValue("photosAction"))
-	drawingsAction := defaultAction(r.FormValue("drawingsAction"))
-	cadAction := defaultAction(r.FormValue("cadAction"))
-	cncAction := defaultAction(r.FormValue("cncAction"))
-	invoiceAction := defaultAction(r.FormValue("invoiceAction"))
-
-	var existingPhotos, existingDrawings, existingCad, existingCnc, existingInvoice string
-	err := db.QueryRow(`
-		SELECT photos, drawing_2d, cad_3d, cnc_code, invoice 
-		FROM products WHERE id = ?`, id).Scan(
-		&existingPhotos, &existingDrawings, &existingCad, &existingCnc, &existingInvoice)
+	materialSupplierID := parseOptionalID(r.FormValue("materialSupplierId"))
+	finishingSupplierID := parseOptionalID(r.FormValue("finishingSupplierId"))
+	materialID := parseOptionalID(r.FormValue("materialId"))
+	finishIDs := parseFinishIDs(r)
+	categoryID := parseOptionalID(r.FormValue("categoryId"))
+	tags := parseTags(r.FormValue("tags"))
+
+	productID, err := strconv.Atoi(id)
 	if err != nil {
-		http.Error(w, "Error getting existing files: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Invalid product id", http.StatusBadRequest)
 		return
 	}
 
 	var oldPartNo string
-	err = db.QueryRow("SELECT partNo FROM products WHERE id = ?", id).Scan(&oldPartNo)
+	err = db.QueryRow("SELECT partNo FROM products WHERE id = ?", productID).Scan(&oldPartNo)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Upload new files with action-aware behavior
-	photoInfo := handleFileUploadWithPartNoAndAction(r, "photos", "photos", newPartNo, photosAction)
-	drawingInfo := handleFileUploadWithPartNoAndAction(r, "drawings", "drawings", newPartNo, drawingsAction)
-	cadInfo := handleFileUploadWithPartNoAndAction(r, "cad", "cad", newPartNo, cadAction)
-	cncInfo := handleFileUploadWithPartNoAndAction(r, "cnc", "cnc", newPartNo, cncAction)
-	invoiceInfo := handleFileUploadWithPartNoAndAction(r, "invoice", "invoice", newPartNo, invoiceAction)
-
-	// Merge DB JSON taking action into account
-	photos := mergeFileDataWithAction(existingPhotos, photoInfo, photosAction)
-	drawings := mergeFileDataWithAction(existingDrawings, drawingInfo, drawingsAction)
-	cad := mergeFileDataWithAction(existingCad, cadInfo, cadAction)
-	cnc := mergeFileDataWithAction(existingCnc, cncInfo, cncAction)
-	invoice := mergeFileDataWithAction(existingInvoice, invoiceInfo, invoiceAction)
-
-	// If part number changed, move folder + rewrite paths (keep your existing behavior)
-	if oldPartNo != newPartNo {
-		oldPath := filepath.Join(uploadDir, sanitizeFilename(oldPartNo))
-		newPath := filepath.Join(uploadDir, sanitizeFilename(newPartNo))
+	newRevision := strings.TrimSpace(r.FormValue("newRevision"))
+	costs, err := parseProductCosts(r)
+	if err == nil {
+		err = applyCatalogMaterial(materialID, &material, materialSize, &costs, &materialSupplierID)
+	}
+	var finishSteps []FinishStep
+	if err == nil {
+		finishSteps, err = applyFinishSteps(finishIDs, &finishingType, materialSize, materialID, &costs, &finishingSupplierID)
+	}
+	fields, fieldValues, fieldErr := parseCustomFieldValues(r)
+	if err == nil {
+		err = fieldErr
+	}
+	if err == nil && newRevision != "" {
+		err = validateRevisionLabel(newRevision)
+		if err == nil {
+			err = checkRevisionFolder(db, productID, newRevision)
+		}
+	}
+	var sizeWarning error
+	if err == nil && r.FormValue("acceptSize") == "" {
+		sizeWarning = checkMaterialSize(materialSize, materialID)
+	}
+	if err != nil || sizeWarning != nil {
+		var p Product
+		if err := scanProduct(db.QueryRow("SELECT "+productColumns+" FROM products WHERE id = ?", productID), &p); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := loadProductAttachments(&p); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		p.PartNo, p.PartName, p.Description = newPartNo, partName, description
+		p.Material, p.MaterialSize, p.FinishingType = material, materialSize, finishingType
+		p.Currency = r.FormValue("currency")
+		p.MaterialSupplierID, p.FinishingSupplierID = materialSupplierID.Int64, finishingSupplierID.Int64
+		p.MaterialID = materialID.Int64
+		p.Fields = fieldValues
+		p.CategoryID, p.Tags = categoryID.Int64, tags
+		p.Finishes = nil
+		for _, id := range finishIDs {
+			p.Finishes = append(p.Finishes, FinishStep{FinishID: id})
+		}
 
-		if _, err := os.Stat(oldPath); err == nil {
-			if err := os.MkdirAll(filepath.Dir(newPath), os.ModePerm); err != nil {
-				http.Error(w, "Error creating new directory: "+err.Error(), http.StatusInternalServerError)
-				return
-			}
-			if err := os.Rename(oldPath, newPath); err != nil {
-				http.Error(w, "Error moving directory: "+err.Error(), http.StatusInternalServerError)
-				return
-			}
-			updateFilePaths := func(fileJSON, oldPartNo, newPartNo string) string {
-				if fileJSON == "" {
-					return ""
-				}
-				var files []FileInfo
-				if err := json.Unmarshal([]byte(fileJSON), &files); err != nil {
-					return fileJSON
-				}
-				for i := range files {
-					pathParts := strings.Split(files[i].Path, "/")
-					if len(pathParts) > 0 {
-						pathParts[0] = sanitizeFilename(newPartNo)
-						files[i].Path = strings.Join(pathParts, "/")
-					}
-				}
-				newJSON, _ := json.Marshal(files)
-				return string(newJSON)
-			}
-			photos = updateFilePaths(photos, oldPartNo, newPartNo)
-			drawings = updateFilePaths(drawings, oldPartNo, newPartNo)
-			cad = updateFilePaths(cad, oldPartNo, newPartNo)
-			cnc = updateFilePaths(cnc, oldPartNo, newPartNo)
-			invoice = updateFilePaths(invoice, oldPartNo, newPartNo)
+		data := modifyPageData{
+			Product:            p,
+			CostInput:          r.FormValue("cost"),
+			MaterialCostInput:  r.FormValue("materialCost"),
+			FinishingCostInput: r.FormValue("finishingCost"),
+		}
+		tmpl := template.Must(template.New("modify.html").Funcs(funcMap).ParseFiles("templates/modify.html"))
+		if err != nil {
+			data.Error = err.Error()
+			w.WriteHeader(http.StatusBadRequest)
 		} else {
-			newPartNoDir := filepath.Join(uploadDir, sanitizeFilename(newPartNo))
-			if err := os.MkdirAll(newPartNoDir, os.ModePerm); err != nil {
-				http.Error(w, "Error creating new partNo directory: "+err.Error(), http.StatusInternalServerError)
-				return
-			}
-			for _, dir := range []string{"photos", "drawings", "cad", "cnc", "invoice"} {
-				if err := os.MkdirAll(filepath.Join(newPartNoDir, dir), os.ModePerm); err != nil {
-					http.Error(w, "Error creating "+dir+" directory: "+err.Error(), http.StatusInternalServerError)
-					return
-				}
-			}
+			data.Warning = sizeWarning.Error() + ". Submit again to save it as entered."
 		}
+		tmpl.Execute(w, data)
+		return
 	}
 
-	stmt, err := db.Prepare(`
-		UPDATE products 
-		SET partNo=?, partName=?, description=?, cost=?, qty=?, material=?,
-			material_size=?, material_cost=?, finishing_type=?, finishing_cost=?,
-			photos=?, drawing_2d=?, cad_3d=?, cnc_code=?, invoice=?,
-			updated_at=CURRENT_TIMESTAMP
-		WHERE id=?`)
+	before := auditSnapshot(productID)
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Drawings, CAD and CNC files go to the current revision, or to a new
+	// revision started from the modify form.
+	var revisionID int64
+	var revision string
+	if newRevision != "" {
+		revision = newRevision
+		revisionID, err = createRevision(tx, productID, newRevision, strings.TrimSpace(r.FormValue("revisionNotes")))
+	} else {
+		revisionID, revision, err = currentRevision(tx, productID)
+	}
 	if err != nil {
-		http.Error(w, "Error preparing statement: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Error selecting revision: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer stmt.Close()
 
-	_, err = stmt.Exec(
-		newPartNo, partName, description, cost, qty, material,
-		materialSize, materialCost, finishingType, finishingCost,
-		photos, drawings, cad, cnc, invoice,
-		id)
+	// Upload new files with action-aware behavior. Action flags come from
+	// hidden inputs in modify.html (default to keepBoth). Files go to the
+	// current folder, which moves with the part number at the end.
+	var fileChanges []AuditChange
+	for _, category := range attachmentCategories {
+		action := defaultAction(r.FormValue(category + "Action"))
+		subDir := category
+		var fileRevisionID int64
+		if isRevisionCategory(category) {
+			subDir = revisionDir(revision, category)
+			fileRevisionID = revisionID
+		}
+		files := handleFileUploadWithPartNoAndAction(r, category, subDir, oldPartNo, action)
+		changes, err := storeAttachments(tx, productID, fileRevisionID, category, files, action)
+		if err != nil {
+			http.Error(w, "Error saving attachments: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fileChanges = append(fileChanges, changes...)
+	}
+
+	err = productValues{
+		PartNo:        newPartNo,
+		PartName:      partName,
+		Description:   description,
+		Material:      material,
+		MaterialSize:  materialSize,
+		FinishingType: finishingType,
+		Costs:         costs,
+
+		MaterialSupplierID:  materialSupplierID,
+		FinishingSupplierID: finishingSupplierID,
+		MaterialID:          materialID,
+		CategoryID:          categoryID,
+	}.update(tx, productID)
 	if err != nil {
 		http.Error(w, "Error updating product: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if err := saveFinishSteps(tx, productID, finishSteps); err != nil {
+		http.Error(w, "Error saving finishing steps: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := saveCustomFieldValues(tx, productID, fields, fieldValues); err != nil {
+		http.Error(w, "Error saving custom fields: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := saveProductTags(tx, productID, tags); err != nil {
+		http.Error(w, "Error saving tags: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	undoMove := func() {}
+	if oldPartNo != newPartNo {
+		undoMove, err = moveProductDir(tx, productID, oldPartNo, newPartNo)
+		if err != nil {
+			http.Error(w, "Error "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		undoMove()
+		http.Error(w, "Error updating product: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := recalculateCostsWithParents(productID); err != nil {
+		log.Printf("Error costing product %d: %v", productID, err)
+	}
+	auditProductChange(productID, "update", before)
+	auditFiles(productID, fileChanges)
 
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
@@ -959,37 +1392,26 @@ func handleFileUpload(r *http.Request, fieldName, subDir string) []FileInfo {
 	}
 
 	for _, fileHeader := range files {
-		file, err := fileHeader.Open()
-		if err != nil {
-			log.Printf("Error opening file: %v", err)
-			continue
-		}
-		defer file.Close()
-
 		filename := filepath.Base(fileHeader.Filename)
 		// // Keep original filename with spaces - only get base name
 		// filename = strings.ReplaceAll(filename, " ", "_")
 		filePath := filepath.Join(partNo, subDir, filename)
 		fullPath := filepath.Join(uploadDir, filePath)
 
-		dst, err := os.Create(fullPath)
+		size, checksum, err := writeUpload(fileHeader, fullPath)
 		if err != nil {
-			log.Printf("Error creating file: %v", err)
-			continue
-		}
-		defer dst.Close()
-
-		if _, err := io.Copy(dst, file); err != nil {
-			log.Printf("Error copying file content: %v", err)
+			log.Printf("Error saving file %s: %v", fullPath, err)
 			continue
 		}
 
 		info := FileInfo{
-			Name: fileHeader.Filename,
-			Size: formatFileSize(fileHeader.Size),
-			Type: fileHeader.Header.Get("Content-Type"),
-			Path: filepath.ToSlash(filePath),
-			Date: time.Now().Format("2006-01-02 15:04"),
+			Name:     filename,
+			Size:     formatFileSize(size),
+			Bytes:    size,
+			Type:     uploadMimeType(fileHeader),
+			Path:     filepath.ToSlash(filePath),
+			Date:     time.Now().Format("2006-01-02 15:04"),
+			Checksum: checksum,
 		}
 		fileInfo = append(fileInfo, info)
 
@@ -1077,20 +1499,6 @@ func handleFileUploadWithPartNo(r *http.Request, fieldName, subDir, partNo strin
 	return fileInfo
 }
 
-func mergeFileData(existingJSON string, newFiles []FileInfo) string {
-	var existing []FileInfo
-	if existingJSON != "" {
-		_ = json.Unmarshal([]byte(existingJSON), &existing)
-	}
-	existing = append(existing, newFiles...) // <— fix typo
-	merged, err := json.Marshal(existing)
-	if err != nil {
-		log.Printf("Error marshaling file data: %v", err)
-		return existingJSON
-	}
-	return string(merged)
-}
-
 func sanitizeFilename(name string) string {
 	name = strings.ToLower(name)
 	name = strings.ReplaceAll(name, " ", "_")
@@ -1129,17 +1537,6 @@ func formatFileSize(bytes int64) string {
 	return fmt.Sprintf("%.2f %s", size, sizes[i])
 }
 
-func hasFiles(s string) bool {
-	if s == "" || s == "null" {
-		return false
-	}
-	var arr []map[string]interface{}
-	if err := json.Unmarshal([]byte(s), &arr); err != nil {
-		return false
-	}
-	return len(arr) > 0
-}
-
 // func sanitizeFileNameLegacy(name string) string {
 // 	name = filepath.Base(name)
 // 	name = strings.ReplaceAll(name, " ", "_")
@@ -1214,78 +1611,48 @@ func removeFileHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Remove file request - ProductID: %s, Type: %s, Filename: %s",
 		request.ProductID, request.Type, request.Filename)
 
-	// Get partNo for the product
-	var partNo string
-	err := db.QueryRow("SELECT partNo FROM products WHERE id = ?", request.ProductID).Scan(&partNo)
-	if err != nil {
-		log.Printf("Error getting product: %v", err)
-		http.Error(w, "Error getting product: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	// Determine which field to update
-	var updateField string
-	switch request.Type {
-	case "photos":
-		updateField = "photos"
-	case "drawings":
-		updateField = "drawing_2d"
-	case "cad":
-		updateField = "cad_3d"
-	case "cnc":
-		updateField = "cnc_code"
-	case "invoice":
-		updateField = "invoice"
-	default:
+	if !isAttachmentCategory(request.Type) {
 		log.Printf("Invalid file type: %s", request.Type)
 		http.Error(w, "Invalid file type", http.StatusBadRequest)
 		return
 	}
 
-	// Get current file list
-	var fileJSON string
-	err = db.QueryRow("SELECT "+updateField+" FROM products WHERE id = ?", request.ProductID).Scan(&fileJSON)
-	if err != nil {
-		log.Printf("Error getting file list: %v", err)
-		http.Error(w, "Error getting file list: "+err.Error(), http.StatusInternalServerError)
+	// Revision scoped files are removed from the current revision, which is
+	// the one shown on the modify page.
+	row := db.QueryRow("SELECT "+attachmentColumns+` FROM attachments
+		WHERE product_id = ? AND category = ? AND name = ?
+		AND (revision_id IS NULL OR revision_id IN (SELECT id FROM revisions WHERE is_current = 1))`,
+		request.ProductID, request.Type, request.Filename)
+	fileToRemove, err := scanAttachment(row)
+	if err == sql.ErrNoRows {
+		log.Printf("File not found in database: %s", request.Filename)
+		http.Error(w, "File not found in database", http.StatusNotFound)
 		return
 	}
-
-	log.Printf("Current file JSON: %s", fileJSON)
-
-	// Parse current files
-	var files []FileInfo
-	if fileJSON != "" && fileJSON != "null" {
-		if err := json.Unmarshal([]byte(fileJSON), &files); err != nil {
-			log.Printf("Error unmarshaling file list: %v", err)
-			http.Error(w, "Error parsing file list: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-	}
-
-	log.Printf("Parsed %d files", len(files))
-
-	// Find and remove the file from the list
-	var newFiles []FileInfo
-	var fileToRemove *FileInfo
-	for i, file := range files {
-		log.Printf("Checking file %d: %s (looking for %s)", i, file.Name, request.Filename)
-		if file.Name == request.Filename {
-			fileToRemove = &files[i]
-			log.Printf("Found file to remove: %s at path: %s", file.Name, file.Path)
-		} else {
-			newFiles = append(newFiles, file)
-		}
+	if err != nil {
+		log.Printf("Error getting attachment: %v", err)
+		http.Error(w, "Error getting attachment: "+err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	if fileToRemove == nil {
-		log.Printf("File not found in database: %s", request.Filename)
-		http.Error(w, "File not found in database", http.StatusNotFound)
+	if err := removeAttachment(fileToRemove); err != nil {
+		log.Printf("Error updating database: %v", err)
+		http.Error(w, "Error updating database: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Delete physical file
-	fullPath := filepath.Join(uploadDir, fileToRemove.Path)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "success",
+		"message": "File removed successfully",
+	})
+}
+
+// removeAttachment deletes an attachment with its file and records the
+// removal in the audit log. A file already missing from disk is only logged.
+func removeAttachment(f FileInfo) error {
+	fullPath := filepath.Join(uploadDir, f.Path)
 	log.Printf("Attempting to delete file at: %s", fullPath)
 
 	if err := os.Remove(fullPath); err != nil {
@@ -1298,66 +1665,47 @@ func removeFileHandler(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Successfully deleted physical file: %s", fullPath)
 	}
 
-	// Update database with new file list
-	newFileJSON, err := json.Marshal(newFiles)
-	if err != nil {
-		log.Printf("Error marshaling new file list: %v", err)
-		http.Error(w, "Error updating file list: "+err.Error(), http.StatusInternalServerError)
-		return
+	if _, err := db.Exec("DELETE FROM attachments WHERE id = ?", f.ID); err != nil {
+		return err
 	}
 
-	log.Printf("New file JSON: %s", string(newFileJSON))
-
-	query := fmt.Sprintf("UPDATE products SET %s = ? WHERE id = ?", updateField)
-	result, err := db.Exec(query, string(newFileJSON), request.ProductID)
+	log.Printf("Removed attachment %d (%s)", f.ID, f.Name)
+	err := recordAudit(AuditEvent{
+		ProductID: f.ProductID,
+		Action:    "file_remove",
+		Changes:   []AuditChange{{Field: f.Category, Old: auditFileLabel(f)}},
+	})
 	if err != nil {
-		log.Printf("Error updating database: %v", err)
-		http.Error(w, "Error updating database: "+err.Error(), http.StatusInternalServerError)
-		return
+		log.Printf("Error recording removal of %s in the audit log: %v", f.Name, err)
 	}
-
-	rowsAffected, _ := result.RowsAffected()
-	log.Printf("Database updated successfully, rows affected: %d", rowsAffected)
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{
-		"status":  "success",
-		"message": "File removed successfully",
-	})
+	return nil
 }
 
-func deleteHandler(w http.ResponseWriter, r *http.Request) {
-	id := strings.TrimPrefix(r.URL.Path, "/delete/")
+// exportHandler writes the products to an Excel workbook, ordered by part
+// number. It takes the parameters of the product list, including view, to
+// export only the products listed.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Export request received")
 
-	row := db.QueryRow("SELECT partNo FROM products WHERE id = ?", id)
-	var partNo string
-	err := row.Scan(&partNo)
+	params, _, err := applySavedView(r.URL.Query(), false)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	partNoDir := filepath.Join(uploadDir, sanitizeFilename(partNo))
-	if _, err := os.Stat(partNoDir); err == nil {
-		if err := os.RemoveAll(partNoDir); err != nil {
-			log.Printf("Error removing partNo directory %s: %v", partNoDir, err)
-		} else {
-			log.Printf("Successfully deleted partNo directory: %s", partNoDir)
-		}
+	listing, err := parseProductListing(params)
+	var queryErr *QueryError
+	if errors.As(err, &queryErr) {
+		http.Error(w, "Invalid search: "+queryErr.Message, http.StatusBadRequest)
+		return
 	}
-
-	_, err = db.Exec("DELETE FROM products WHERE id = ?", id)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	http.Redirect(w, r, "/", http.StatusSeeOther)
-}
-
-func exportHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("Export request received")
+	order := "partNo"
+	if params.Get("sort") != "" {
+		order = listing.sortColumn + " " + listing.SortOrder
+	}
 
 	f := excelize.NewFile()
 
@@ -1372,7 +1720,8 @@ func exportHandler(w http.ResponseWriter, r *http.Request) {
 	f.DeleteSheet("Sheet1")
 
 	headers := []string{"PartNo", "PartName", "Description", "Cost", "Quantity", "Material",
-		"Material Size", "Material Cost", "Finishing Type", "Finishing Cost", "Created At", "Updated At"}
+		"Material Size", "Material Cost", "Finishing Type", "Finishing Cost", "Currency", "Created At", "Updated At",
+		"Category", "Tags"}
 	headerStyle, err := f.NewStyle(&excelize.Style{
 		Font: &excelize.Font{Bold: true, Size: 12},
 		Fill: excelize.Fill{Type: "pattern", Color: []string{"#C6EFCE"}, Pattern: 1},
@@ -1391,11 +1740,71 @@ func exportHandler(w http.ResponseWriter, r *http.Request) {
 		f.SetCellStyle(sheetName, cell, cell, headerStyle)
 	}
 
-	rows, err := db.Query(`
-		SELECT partNo, partName, description, cost, qty, material,
-			   material_size, material_cost, finishing_type, finishing_cost,
-			   created_at, updated_at 
-		FROM products ORDER BY partNo`)
+	// Custom fields follow the fixed columns, one column each.
+	fields, err := loadCustomFields()
+	if err != nil {
+		log.Printf("Error loading custom fields: %v", err)
+		http.Error(w, "Failed to load custom fields", http.StatusInternalServerError)
+		return
+	}
+	fieldValues, err := loadAllFieldValues()
+	if err != nil {
+		log.Printf("Error loading custom field values: %v", err)
+		http.Error(w, "Failed to load custom fields", http.StatusInternalServerError)
+		return
+	}
+	categories, err := loadCategories()
+	if err != nil {
+		log.Printf("Error loading categories: %v", err)
+		http.Error(w, "Failed to load categories", http.StatusInternalServerError)
+		return
+	}
+	categoryPaths := make(map[int64]string, len(categories))
+	for _, c := range categories {
+		categoryPaths[c.ID] = c.Path
+	}
+	productTags, err := loadAllTags()
+	if err != nil {
+		log.Printf("Error loading tags: %v", err)
+		http.Error(w, "Failed to load tags", http.StatusInternalServerError)
+		return
+	}
+	fieldColumns := make([]string, len(fields))
+	for i, field := range fields {
+		fieldColumns[i], _ = excelize.ColumnNumberToName(len(headers) + 1 + i)
+		cell := fieldColumns[i] + "1"
+		f.SetCellValue(sheetName, cell, field.Name)
+		f.SetCellStyle(sheetName, cell, cell, headerStyle)
+	}
+
+	// Costs are written as numbers with a currency format so Excel can sum
+	// them; one style is created per currency in use.
+	moneyStyles := map[string]int{}
+	moneyStyle := func(currency string) int {
+		if id, ok := moneyStyles[currency]; ok {
+			return id
+		}
+		numFmt := excelMoneyFormat(currency)
+		id, err := f.NewStyle(&excelize.Style{CustomNumFmt: &numFmt})
+		if err != nil {
+			log.Printf("Error creating currency style: %v", err)
+		}
+		moneyStyles[currency] = id
+		return id
+	}
+	setMoney := func(cell string, a Amount, currency string) {
+		if !a.Valid {
+			return
+		}
+		f.SetCellValue(sheetName, cell, a.Float(currency))
+		f.SetCellStyle(sheetName, cell, cell, moneyStyle(currency))
+	}
+
+	query, args := listing.source(`id, partNo, partName, description, cost_minor, qty, material,
+			   material_size, material_cost_minor, finishing_type, finishing_cost_minor,
+			   currency, created_at, updated_at, category_id`)
+	where, whereArgs := listing.filter("")
+	rows, err := db.Query(query+where+" ORDER BY "+order, append(args, whereArgs...)...)
 	if err != nil {
 		log.Printf("Error querying products: %v", err)
 		http.Error(w, "Failed to query products", http.StatusInternalServerError)
@@ -1406,13 +1815,15 @@ func exportHandler(w http.ResponseWriter, r *http.Request) {
 	rowNum := 2
 	productCount := 0
 	for rows.Next() {
-		var qty int
-		var partNo, partName, description, cost, material string
-		var materialSize, materialCost, finishingType, finishingCost string
+		var id, qty int
+		var partNo, partName, description, material string
+		var materialSize, finishingType, currency string
+		var cost, materialCost, finishingCost Amount
 		var createdAt, updatedAt time.Time
+		var categoryID sql.NullInt64
 
-		if err := rows.Scan(&partNo, &partName, &description, &cost, &qty, &material,
-			&materialSize, &materialCost, &finishingType, &finishingCost, &createdAt, &updatedAt); err != nil {
+		if err := rows.Scan(&id, &partNo, &partName, &description, &cost, &qty, &material,
+			&materialSize, &materialCost, &finishingType, &finishingCost, &currency, &createdAt, &updatedAt, &categoryID); err != nil {
 			log.Printf("Error scanning row: %v", err)
 			continue
 		}
@@ -1420,15 +1831,32 @@ func exportHandler(w http.ResponseWriter, r *http.Request) {
 		f.SetCellValue(sheetName, fmt.Sprintf("A%d", rowNum), partNo)
 		f.SetCellValue(sheetName, fmt.Sprintf("B%d", rowNum), partName)
 		f.SetCellValue(sheetName, fmt.Sprintf("C%d", rowNum), description)
-		f.SetCellValue(sheetName, fmt.Sprintf("D%d", rowNum), cost)
+		setMoney(fmt.Sprintf("D%d", rowNum), cost, currency)
 		f.SetCellValue(sheetName, fmt.Sprintf("E%d", rowNum), qty)
 		f.SetCellValue(sheetName, fmt.Sprintf("F%d", rowNum), material)
 		f.SetCellValue(sheetName, fmt.Sprintf("G%d", rowNum), materialSize)
-		f.SetCellValue(sheetName, fmt.Sprintf("H%d", rowNum), materialCost)
+		setMoney(fmt.Sprintf("H%d", rowNum), materialCost, currency)
 		f.SetCellValue(sheetName, fmt.Sprintf("I%d", rowNum), finishingType)
-		f.SetCellValue(sheetName, fmt.Sprintf("J%d", rowNum), finishingCost)
-		f.SetCellValue(sheetName, fmt.Sprintf("K%d", rowNum), createdAt.Format("2006-01-02 15:04:05"))
-		f.SetCellValue(sheetName, fmt.Sprintf("L%d", rowNum), updatedAt.Format("2006-01-02 15:04:05"))
+		setMoney(fmt.Sprintf("J%d", rowNum), finishingCost, currency)
+		f.SetCellValue(sheetName, fmt.Sprintf("K%d", rowNum), currency)
+		f.SetCellValue(sheetName, fmt.Sprintf("L%d", rowNum), createdAt.Format("2006-01-02 15:04:05"))
+		f.SetCellValue(sheetName, fmt.Sprintf("M%d", rowNum), updatedAt.Format("2006-01-02 15:04:05"))
+		f.SetCellValue(sheetName, fmt.Sprintf("N%d", rowNum), categoryPaths[categoryID.Int64])
+		f.SetCellValue(sheetName, fmt.Sprintf("O%d", rowNum), strings.Join(productTags[id], ", "))
+		for i, field := range fields {
+			value, ok := fieldValues[id][field.ID]
+			cell := fmt.Sprintf("%s%d", fieldColumns[i], rowNum)
+			switch {
+			case field.Type == "boolean":
+				f.SetCellValue(sheetName, cell, value == "1")
+			case !ok:
+			case field.Type == "number":
+				n, _ := strconv.ParseFloat(value, 64)
+				f.SetCellValue(sheetName, cell, n)
+			default:
+				f.SetCellValue(sheetName, cell, value)
+			}
+		}
 
 		rowNum++
 		productCount++
@@ -1436,8 +1864,19 @@ func exportHandler(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("Added %d products to Excel export", productCount)
 
+	if err := writeBOMSheet(f, headerStyle); err != nil {
+		log.Printf("Error writing BOM sheet: %v", err)
+		http.Error(w, "Failed to export BOM", http.StatusInternalServerError)
+		return
+	}
+	if err := writeRoutingSheet(f, headerStyle); err != nil {
+		log.Printf("Error writing Routing sheet: %v", err)
+		http.Error(w, "Failed to export routing", http.StatusInternalServerError)
+		return
+	}
+
 	for i := range headers {
-		col := string('A' + i)
+		col := string(rune('A' + i))
 		width := 15.0
 		if i == 1 { // PartName
 			width = 30.0
@@ -1449,9 +1888,14 @@ func exportHandler(w http.ResponseWriter, r *http.Request) {
 			width = 15.0
 		} else if i == 8 { // Finishing Type
 			width = 20.0
+		} else if i == 13 || i == 14 { // Category, Tags
+			width = 30.0
 		}
 		f.SetColWidth(sheetName, col, col, width)
 	}
+	for _, col := range fieldColumns {
+		f.SetColWidth(sheetName, col, col, 15)
+	}
 
 	w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
 	w.Header().Set("Content-Disposition", "attachment; filename=products.xlsx")
@@ -1573,32 +2017,45 @@ func defaultAction(a string) string {
 }
 
 func handleFileUploadWithPartNoAndAction(r *http.Request, fieldName, subDir, partNo, action string) []FileInfo {
+	fileInfo, _ := saveUploads(r, fieldName, subDir, partNo, action, nil)
+	return fileInfo
+}
+
+// uploadFailure is an uploaded file that could not be written.
+type uploadFailure struct {
+	Field string `json:"field"`
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+// saveUploads writes the files uploaded in fieldName to subDir of the
+// product folder, as handleFileUploadWithPartNoAndAction does, and also
+// returns the files that could not be written. Files are written through
+// batch when it is not nil.
+func saveUploads(r *http.Request, fieldName, subDir, partNo, action string, batch *uploadBatch) ([]FileInfo, []uploadFailure) {
 	var fileInfo []FileInfo
+	var failures []uploadFailure
 	if r.MultipartForm == nil {
-		return fileInfo
+		return fileInfo, failures
 	}
 
 	files := r.MultipartForm.File[fieldName]
 	if len(files) == 0 {
-		return fileInfo
+		return fileInfo, failures
 	}
 
 	partNoPath := filepath.Join(uploadDir, sanitizeFilename(partNo), subDir)
 	if err := os.MkdirAll(partNoPath, os.ModePerm); err != nil {
 		log.Printf("Error creating directory %s: %v", partNoPath, err)
-		return fileInfo
+		for _, fileHeader := range files {
+			failures = append(failures, uploadFailure{fieldName, filepath.Base(fileHeader.Filename), "creating folder: " + err.Error()})
+		}
+		return fileInfo, failures
 	}
 
 	act := strings.ToLower(strings.TrimSpace(action)) // <— normalize here too
 
 	for _, fileHeader := range files {
-		src, err := fileHeader.Open()
-		if err != nil {
-			log.Printf("Error opening file: %v", err)
-			continue
-		}
-		defer src.Close()
-
 		filename := filepath.Base(fileHeader.Filename)
 		fullPath := filepath.Join(partNoPath, filename)
 
@@ -1637,60 +2094,23 @@ func handleFileUploadWithPartNoAndAction(r *http.Request, fieldName, subDir, par
 			}
 		}
 
-		dst, err := os.Create(fullPath) // truncates if exists
+		size, checksum, err := batch.write(fileHeader, fullPath)
 		if err != nil {
-			log.Printf("Error creating file: %v", err)
-			continue
-		}
-		if _, err := io.Copy(dst, src); err != nil {
-			dst.Close()
-			log.Printf("Error copying file content: %v", err)
+			log.Printf("Error saving file %s: %v", fullPath, err)
+			failures = append(failures, uploadFailure{fieldName, filename, err.Error()})
 			continue
 		}
-		dst.Close()
 
 		relativePath := filepath.Join(sanitizeFilename(partNo), subDir, filename)
 		fileInfo = append(fileInfo, FileInfo{
-			Name: filename,
-			Size: formatFileSize(fileHeader.Size),
-			Type: fileHeader.Header.Get("Content-Type"),
-			Path: filepath.ToSlash(relativePath),
-			Date: time.Now().Format("2006-01-02 15:04"),
+			Name:     filename,
+			Size:     formatFileSize(size),
+			Bytes:    size,
+			Type:     uploadMimeType(fileHeader),
+			Path:     filepath.ToSlash(relativePath),
+			Date:     time.Now().Format("2006-01-02 15:04"),
+			Checksum: checksum,
 		})
 	}
-	return fileInfo
-}
-
-func mergeFileDataWithAction(existingJSON string, newFiles []FileInfo, action string) string {
-	var existing []FileInfo
-	if existingJSON != "" && existingJSON != "null" {
-		_ = json.Unmarshal([]byte(existingJSON), &existing)
-	}
-
-	if strings.ToLower(strings.TrimSpace(action)) == "replace" && len(newFiles) > 0 {
-		// Drop any existing entries that have the same filename as a newly uploaded one
-		newNames := make(map[string]struct{}, len(newFiles))
-		for _, nf := range newFiles {
-			newNames[strings.ToLower(nf.Name)] = struct{}{}
-		}
-		filtered := existing[:0]
-		for _, ex := range existing {
-			if _, clash := newNames[strings.ToLower(ex.Name)]; !clash {
-				filtered = append(filtered, ex)
-			}
-		}
-		existing = filtered
-	}
-
-	existing = append(existing, newFiles...) // <— fix the typo here
-
-	merged, err := json.Marshal(existing)
-	if err != nil {
-		log.Printf("Error marshaling file data: %v", err)
-		if existingJSON == "" {
-			return "[]"
-		}
-		return existingJSON
-	}
-	return string(merged)
+	return fileInfo, failures
 }
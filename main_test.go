@@ -0,0 +1,114 @@
+package main
+
+import (
+	"database/sql"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setupTestDB points db, uploadDir and trashDir at a fresh, migrated
+// database and empty folders for the test.
+func setupTestDB(t *testing.T) {
+	t.Helper()
+	skipWithoutFTS5(t)
+	dir := t.TempDir()
+	uploadDir = filepath.Join(dir, "uploads")
+	trashDir = filepath.Join(dir, "trash")
+	for _, d := range []string{uploadDir, trashDir} {
+		if err := os.MkdirAll(d, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(dir, "products.db")
+	testDB, err := sql.Open("sqlite3", path+"?_foreign_keys=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { testDB.Close() })
+	if err := migrateDB(testDB, path); err != nil {
+		t.Fatal(err)
+	}
+	db = testDB
+}
+
+// openLegacyDB creates a database of the original layout, before any
+// migration, holding the rows inserted by the SQL insert, and points
+// uploadDir at an empty folder.
+func openLegacyDB(t *testing.T, insert string) (*sql.DB, string) {
+	t.Helper()
+	dir := t.TempDir()
+	uploadDir = filepath.Join(dir, "uploads")
+	path := filepath.Join(dir, "products.db")
+	legacy, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { legacy.Close() })
+	_, err = legacy.Exec(`
+		CREATE TABLE products (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			partNo TEXT UNIQUE NOT NULL,
+			partName TEXT,
+			description TEXT,
+			cost TEXT,
+			qty INTEGER DEFAULT 0,
+			material TEXT,
+			material_size TEXT,
+			material_cost TEXT,
+			finishing_type TEXT,
+			finishing_cost TEXT,
+			photos TEXT,
+			drawing_2d TEXT,
+			cad_3d TEXT,
+			cnc_code TEXT,
+			invoice TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+	` + insert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return legacy, path
+}
+
+// serve sends a request through the application's routes.
+func serve(method, target, contentType string, body io.Reader) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	for _, route := range routes {
+		mux.HandleFunc(route.pattern, route.handler)
+	}
+	r := httptest.NewRequest(method, target, body)
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+// postForm posts url-encoded form values through the application's routes.
+func postForm(target string, values url.Values) *httptest.ResponseRecorder {
+	return serve(http.MethodPost, target, "application/x-www-form-urlencoded", strings.NewReader(values.Encode()))
+}
+
+// skipWithoutFTS5 skips a test that migrates a database when SQLite was built
+// without full-text search, which the migrations need.
+func skipWithoutFTS5(t *testing.T) {
+	t.Helper()
+	probe, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer probe.Close()
+	if _, err := probe.Exec("CREATE VIRTUAL TABLE probe USING fts5(text)"); err != nil {
+		t.Skip("SQLite was built without FTS5: run the tests with make test or go test -tags sqlite_fts5")
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Material is a catalog entry: a grade of material in one stock form, with
+// its density in g/cm³ and its price per kg or per metre of stock.
+type Material struct {
+	ID         int64   `json:"id"`
+	Grade      string  `json:"grade"`
+	Form       string  `json:"form"`
+	Density    float64 `json:"density"`
+	Price      Amount  `json:"priceMinor"`
+	Currency   string  `json:"currency"`
+	PriceUnit  string  `json:"priceUnit"`
+	SupplierID int64   `json:"supplierId,omitempty"`
+	Supplier   string  `json:"supplier,omitempty"`
+}
+
+// Name is the material text stored on products using this entry, e.g.
+// "6061-T6 Round Bar".
+func (m Material) Name() string {
+	return m.Grade + " " + materialFormLabel(m.Form)
+}
+
+var errMaterialCurrency = errors.New("catalog price is in a different currency")
+
+// stockSize reads a material size, taking the shape from the catalog form
+// when the size does not name one.
+func (m Material) stockSize(size string) (StockSize, error) {
+	parsed, err := parseMaterialSize(size, m.Form)
+	if err != nil {
+		return StockSize{}, err
+	}
+	if parsed.Shape != m.Form {
+		return StockSize{}, fmt.Errorf("size %q is a %s but %s is %s stock", size,
+			materialFormLabel(parsed.Shape), m.Grade, materialFormLabel(m.Form))
+	}
+	return parsed, nil
+}
+
+// CostFor computes the material cost of a piece with the given size, in the
+// product currency. Catalog prices are not converted between currencies.
+func (m Material) CostFor(size, currency string) (Amount, error) {
+	if !m.Price.Valid {
+		return Amount{}, fmt.Errorf("%s has no price", m.Name())
+	}
+	if m.Currency != currency {
+		return Amount{}, fmt.Errorf("%w: %s is priced in %s, the product uses %s",
+			errMaterialCurrency, m.Name(), m.Currency, currency)
+	}
+	parsed, err := m.stockSize(size)
+	if err != nil {
+		return Amount{}, err
+	}
+
+	quantity := parsed.Weight(m.Density)
+	if m.PriceUnit == "m" {
+		quantity = parsed.Length() / 1000
+	}
+	return Amount{Minor: int64(math.Round(quantity * float64(m.Price.Minor))), Valid: true}, nil
+}
+
+const materialColumns = `m.id, m.grade, m.form, m.density, m.price_minor, m.currency, m.price_unit,
+	m.supplier_id, s.name`
+
+const materialFrom = ` FROM materials m LEFT JOIN suppliers s ON s.id = m.supplier_id `
+
+func scanMaterial(s rowScanner, m *Material) error {
+	var supplierID sql.NullInt64
+	var supplier sql.NullString
+	err := s.Scan(&m.ID, &m.Grade, &m.Form, &m.Density, &m.Price, &m.Currency, &m.PriceUnit, &supplierID, &supplier)
+	m.SupplierID, m.Supplier = supplierID.Int64, supplier.String
+	return err
+}
+
+// loadMaterials returns the catalog ordered by grade and form. It is also
+// available to templates as "materials".
+func loadMaterials() ([]Material, error) {
+	rows, err := db.Query("SELECT " + materialColumns + materialFrom + "ORDER BY m.grade, m.form")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var materials []Material
+	for rows.Next() {
+		var m Material
+		if err := scanMaterial(rows, &m); err != nil {
+			return nil, err
+		}
+		materials = append(materials, m)
+	}
+	return materials, rows.Err()
+}
+
+func findMaterial(q rowQuerier, id int64) (Material, error) {
+	var m Material
+	err := scanMaterial(q.QueryRow("SELECT "+materialColumns+materialFrom+"WHERE m.id = ?", id), &m)
+	return m, err
+}
+
+// applyCatalogMaterial fills in the material name, cost and (if none was
+// chosen) supplier of a product form from the selected catalog material. The
+// cost typed on the form is kept when the size cannot be measured.
+func applyCatalogMaterial(materialID sql.NullInt64, material *string, materialSize string,
+	costs *productCosts, supplierID *sql.NullInt64) error {
+	if !materialID.Valid {
+		return nil
+	}
+	m, err := findMaterial(db, materialID.Int64)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("Material: catalog material %d does not exist", materialID.Int64)
+	}
+	if err != nil {
+		return err
+	}
+
+	*material = m.Name()
+	if !supplierID.Valid && m.SupplierID != 0 {
+		*supplierID = sql.NullInt64{Int64: m.SupplierID, Valid: true}
+	}
+	cost, err := m.CostFor(materialSize, costs.Currency)
+	if errors.Is(err, errMaterialCurrency) {
+		return fmt.Errorf("Material Cost: %v", err)
+	}
+	if err != nil {
+		log.Printf("Material cost of %s %q not computed: %v", m.Name(), materialSize, err)
+		return nil
+	}
+	costs.MaterialCost = cost
+	return nil
+}
+
+// recomputeMaterialCosts updates the material name and cost of every product
+// using a catalog material, after the catalog entry changed. Products whose
+// size cannot be measured or that use another currency keep their cost.
+func recomputeMaterialCosts(tx *sql.Tx, materialID int64) (int, error) {
+	m, err := findMaterial(tx, materialID)
+	if err != nil {
+		return 0, err
+	}
+
+	type productSize struct {
+		id                 int
+		partNo, size, curr string
+	}
+	rows, err := tx.Query("SELECT id, partNo, IFNULL(material_size, ''), currency FROM products WHERE material_id = ?", materialID)
+	if err != nil {
+		return 0, err
+	}
+	var products []productSize
+	for rows.Next() {
+		var p productSize
+		if err := rows.Scan(&p.id, &p.partNo, &p.size, &p.curr); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		products = append(products, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	updated := 0
+	for _, p := range products {
+		if _, err := tx.Exec("UPDATE products SET material = ? WHERE id = ?", m.Name(), p.id); err != nil {
+			return updated, err
+		}
+		cost, err := m.CostFor(p.size, p.curr)
+		if err != nil {
+			log.Printf("Material cost of %s not updated: %v", p.partNo, err)
+			continue
+		}
+		if _, err := tx.Exec("UPDATE products SET material_cost_minor = ? WHERE id = ?", cost, p.id); err != nil {
+			return updated, err
+		}
+		updated++
+	}
+	return updated, nil
+}
+
+// parseMaterialForm validates the catalog fields posted by the material
+// pages.
+func parseMaterialForm(r *http.Request) (Material, error) {
+	m := Material{
+		Grade:     strings.TrimSpace(r.FormValue("grade")),
+		Form:      r.FormValue("form"),
+		Currency:  strings.ToUpper(strings.TrimSpace(r.FormValue("currency"))),
+		PriceUnit: r.FormValue("priceUnit"),
+	}
+	var problems []string
+	if m.Grade == "" {
+		problems = append(problems, "Grade: grade is required")
+	}
+	if materialFormDimensions(m.Form) == "" {
+		problems = append(problems, fmt.Sprintf("Form: %q is not a known form", m.Form))
+	}
+	density, err := strconv.ParseFloat(strings.TrimSpace(r.FormValue("density")), 64)
+	if err != nil || density <= 0 {
+		problems = append(problems, "Density: enter the density in g/cm³, e.g. 2.70")
+	}
+	m.Density = density
+	if m.Currency == "" {
+		m.Currency = defaultCurrency
+	}
+	if !isCurrency(m.Currency) {
+		problems = append(problems, fmt.Sprintf("Currency: %q is not supported", m.Currency))
+		m.Currency = defaultCurrency
+	}
+	if m.PriceUnit != "kg" && m.PriceUnit != "m" {
+		problems = append(problems, "Price Unit: choose per kg or per metre")
+	}
+	if m.Price, err = parseAmount(r.FormValue("price"), m.Currency); err != nil {
+		problems = append(problems, "Price: "+err.Error())
+	}
+	m.SupplierID = parseOptionalID(r.FormValue("supplierId")).Int64
+
+	if len(problems) > 0 {
+		return m, errors.New(strings.Join(problems, "; "))
+	}
+	return m, nil
+}
+
+// saveMaterial inserts m, or updates it and recomputes the products using it,
+// and their unit costs, when m.ID is set. It returns the number of product
+// costs updated.
+func saveMaterial(m *Material) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	supplierID := sql.NullInt64{Int64: m.SupplierID, Valid: m.SupplierID != 0}
+	if m.ID == 0 {
+		var res sql.Result
+		res, err = tx.Exec(`
+			INSERT INTO materials(grade, form, density, price_minor, currency, price_unit, supplier_id)
+			VALUES(?, ?, ?, ?, ?, ?, ?)`,
+			m.Grade, m.Form, m.Density, m.Price, m.Currency, m.PriceUnit, supplierID)
+		if err == nil {
+			m.ID, err = res.LastInsertId()
+		}
+	} else {
+		_, err = tx.Exec(`
+			UPDATE materials SET grade = ?, form = ?, density = ?, price_minor = ?, currency = ?,
+				price_unit = ?, supplier_id = ?
+			WHERE id = ?`,
+			m.Grade, m.Form, m.Density, m.Price, m.Currency, m.PriceUnit, supplierID, m.ID)
+	}
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			return 0, fmt.Errorf("Grade: %s is already in the catalog", m.Name())
+		}
+		return 0, err
+	}
+
+	updated, err := recomputeMaterialCosts(tx, m.ID)
+	if err != nil {
+		return 0, err
+	}
+	// Finishing priced by weight depends on the density.
+	if _, err := repriceFinishing(tx, "material_id = ?", m.ID); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	if _, err := recalculateCostsWhere("material_id = ?", m.ID); err != nil {
+		log.Printf("Error costing the products made of %s: %v", m.Name(), err)
+	}
+	return updated, nil
+}
+
+// materialsHandler lists the material catalog (GET) and adds an entry from the
+// form on the same page (POST).
+func materialsHandler(w http.ResponseWriter, r *http.Request) {
+	var formError string
+	if r.Method == http.MethodPost {
+		m, err := parseMaterialForm(r)
+		if err == nil {
+			_, err = saveMaterial(&m)
+		}
+		if err == nil {
+			http.Redirect(w, r, "/materials", http.StatusSeeOther)
+			return
+		}
+		formError = err.Error()
+		w.WriteHeader(http.StatusBadRequest)
+	}
+
+	materials, err := loadMaterials()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tmpl := template.Must(template.New("materials.html").Funcs(funcMap).ParseFiles("templates/materials.html"))
+	err = tmpl.Execute(w, struct {
+		Materials []Material
+		Error     string
+	}{materials, formError})
+	if err != nil {
+		log.Printf("Error rendering materials: %v", err)
+	}
+}
+
+// materialHandler edits one catalog entry. Saving recomputes the material
+// cost of every product using it.
+func materialHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/material/"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid material id", http.StatusBadRequest)
+		return
+	}
+
+	data := struct {
+		Material
+		Error    string
+		Message  string
+		Products []Product
+	}{}
+	data.Material, err = findMaterial(db, id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Material not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		m, err := parseMaterialForm(r)
+		m.ID = id
+		var updated int
+		if err == nil {
+			updated, err = saveMaterial(&m)
+		}
+		if err == nil {
+			log.Printf("Material %s saved, %d product costs updated", m.Name(), updated)
+			http.Redirect(w, r, fmt.Sprintf("/material/%d?updated=%d", id, updated), http.StatusSeeOther)
+			return
+		}
+		data.Material, data.Error = m, err.Error()
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	if updated := r.URL.Query().Get("updated"); updated != "" {
+		data.Message = "Saved. Material cost updated on " + updated + " product(s)."
+	}
+
+	rows, err := db.Query("SELECT "+productColumns+" FROM products WHERE material_id = ? ORDER BY partNo", id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p Product
+		if err := scanProduct(rows, &p); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data.Products = append(data.Products, p)
+	}
+
+	tmpl := template.Must(template.New("material.html").Funcs(funcMap).ParseFiles("templates/material.html"))
+	if err := tmpl.Execute(w, data); err != nil {
+		log.Printf("Error rendering material: %v", err)
+	}
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// migration is a single numbered schema change. Versions must be strictly
+// increasing; a migration is never edited once it has shipped, a new one is
+// appended instead.
+type migration struct {
+	Version int
+	Name    string
+	Up      func(tx *sql.Tx) error
+}
+
+// migrations lists every schema change in the order it is applied.
+var migrations = []migration{
+	{1, "create products table", execStatements(`
+		CREATE TABLE IF NOT EXISTS products (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			partNo TEXT UNIQUE,
+			partName TEXT,
+			description TEXT,
+			cost TEXT,
+			qty INTEGER DEFAULT 0,
+			material TEXT,
+			material_size TEXT,
+			material_cost TEXT,
+			finishing_type TEXT,
+			finishing_cost TEXT,
+			photos TEXT,
+			drawing_2d TEXT,
+			cad_3d TEXT,
+			cnc_code TEXT,
+			invoice TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TRIGGER IF NOT EXISTS update_products_timestamp
+		AFTER UPDATE ON products
+		BEGIN
+			UPDATE products SET updated_at = DATETIME('now')
+			WHERE id = NEW.id;
+		END;
+	`)},
+	{2, "move attachments into attachments table", migrateAttachmentsFromJSON},
+	{3, "store costs as minor units with currency", withoutUpdatedAtTrigger(migrateCostsToMinorUnits)},
+	{4, "add part revisions", execStatements(`
+		CREATE TABLE revisions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+			rev TEXT NOT NULL,
+			notes TEXT,
+			is_current INTEGER NOT NULL DEFAULT 0,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(product_id, rev)
+		);
+		CREATE UNIQUE INDEX idx_revisions_current ON revisions(product_id) WHERE is_current = 1;
+		ALTER TABLE attachments ADD COLUMN revision_id INTEGER REFERENCES revisions(id) ON DELETE CASCADE;
+
+		INSERT INTO revisions(product_id, rev, is_current, created_at)
+		SELECT id, 'A', 1, created_at FROM products;
+		UPDATE attachments SET revision_id = (
+			SELECT r.id FROM revisions r WHERE r.product_id = attachments.product_id
+		) WHERE category IN ('drawings', 'cad', 'cnc');
+	`)},
+	{5, "add bill of materials", execStatements(`
+		CREATE TABLE bom_items (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			parent_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+			child_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+			quantity REAL NOT NULL CHECK(quantity > 0),
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(parent_id, child_id),
+			CHECK(parent_id <> child_id)
+		);
+		CREATE INDEX idx_bom_items_child ON bom_items(child_id);
+	`)},
+	{6, "add stock movement ledger", withoutUpdatedAtTrigger(execStatements(`
+		CREATE TABLE stock_movements (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+			type TEXT NOT NULL CHECK(type IN ('receipt', 'issue', 'adjustment', 'scrap')),
+			quantity INTEGER NOT NULL CHECK(quantity <> 0),
+			reason TEXT,
+			reference TEXT,
+			created_by TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX idx_stock_movements_product ON stock_movements(product_id, id);
+
+		UPDATE products SET qty = 0 WHERE qty IS NULL;
+		INSERT INTO stock_movements(product_id, type, quantity, reason, created_at)
+		SELECT id, 'adjustment', qty, 'Opening balance', updated_at FROM products WHERE qty <> 0;
+
+		CREATE TRIGGER update_product_on_hand
+		AFTER INSERT ON stock_movements
+		BEGIN
+			UPDATE products SET qty = qty + NEW.quantity WHERE id = NEW.product_id;
+		END;
+	`))},
+	{7, "add stock locations", execStatements(`
+		CREATE TABLE locations (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			code TEXT NOT NULL UNIQUE COLLATE NOCASE,
+			name TEXT,
+			parent_id INTEGER REFERENCES locations(id),
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		INSERT INTO locations(code, name) VALUES('` + defaultLocationCode + `', 'Main store');
+
+		-- Rebuild stock_movements to add the location and the transfer type.
+		-- Nothing references the table, and the on-hand trigger is dropped
+		-- first so copying the rows does not count them twice.
+		DROP TRIGGER update_product_on_hand;
+		CREATE TABLE stock_movements_new (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+			location_id INTEGER NOT NULL REFERENCES locations(id),
+			type TEXT NOT NULL CHECK(type IN ('receipt', 'issue', 'adjustment', 'scrap', 'transfer')),
+			quantity INTEGER NOT NULL CHECK(quantity <> 0),
+			reason TEXT,
+			reference TEXT,
+			created_by TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		INSERT INTO stock_movements_new(id, product_id, location_id, type, quantity, reason, reference, created_by, created_at)
+		SELECT id, product_id, (SELECT id FROM locations WHERE code = '` + defaultLocationCode + `'),
+			   type, quantity, reason, reference, created_by, created_at
+		FROM stock_movements;
+		DROP TABLE stock_movements;
+		ALTER TABLE stock_movements_new RENAME TO stock_movements;
+		CREATE INDEX idx_stock_movements_product ON stock_movements(product_id, id);
+		CREATE INDEX idx_stock_movements_location ON stock_movements(location_id, product_id);
+
+		CREATE TRIGGER update_product_on_hand
+		AFTER INSERT ON stock_movements
+		BEGIN
+			UPDATE products SET qty = qty + NEW.quantity WHERE id = NEW.product_id;
+		END;
+	`)},
+	{8, "add suppliers", execStatements(`
+		CREATE TABLE suppliers (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE COLLATE NOCASE,
+			contact TEXT,
+			lead_time_days INTEGER CHECK(lead_time_days >= 0),
+			notes TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		ALTER TABLE products ADD COLUMN material_supplier_id INTEGER REFERENCES suppliers(id) ON DELETE SET NULL;
+		ALTER TABLE products ADD COLUMN finishing_supplier_id INTEGER REFERENCES suppliers(id) ON DELETE SET NULL;
+		CREATE TABLE invoices (
+			attachment_id INTEGER PRIMARY KEY REFERENCES attachments(id) ON DELETE CASCADE,
+			supplier_id INTEGER REFERENCES suppliers(id) ON DELETE SET NULL,
+			invoice_no TEXT,
+			invoice_date TEXT,  -- YYYY-MM-DD
+			amount_minor INTEGER,
+			currency TEXT
+		);
+		CREATE INDEX idx_invoices_supplier ON invoices(supplier_id);
+	`)},
+	{9, "add material catalog", execStatements(`
+		CREATE TABLE materials (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			grade TEXT NOT NULL COLLATE NOCASE,
+			form TEXT NOT NULL CHECK(form IN ('round_bar', 'flat_bar', 'plate', 'tube', 'hex')),
+			density REAL NOT NULL CHECK(density > 0),  -- g/cm³
+			price_minor INTEGER,
+			currency TEXT NOT NULL,
+			price_unit TEXT NOT NULL CHECK(price_unit IN ('kg', 'm')),
+			supplier_id INTEGER REFERENCES suppliers(id) ON DELETE SET NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(grade, form)
+		);
+		ALTER TABLE products ADD COLUMN material_id INTEGER REFERENCES materials(id) ON DELETE SET NULL;
+		CREATE INDEX idx_products_material ON products(material_id);
+	`)},
+	{10, "report unreadable material sizes", reportUnreadableMaterialSizes},
+	{11, "add finishing catalog", execStatements(`
+		CREATE TABLE finishes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE COLLATE NOCASE,
+			pricing TEXT NOT NULL CHECK(pricing IN ('area', 'weight', 'batch')),
+			rate_minor INTEGER,  -- per dm², per kg or per batch
+			batch_size INTEGER NOT NULL DEFAULT 1 CHECK(batch_size >= 1),
+			minimum_minor INTEGER,  -- minimum charge per batch
+			currency TEXT NOT NULL,
+			supplier_id INTEGER REFERENCES suppliers(id) ON DELETE SET NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE product_finishes (
+			product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+			step INTEGER NOT NULL,
+			finish_id INTEGER NOT NULL REFERENCES finishes(id),
+			basis TEXT,
+			cost_minor INTEGER,
+			PRIMARY KEY(product_id, step)
+		);
+		CREATE INDEX idx_product_finishes_finish ON product_finishes(finish_id);
+	`)},
+	{12, "add work centers and routing", execStatements(`
+		CREATE TABLE work_centers (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			code TEXT NOT NULL UNIQUE COLLATE NOCASE,
+			name TEXT,
+			rate_minor INTEGER,  -- per hour
+			currency TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE routing_operations (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+			op_no INTEGER NOT NULL CHECK(op_no > 0),
+			work_center_id INTEGER NOT NULL REFERENCES work_centers(id),
+			description TEXT,
+			setup_minutes REAL NOT NULL DEFAULT 0 CHECK(setup_minutes >= 0),
+			cycle_minutes REAL NOT NULL DEFAULT 0 CHECK(cycle_minutes >= 0),
+			cnc_attachment_id INTEGER REFERENCES attachments(id) ON DELETE SET NULL,
+			UNIQUE(product_id, op_no)
+		);
+		CREATE INDEX idx_routing_operations_work_center ON routing_operations(work_center_id);
+	`)},
+	{13, "add computed unit costs", execStatements(`
+		CREATE TABLE product_costs (
+			product_id INTEGER PRIMARY KEY REFERENCES products(id) ON DELETE CASCADE,
+			batch_size INTEGER NOT NULL DEFAULT 1 CHECK(batch_size > 0),
+			unit_cost_minor INTEGER,
+			currency TEXT NOT NULL,
+			computed_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+	`)},
+	{14, "add custom fields", execStatements(`
+		CREATE TABLE custom_fields (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE COLLATE NOCASE,
+			type TEXT NOT NULL CHECK(type IN ('text', 'number', 'date', 'select', 'boolean')),
+			options TEXT,
+			position INTEGER NOT NULL DEFAULT 0,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE product_field_values (
+			product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+			field_id INTEGER NOT NULL REFERENCES custom_fields(id) ON DELETE CASCADE,
+			value TEXT NOT NULL,
+			PRIMARY KEY(product_id, field_id)
+		);
+		CREATE INDEX idx_product_field_values_field ON product_field_values(field_id, value);
+	`)},
+	{15, "add categories and tags", execStatements(`
+		CREATE TABLE categories (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL COLLATE NOCASE,
+			parent_id INTEGER REFERENCES categories(id),
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE UNIQUE INDEX idx_categories_name ON categories(IFNULL(parent_id, 0), name);
+		ALTER TABLE products ADD COLUMN category_id INTEGER REFERENCES categories(id) ON DELETE SET NULL;
+		CREATE INDEX idx_products_category ON products(category_id);
+		CREATE TABLE tags (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE COLLATE NOCASE
+		);
+		CREATE TABLE product_tags (
+			product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+			tag_id INTEGER NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+			PRIMARY KEY(product_id, tag_id)
+		);
+		CREATE INDEX idx_product_tags_tag ON product_tags(tag_id);
+	`)},
+	{16, "add recycle bin", execStatements(`
+		CREATE TABLE trash (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			product_id INTEGER NOT NULL,
+			part_no TEXT NOT NULL,
+			part_name TEXT,
+			snapshot TEXT NOT NULL,
+			folder TEXT,
+			deleted_by TEXT,
+			deleted_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX idx_trash_deleted_at ON trash(deleted_at);
+		CREATE TABLE settings (
+			key TEXT PRIMARY KEY,
+			value TEXT NOT NULL
+		);
+	`)},
+	{17, "add audit log", execStatements(`
+		CREATE TABLE audit_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			product_id INTEGER NOT NULL,
+			part_no TEXT NOT NULL,
+			action TEXT NOT NULL CHECK(action IN ('create', 'update', 'delete', 'restore', 'file_upload', 'file_replace', 'file_remove')),
+			created_by TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX idx_audit_events_product ON audit_events(product_id, id);
+		CREATE INDEX idx_audit_events_created ON audit_events(created_at);
+		CREATE TABLE audit_changes (
+			event_id INTEGER NOT NULL REFERENCES audit_events(id) ON DELETE CASCADE,
+			field TEXT NOT NULL,
+			old_value TEXT,
+			new_value TEXT
+		);
+		CREATE INDEX idx_audit_changes_event ON audit_changes(event_id);
+	`)},
+	{18, "add full-text product search", createProductSearch},
+	{19, "add saved views", execStatements(`
+		CREATE TABLE saved_views (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE COLLATE NOCASE,
+			query TEXT NOT NULL DEFAULT '',
+			category_id INTEGER REFERENCES categories(id) ON DELETE SET NULL,
+			sort_by TEXT NOT NULL DEFAULT '',
+			sort_order TEXT NOT NULL DEFAULT '',
+			columns TEXT NOT NULL DEFAULT '',
+			page_size INTEGER NOT NULL DEFAULT 500,
+			is_default INTEGER NOT NULL DEFAULT 0,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE UNIQUE INDEX idx_saved_views_default ON saved_views(is_default) WHERE is_default;
+	`)},
+}
+
+// execStatements returns a migration step that runs the given SQL script.
+func execStatements(script string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(script)
+		return err
+	}
+}
+
+const updatedAtTriggerSQL = `
+	CREATE TRIGGER IF NOT EXISTS update_products_timestamp
+	AFTER UPDATE ON products
+	BEGIN
+		UPDATE products SET updated_at = DATETIME('now')
+		WHERE id = NEW.id;
+	END;
+`
+
+// withoutUpdatedAtTrigger wraps a data migration that rewrites product rows
+// so that converting stored values does not bump every updated_at.
+func withoutUpdatedAtTrigger(up func(tx *sql.Tx) error) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DROP TRIGGER IF EXISTS update_products_timestamp"); err != nil {
+			return err
+		}
+		if err := up(tx); err != nil {
+			return err
+		}
+		_, err := tx.Exec(updatedAtTriggerSQL)
+		return err
+	}
+}
+
+// reportMigrationIssue records a value a data migration could not convert so
+// it can be fixed by hand later.
+func reportMigrationIssue(tx *sql.Tx, version, productID int, field, value, message string) error {
+	_, err := tx.Exec(`
+		INSERT INTO migration_reports(migration, product_id, field, value, message)
+		VALUES(?, ?, ?, ?, ?)`, version, productID, field, value, message)
+	return err
+}
+
+// latestSchemaVersion is the schema version this build knows how to use.
+func latestSchemaVersion() int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// currentSchemaVersion returns the highest applied migration version, or 0
+// for a database that has never been migrated.
+func currentSchemaVersion(db *sql.DB) (int, error) {
+	var version sql.NullInt64
+	err := db.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// migrateDB brings the database at dbPath up to latestSchemaVersion. Before
+// touching an existing database a copy is written next to it, and a database
+// created by a newer build is refused rather than silently used.
+func migrateDB(db *sql.DB, dbPath string) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`)
+	if err != nil {
+		return fmt.Errorf("creating schema_migrations table: %w", err)
+	}
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS migration_reports (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			migration INTEGER NOT NULL,
+			product_id INTEGER,
+			field TEXT,
+			value TEXT,
+			message TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`)
+	if err != nil {
+		return fmt.Errorf("creating migration_reports table: %w", err)
+	}
+
+	current, err := currentSchemaVersion(db)
+	if err != nil {
+		return fmt.Errorf("reading schema version: %w", err)
+	}
+
+	latest := latestSchemaVersion()
+	if current > latest {
+		return fmt.Errorf("database %s is at schema version %d but this build only supports up to version %d; "+
+			"please run a newer version of Product Manager", dbPath, current, latest)
+	}
+	if current == latest {
+		log.Printf("Database schema is up to date (version %d)", current)
+		return nil
+	}
+
+	var hasProducts bool
+	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'products')").Scan(&hasProducts)
+	if err != nil {
+		return fmt.Errorf("inspecting database: %w", err)
+	}
+	if hasProducts {
+		backupPath, err := backupDB(db, dbPath, current)
+		if err != nil {
+			return fmt.Errorf("backing up database before migration: %w", err)
+		}
+		log.Printf("Database backed up to %s", backupPath)
+	}
+
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		if err := applyMigration(db, m); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.Version, m.Name, err)
+		}
+		log.Printf("Applied migration %d: %s", m.Version, m.Name)
+	}
+
+	return nil
+}
+
+func applyMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.Up(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO schema_migrations(version, name) VALUES(?, ?)", m.Version, m.Name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// backupDB writes a consistent copy of the database next to dbPath using
+// VACUUM INTO and returns the path of the copy.
+func backupDB(db *sql.DB, dbPath string, version int) (string, error) {
+	backupPath := fmt.Sprintf("%s.v%d-%s.bak", strings.TrimSuffix(dbPath, ".db"), version, time.Now().Format("20060102-150405"))
+	if _, err := os.Stat(backupPath); err == nil {
+		return "", fmt.Errorf("backup file %s already exists", backupPath)
+	}
+	if _, err := db.Exec("VACUUM INTO ?", backupPath); err != nil {
+		return "", err
+	}
+	return backupPath, nil
+}
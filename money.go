@@ -0,0 +1,323 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultCurrency is used for new products and for costs migrated from the
+// old free text columns.
+const defaultCurrency = "USD"
+
+// currencies lists the currency codes accepted on the product forms with
+// their display symbol and number of minor unit digits.
+var currencies = []struct {
+	Code     string
+	Symbol   string
+	Decimals int
+}{
+	{"USD", "$", 2},
+	{"EUR", "€", 2},
+	{"GBP", "£", 2},
+	{"MYR", "RM", 2},
+	{"SGD", "S$", 2},
+	{"CNY", "CN¥", 2},
+	{"JPY", "¥", 0},
+}
+
+func isCurrency(code string) bool {
+	for _, c := range currencies {
+		if c.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+func currencySymbol(code string) string {
+	for _, c := range currencies {
+		if c.Code == code {
+			return c.Symbol
+		}
+	}
+	return code + " "
+}
+
+func currencyDecimals(code string) int {
+	for _, c := range currencies {
+		if c.Code == code {
+			return c.Decimals
+		}
+	}
+	return 2
+}
+
+// Amount is a money value in minor units (cents) of the product currency.
+// Valid is false when no amount was entered.
+type Amount struct {
+	Minor int64
+	Valid bool
+}
+
+func (a *Amount) Scan(value any) error {
+	var n sql.NullInt64
+	if err := n.Scan(value); err != nil {
+		return err
+	}
+	a.Minor, a.Valid = n.Int64, n.Valid
+	return nil
+}
+
+func (a Amount) Value() (driver.Value, error) {
+	if !a.Valid {
+		return nil, nil
+	}
+	return a.Minor, nil
+}
+
+func (a Amount) MarshalJSON() ([]byte, error) {
+	if !a.Valid {
+		return []byte("null"), nil
+	}
+	return strconv.AppendInt(nil, a.Minor, 10), nil
+}
+
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*a = Amount{}
+		return nil
+	}
+	n, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return fmt.Errorf("amount must be an integer number of minor units: %w", err)
+	}
+	*a = Amount{Minor: n, Valid: true}
+	return nil
+}
+
+// Float returns the amount in major units, e.g. 1250 cents as 12.5.
+func (a Amount) Float(currency string) float64 {
+	f := float64(a.Minor)
+	for i := 0; i < currencyDecimals(currency); i++ {
+		f /= 10
+	}
+	return f
+}
+
+// formatAmount renders an amount without currency symbol, suitable for form
+// inputs: 1250 USD becomes "12.50". An unset amount renders as "".
+func formatAmount(a Amount, currency string) string {
+	if !a.Valid {
+		return ""
+	}
+	decimals := currencyDecimals(currency)
+	sign := ""
+	minor := a.Minor
+	if minor < 0 {
+		sign = "-"
+		minor = -minor
+	}
+	if decimals == 0 {
+		return sign + strconv.FormatInt(minor, 10)
+	}
+	scale := int64(1)
+	for i := 0; i < decimals; i++ {
+		scale *= 10
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, minor/scale, decimals, minor%scale)
+}
+
+// formatMoney renders an amount for display, e.g. "$12.50".
+func formatMoney(a Amount, currency string) string {
+	if !a.Valid {
+		return ""
+	}
+	return currencySymbol(currency) + formatAmount(a, currency)
+}
+
+// excelMoneyFormat returns an Excel number format showing the currency
+// symbol and the currency's minor unit digits, e.g. "$"#,##0.00.
+func excelMoneyFormat(currency string) string {
+	format := `"` + currencySymbol(currency) + `"#,##0`
+	if decimals := currencyDecimals(currency); decimals > 0 {
+		format += "." + strings.Repeat("0", decimals)
+	}
+	return format
+}
+
+// parseAmount parses user input such as "12.5", "$1,234.50" or "3,20" into
+// minor units of currency. Blank input yields an unset amount.
+func parseAmount(s, currency string) (Amount, error) {
+	s = strings.TrimSpace(s)
+	for _, c := range currencies {
+		s = strings.TrimPrefix(s, c.Symbol)
+		s = strings.TrimPrefix(s, c.Code)
+		s = strings.TrimSuffix(s, c.Code)
+	}
+	s = strings.ReplaceAll(strings.TrimSpace(s), " ", "")
+	if s == "" {
+		return Amount{}, nil
+	}
+
+	// A lone comma followed by one or two digits is a decimal comma ("3,20");
+	// otherwise commas are thousands separators ("1,234.50").
+	if !strings.Contains(s, ".") {
+		if i := strings.LastIndex(s, ","); i >= 0 && strings.Count(s, ",") == 1 && len(s)-i-1 <= 2 {
+			s = s[:i] + "." + s[i+1:]
+		}
+	}
+	s = strings.ReplaceAll(s, ",", "")
+
+	if strings.HasPrefix(s, "-") {
+		return Amount{}, fmt.Errorf("%q must not be negative", s)
+	}
+
+	whole, frac, _ := strings.Cut(s, ".")
+	decimals := currencyDecimals(currency)
+	if len(frac) > decimals {
+		return Amount{}, fmt.Errorf("%q has more than %d decimal places", s, decimals)
+	}
+	if whole == "" {
+		whole = "0"
+	}
+	for _, part := range []string{whole, frac} {
+		for _, r := range part {
+			if r < '0' || r > '9' {
+				return Amount{}, fmt.Errorf("%q is not a valid amount", s)
+			}
+		}
+	}
+
+	digits := whole + frac + strings.Repeat("0", decimals-len(frac))
+	minor, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return Amount{}, fmt.Errorf("%q is not a valid amount", s)
+	}
+	return Amount{Minor: minor, Valid: true}, nil
+}
+
+// productCosts holds the validated currency and cost fields of a product form.
+type productCosts struct {
+	Currency      string
+	Cost          Amount
+	MaterialCost  Amount
+	FinishingCost Amount
+}
+
+// parseProductCosts validates the currency and cost inputs posted by the add
+// and modify forms. All problems are reported together in one error.
+func parseProductCosts(r *http.Request) (productCosts, error) {
+	costs := productCosts{Currency: strings.ToUpper(strings.TrimSpace(r.FormValue("currency")))}
+	if costs.Currency == "" {
+		costs.Currency = defaultCurrency
+	}
+
+	var problems []string
+	if !isCurrency(costs.Currency) {
+		problems = append(problems, fmt.Sprintf("Currency: %q is not supported", costs.Currency))
+		costs.Currency = defaultCurrency
+	}
+
+	fields := []struct {
+		label string
+		input string
+		dest  *Amount
+	}{
+		{"Part Cost", r.FormValue("cost"), &costs.Cost},
+		{"Material Cost", r.FormValue("materialCost"), &costs.MaterialCost},
+		{"Finishing Cost", r.FormValue("finishingCost"), &costs.FinishingCost},
+	}
+	for _, f := range fields {
+		amount, err := parseAmount(f.input, costs.Currency)
+		if err != nil {
+			problems = append(problems, f.label+": "+err.Error())
+			continue
+		}
+		*f.dest = amount
+	}
+
+	if len(problems) > 0 {
+		return costs, errors.New(strings.Join(problems, "; "))
+	}
+	return costs, nil
+}
+
+// migrateCostsToMinorUnits replaces the free text cost columns with integer
+// minor unit columns plus a currency code. Values that cannot be parsed are
+// left unset and recorded in migration_reports.
+func migrateCostsToMinorUnits(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		ALTER TABLE products ADD COLUMN currency TEXT NOT NULL DEFAULT '` + defaultCurrency + `';
+		ALTER TABLE products ADD COLUMN cost_minor INTEGER;
+		ALTER TABLE products ADD COLUMN material_cost_minor INTEGER;
+		ALTER TABLE products ADD COLUMN finishing_cost_minor INTEGER;
+	`)
+	if err != nil {
+		return err
+	}
+
+	type legacyCosts struct {
+		id                                int
+		partNo                            string
+		cost, materialCost, finishingCost sql.NullString
+	}
+	rows, err := tx.Query("SELECT id, partNo, cost, material_cost, finishing_cost FROM products")
+	if err != nil {
+		return err
+	}
+	var legacy []legacyCosts
+	for rows.Next() {
+		var c legacyCosts
+		if err := rows.Scan(&c.id, &c.partNo, &c.cost, &c.materialCost, &c.finishingCost); err != nil {
+			rows.Close()
+			return err
+		}
+		legacy = append(legacy, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, c := range legacy {
+		fields := []struct {
+			column string
+			value  sql.NullString
+		}{
+			{"cost", c.cost},
+			{"material_cost", c.materialCost},
+			{"finishing_cost", c.finishingCost},
+		}
+		for _, f := range fields {
+			amount, err := parseAmount(f.value.String, defaultCurrency)
+			if err != nil {
+				failed++
+				log.Printf("Could not parse %s %q of product %s: %v", f.column, f.value.String, c.partNo, err)
+				if err := reportMigrationIssue(tx, 3, c.id, f.column, f.value.String, err.Error()); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err := tx.Exec("UPDATE products SET "+f.column+"_minor = ? WHERE id = ?", amount, c.id); err != nil {
+				return err
+			}
+		}
+	}
+	if failed > 0 {
+		log.Printf("%d cost values could not be converted and were left empty; see the migration_reports table", failed)
+	}
+
+	_, err = tx.Exec(`
+		ALTER TABLE products DROP COLUMN cost;
+		ALTER TABLE products DROP COLUMN material_cost;
+		ALTER TABLE products DROP COLUMN finishing_cost;
+	`)
+	return err
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+func TestParseAmount(t *testing.T) {
+	for _, tc := range []struct {
+		input, currency string
+		want            Amount
+		err             string
+	}{
+		{"", "USD", Amount{}, ""},
+		{"   ", "USD", Amount{}, ""},
+		{"$", "USD", Amount{}, ""},
+		{"12", "USD", Amount{Minor: 1200, Valid: true}, ""},
+		{"12.5", "USD", Amount{Minor: 1250, Valid: true}, ""},
+		{".5", "USD", Amount{Minor: 50, Valid: true}, ""},
+		{"0", "USD", Amount{Minor: 0, Valid: true}, ""},
+		// Currency symbols and codes on either side.
+		{"$12", "USD", Amount{Minor: 1200, Valid: true}, ""},
+		{"USD 7", "USD", Amount{Minor: 700, Valid: true}, ""},
+		{"7 USD", "USD", Amount{Minor: 700, Valid: true}, ""},
+		{"S$3.10", "SGD", Amount{Minor: 310, Valid: true}, ""},
+		{"RM 45", "MYR", Amount{Minor: 4500, Valid: true}, ""},
+		// Thousands separators and decimal commas.
+		{"1,234.50", "USD", Amount{Minor: 123450, Valid: true}, ""},
+		{"$1,234,567.8", "USD", Amount{Minor: 123456780, Valid: true}, ""},
+		{"1,234", "USD", Amount{Minor: 123400, Valid: true}, ""},
+		{"3,20", "EUR", Amount{Minor: 320, Valid: true}, ""},
+		{"3,2", "EUR", Amount{Minor: 320, Valid: true}, ""},
+		{"€ 1 234,50", "EUR", Amount{Minor: 123450, Valid: true}, ""},
+		// Currencies without minor units.
+		{"¥1,000", "JPY", Amount{Minor: 1000, Valid: true}, ""},
+		{"12.5", "JPY", Amount{}, `"12.5" has more than 0 decimal places`},
+		// Input that would lose data or is not an amount.
+		{"12.345", "USD", Amount{}, `"12.345" has more than 2 decimal places`},
+		{"-5", "USD", Amount{}, `"-5" must not be negative`},
+		{"abc", "USD", Amount{}, `"abc" is not a valid amount`},
+		{"12 each", "USD", Amount{}, `"12each" is not a valid amount`},
+		{"1e3", "USD", Amount{}, `"1e3" is not a valid amount`},
+		{"99999999999999999999", "USD", Amount{}, `"99999999999999999999" is not a valid amount`},
+	} {
+		got, err := parseAmount(tc.input, tc.currency)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("parseAmount(%q, %s) = %v, %v, want error %q", tc.input, tc.currency, got, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("parseAmount(%q, %s) = %v, %v, want %v", tc.input, tc.currency, got, err, tc.want)
+		}
+	}
+}
+
+// TestMigrateCostsToMinorUnits migrates free text costs of the original
+// layout: amounts that can be read are converted and the others are left
+// unset and reported.
+func TestMigrateCostsToMinorUnits(t *testing.T) {
+	skipWithoutFTS5(t)
+	legacy, path := openLegacyDB(t, `
+		INSERT INTO products(partNo, cost, material_cost, finishing_cost) VALUES
+			('A-1', '$12', '1,234.50', ''),
+			('A-2', '12.345', 'abc', NULL),
+			('A-3', '3,20', '  ', '-1')`)
+	if err := migrateDB(legacy, path); err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+
+	for _, tc := range []struct {
+		partNo                            string
+		cost, materialCost, finishingCost sql.NullInt64
+	}{
+		{"A-1", sql.NullInt64{Int64: 1200, Valid: true}, sql.NullInt64{Int64: 123450, Valid: true}, sql.NullInt64{}},
+		{"A-2", sql.NullInt64{}, sql.NullInt64{}, sql.NullInt64{}},
+		{"A-3", sql.NullInt64{Int64: 320, Valid: true}, sql.NullInt64{}, sql.NullInt64{}},
+	} {
+		var currency string
+		var cost, materialCost, finishingCost sql.NullInt64
+		err := legacy.QueryRow("SELECT currency, cost_minor, material_cost_minor, finishing_cost_minor FROM products WHERE partNo = ?",
+			tc.partNo).Scan(&currency, &cost, &materialCost, &finishingCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if currency != defaultCurrency || cost != tc.cost || materialCost != tc.materialCost || finishingCost != tc.finishingCost {
+			t.Errorf("%s: %s %v %v %v, want %v %v %v", tc.partNo, currency, cost, materialCost, finishingCost,
+				tc.cost, tc.materialCost, tc.finishingCost)
+		}
+	}
+
+	rows, err := legacy.Query(`
+		SELECT p.partNo, r.field, r.value, r.message
+		FROM migration_reports r JOIN products p ON p.id = r.product_id
+		WHERE r.migration = 3 ORDER BY r.id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var reports []string
+	for rows.Next() {
+		var partNo, field, value, message string
+		if err := rows.Scan(&partNo, &field, &value, &message); err != nil {
+			t.Fatal(err)
+		}
+		reports = append(reports, partNo+" "+field+" "+value+": "+message)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`A-2 cost 12.345: "12.345" has more than 2 decimal places`,
+		`A-2 material_cost abc: "abc" is not a valid amount`,
+		`A-3 finishing_cost -1: "-1" must not be negative`,
+	}
+	if strings.Join(reports, "\n") != strings.Join(want, "\n") {
+		t.Errorf("migration reports:\n%s\nwant\n%s", strings.Join(reports, "\n"), strings.Join(want, "\n"))
+	}
+}
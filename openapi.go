@@ -0,0 +1,17 @@
+package main
+
+import "net/http"
+
+// openAPIPath is the OpenAPI 3 description of the JSON endpoints. The
+// interactive documentation at /static/api-docs.html is built from it.
+const openAPIPath = "static/openapi.json"
+
+// openAPIHandler serves the OpenAPI document at /api/openapi.json.
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	http.ServeFile(w, r, openAPIPath)
+}
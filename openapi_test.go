@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+type openAPIDocument struct {
+	OpenAPI    string                                `json:"openapi"`
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components map[string]map[string]json.RawMessage `json:"components"`
+}
+
+func loadOpenAPIDocument(t *testing.T) (openAPIDocument, []byte) {
+	t.Helper()
+	data, err := os.ReadFile(openAPIPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc openAPIDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("%s: %v", openAPIPath, err)
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		t.Fatalf("%s: openapi is %q, want 3.x", openAPIPath, doc.OpenAPI)
+	}
+	return doc, data
+}
+
+// TestOpenAPIDocumentsRoutes fails when a route that answers with JSON is
+// not described in the OpenAPI document under each of its path templates, or
+// when the document describes a path that no route serves.
+func TestOpenAPIDocumentsRoutes(t *testing.T) {
+	doc, _ := loadOpenAPIDocument(t)
+
+	mux := http.NewServeMux()
+	for _, route := range routes {
+		mux.HandleFunc(route.pattern, route.handler)
+	}
+	param := regexp.MustCompile(`\{[^}]+\}`)
+	served := map[string]bool{}
+	for _, route := range routes {
+		if strings.HasPrefix(route.pattern, "/api/") && !route.json {
+			t.Errorf("route %s is under /api/ but not marked json", route.pattern)
+		}
+		templates := route.paths
+		if len(templates) == 0 {
+			if route.json && strings.HasSuffix(route.pattern, "/") {
+				t.Errorf("route %s serves paths below it but lists none", route.pattern)
+			}
+			templates = []string{route.pattern}
+		}
+		for _, path := range templates {
+			served[path] = true
+			r := httptest.NewRequest(http.MethodGet, param.ReplaceAllString(path, "1"), nil)
+			if _, pattern := mux.Handler(r); pattern != route.pattern {
+				t.Errorf("route %s lists %s, which is served by %q", route.pattern, path, pattern)
+			}
+			if _, ok := doc.Paths[path]; route.json && !ok {
+				t.Errorf("%s is not described in %s", path, openAPIPath)
+			}
+		}
+	}
+
+	methods := map[string]bool{"get": true, "put": true, "post": true, "patch": true, "delete": true, "parameters": true}
+	for path, operations := range doc.Paths {
+		if !served[path] {
+			t.Errorf("%s describes %s, which no route serves", openAPIPath, path)
+		}
+		for method := range operations {
+			if !methods[method] {
+				t.Errorf("%s: %s has unexpected key %q", openAPIPath, path, method)
+			}
+		}
+	}
+}
+
+// TestOpenAPIReferences fails when the OpenAPI document refers to a schema
+// or response it does not define.
+func TestOpenAPIReferences(t *testing.T) {
+	doc, data := loadOpenAPIDocument(t)
+
+	refs := regexp.MustCompile(`"\$ref": "#/components/(\w+)/(\w+)"`).FindAllStringSubmatch(string(data), -1)
+	if len(refs) == 0 {
+		t.Fatalf("%s has no references", openAPIPath)
+	}
+	for _, ref := range refs {
+		if _, ok := doc.Components[ref[1]][ref[2]]; !ok {
+			t.Errorf("%s refers to undefined %s/%s", openAPIPath, ref[1], ref[2])
+		}
+	}
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// productInput is the JSON body of the product API. It uses the field names
+// and units of Product, so costs are minor units of the currency and an id of
+// 0 means none. POST and PUT start from an empty product, clearing the fields
+// left out; PATCH starts from the stored product and changes only the fields
+// given.
+type productInput struct {
+	PartNo              string            `json:"partNo"`
+	PartName            string            `json:"partName"`
+	Description         string            `json:"description"`
+	Cost                Amount            `json:"costMinor"`
+	Qty                 *int              `json:"qty"`
+	Material            string            `json:"material"`
+	MaterialSize        string            `json:"materialSize"`
+	MaterialCost        Amount            `json:"materialCostMinor"`
+	FinishingType       string            `json:"finishingType"`
+	FinishingCost       Amount            `json:"finishingCostMinor"`
+	Currency            string            `json:"currency"`
+	MaterialSupplierID  int64             `json:"materialSupplierId"`
+	FinishingSupplierID int64             `json:"finishingSupplierId"`
+	MaterialID          int64             `json:"materialId"`
+	FinishIDs           []int64           `json:"finishIds"`
+	Fields              map[string]string `json:"fields"`
+	CategoryID          int64             `json:"categoryId"`
+	Tags                []string          `json:"tags"`
+
+	// Revision is the first revision of a new product. On an existing
+	// product a label other than the current revision starts a new revision
+	// described by RevisionNotes.
+	Revision      string `json:"revision"`
+	RevisionNotes string `json:"revisionNotes"`
+
+	// AcceptSize saves a material size the parser cannot read as given.
+	AcceptSize bool `json:"acceptSize"`
+}
+
+// patchInput returns the stored values of p as the starting point of a
+// PATCH. Quantity is left out: it only changes through stock movements.
+func patchInput(p Product) productInput {
+	in := productInput{
+		PartNo:              p.PartNo,
+		PartName:            p.PartName,
+		Description:         p.Description,
+		Cost:                p.Cost,
+		Material:            p.Material,
+		MaterialSize:        p.MaterialSize,
+		MaterialCost:        p.MaterialCost,
+		FinishingType:       p.FinishingType,
+		FinishingCost:       p.FinishingCost,
+		Currency:            p.Currency,
+		MaterialSupplierID:  p.MaterialSupplierID,
+		FinishingSupplierID: p.FinishingSupplierID,
+		MaterialID:          p.MaterialID,
+		Fields:              map[string]string{},
+		CategoryID:          p.CategoryID,
+		Tags:                p.Tags,
+		Revision:            p.CurrentRevision,
+	}
+	for _, s := range p.Finishes {
+		in.FinishIDs = append(in.FinishIDs, s.FinishID)
+	}
+	for name, value := range p.Fields {
+		in.Fields[name] = value
+	}
+	return in
+}
+
+// productChange is a validated productInput, ready to be stored.
+type productChange struct {
+	productValues
+	finishSteps []FinishStep
+	fields      []CustomField
+	fieldValues map[string]string
+	tags        []string
+
+	// qty is the opening stock of a new product. revision is the first
+	// revision of a new product, or the new revision started on an existing
+	// one when not empty.
+	qty           int
+	revision      string
+	revisionNotes string
+}
+
+// resolve validates the input for the product current, or for a new product
+// when current is nil, and prices its catalog material and finishing steps as
+// the product forms do. Problems are returned keyed by the JSON field they
+// concern; a part number used by another product is reported as
+// errPartNoInUse once the input is otherwise valid.
+func (in productInput) resolve(current *Product) (productChange, map[string]string, error) {
+	optionalID := func(id int64) sql.NullInt64 {
+		return sql.NullInt64{Int64: id, Valid: id != 0}
+	}
+	c := productChange{
+		productValues: productValues{
+			PartNo:        strings.TrimSpace(in.PartNo),
+			PartName:      in.PartName,
+			Description:   in.Description,
+			Material:      in.Material,
+			MaterialSize:  in.MaterialSize,
+			FinishingType: in.FinishingType,
+			Costs: productCosts{
+				Currency:      strings.ToUpper(strings.TrimSpace(in.Currency)),
+				Cost:          in.Cost,
+				MaterialCost:  in.MaterialCost,
+				FinishingCost: in.FinishingCost,
+			},
+			MaterialSupplierID:  optionalID(in.MaterialSupplierID),
+			FinishingSupplierID: optionalID(in.FinishingSupplierID),
+			MaterialID:          optionalID(in.MaterialID),
+			CategoryID:          optionalID(in.CategoryID),
+		},
+		tags:          parseTags(strings.Join(in.Tags, ",")),
+		revision:      strings.TrimSpace(in.Revision),
+		revisionNotes: strings.TrimSpace(in.RevisionNotes),
+	}
+	problems := map[string]string{}
+
+	if c.PartNo == "" {
+		problems["partNo"] = "part number is required"
+	}
+	if c.Costs.Currency == "" {
+		c.Costs.Currency = defaultCurrency
+	}
+	if !isCurrency(c.Costs.Currency) {
+		problems["currency"] = fmt.Sprintf("%q is not supported", c.Costs.Currency)
+	}
+	for _, a := range []struct {
+		field  string
+		amount Amount
+	}{
+		{"costMinor", c.Costs.Cost},
+		{"materialCostMinor", c.Costs.MaterialCost},
+		{"finishingCostMinor", c.Costs.FinishingCost},
+	} {
+		if a.amount.Valid && a.amount.Minor < 0 {
+			problems[a.field] = "must not be negative"
+		}
+	}
+
+	for _, ref := range []struct {
+		field, table, label string
+		id                  sql.NullInt64
+	}{
+		{"materialSupplierId", "suppliers", "supplier", c.MaterialSupplierID},
+		{"finishingSupplierId", "suppliers", "supplier", c.FinishingSupplierID},
+		{"categoryId", "categories", "category", c.CategoryID},
+	} {
+		if !ref.id.Valid {
+			continue
+		}
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM "+ref.table+" WHERE id = ?)", ref.id.Int64).Scan(&exists); err != nil {
+			return c, nil, err
+		}
+		if !exists {
+			problems[ref.field] = fmt.Sprintf("%s %d does not exist", ref.label, ref.id.Int64)
+		}
+	}
+
+	if len(problems) == 0 {
+		if err := applyCatalogMaterial(c.MaterialID, &c.Material, c.MaterialSize, &c.Costs, &c.MaterialSupplierID); err != nil {
+			problems["materialId"] = err.Error()
+		}
+	}
+	if len(problems) == 0 {
+		steps, err := applyFinishSteps(in.FinishIDs, &c.FinishingType, c.MaterialSize, c.MaterialID, &c.Costs, &c.FinishingSupplierID)
+		if err != nil {
+			problems["finishIds"] = err.Error()
+		}
+		c.finishSteps = steps
+	}
+
+	fields, err := loadCustomFields()
+	if err != nil {
+		return c, nil, err
+	}
+	c.fields, c.fieldValues = fields, map[string]string{}
+	known := map[string]bool{}
+	for _, f := range fields {
+		known[f.Name] = true
+		value, err := f.normalize(in.Fields[f.Name])
+		if err != nil {
+			problems["fields."+f.Name] = err.Error()
+		} else if value != "" {
+			c.fieldValues[f.Name] = value
+		}
+	}
+	for name := range in.Fields {
+		if !known[name] {
+			problems["fields."+name] = "no such custom field"
+		}
+	}
+
+	if current == nil {
+		if c.revision == "" {
+			c.revision = "A"
+		}
+		if in.Qty != nil {
+			c.qty = *in.Qty
+		}
+		if c.qty < 0 {
+			problems["qty"] = "opening stock must not be negative"
+		}
+	} else {
+		if c.revision == current.CurrentRevision {
+			c.revision = ""
+		}
+		if in.Qty != nil && *in.Qty != current.Qty {
+			problems["qty"] = "stock is changed by posting to /api/stock-movements"
+		}
+	}
+	if c.revision != "" {
+		if err := validateRevisionLabel(c.revision); err != nil {
+			problems["revision"] = err.Error()
+		} else if current != nil {
+			if err := checkRevisionFolder(db, current.ID, c.revision); err != nil {
+				problems["revision"] = err.Error()
+			}
+		}
+	}
+
+	if len(problems) == 0 && !in.AcceptSize {
+		if err := checkMaterialSize(c.MaterialSize, c.MaterialID); err != nil {
+			problems["materialSize"] = err.Error() + "; set acceptSize to save it as given"
+		}
+	}
+	if len(problems) > 0 {
+		return c, problems, nil
+	}
+
+	id := 0
+	if current != nil {
+		id = current.ID
+	}
+	var taken bool
+	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM products WHERE partNo = ? AND id <> ?)", c.PartNo, id).Scan(&taken)
+	if err != nil {
+		return c, nil, err
+	}
+	if taken {
+		return c, nil, fmt.Errorf("%w: %s", errPartNoInUse, c.PartNo)
+	}
+	return c, nil, nil
+}
+
+// createProduct stores a validated new product with its first revision and
+// opening stock, and returns its id. Its upload folder is created once the
+// product is stored.
+func createProduct(c productChange) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	id, err := c.insert(tx)
+	if err != nil {
+		return 0, err
+	}
+	productID := int(id)
+	if _, err := createRevision(tx, productID, c.revision, ""); err != nil {
+		return 0, fmt.Errorf("creating revision: %w", err)
+	}
+	if err := saveFinishSteps(tx, productID, c.finishSteps); err != nil {
+		return 0, fmt.Errorf("saving finishing steps: %w", err)
+	}
+	if err := saveCustomFieldValues(tx, productID, c.fields, c.fieldValues); err != nil {
+		return 0, fmt.Errorf("saving custom fields: %w", err)
+	}
+	if err := saveProductTags(tx, productID, c.tags); err != nil {
+		return 0, fmt.Errorf("saving tags: %w", err)
+	}
+	if c.qty != 0 {
+		_, err = recordStockMovement(tx, StockMovement{
+			ProductID: productID,
+			Type:      "adjustment",
+			Quantity:  c.qty,
+			Reason:    "Opening balance",
+			CreatedBy: currentUsername(),
+		})
+		if err != nil {
+			return 0, fmt.Errorf("recording opening stock: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	// Uploads create the folders they need, so the product is usable
+	// without them.
+	if err := createProductDirs(c.PartNo); err != nil {
+		log.Printf("Error creating the upload folder of %s: %v", c.PartNo, err)
+	}
+	return productID, nil
+}
+
+// updateProduct stores a validated change of the product current, moving its
+// upload folder when the part number changed. The folder is moved last and
+// moved back when the change cannot be committed.
+func updateProduct(current Product, c productChange) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := c.update(tx, current.ID); err != nil {
+		return err
+	}
+	if c.revision != "" {
+		if _, err := createRevision(tx, current.ID, c.revision, c.revisionNotes); err != nil {
+			return fmt.Errorf("creating revision: %w", err)
+		}
+	}
+	if err := saveFinishSteps(tx, current.ID, c.finishSteps); err != nil {
+		return fmt.Errorf("saving finishing steps: %w", err)
+	}
+	if err := saveCustomFieldValues(tx, current.ID, c.fields, c.fieldValues); err != nil {
+		return fmt.Errorf("saving custom fields: %w", err)
+	}
+	if err := saveProductTags(tx, current.ID, c.tags); err != nil {
+		return fmt.Errorf("saving tags: %w", err)
+	}
+	undoMove := func() {}
+	if c.PartNo != current.PartNo {
+		if undoMove, err = moveProductDir(tx, current.ID, current.PartNo, c.PartNo); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		undoMove()
+		return err
+	}
+	return nil
+}
+
+// loadProductByPartNo loads a product with its files, stock, custom fields,
+// tags and finishing steps, as the product API returns it.
+func loadProductByPartNo(partNo string) (Product, error) {
+	var p Product
+	if err := scanProduct(db.QueryRow("SELECT "+productColumns+" FROM products WHERE partNo = ?", partNo), &p); err != nil {
+		return p, err
+	}
+	if err := loadProductAttachments(&p); err != nil {
+		return p, err
+	}
+	products := []Product{p}
+	if err := loadStockLevels(products); err != nil {
+		return p, err
+	}
+	if err := loadFieldValues(products); err != nil {
+		return p, err
+	}
+	if err := loadTagsAndCategories(products); err != nil {
+		return p, err
+	}
+	p = products[0]
+	var err error
+	p.Finishes, err = loadFinishSteps(p.ID)
+	return p, err
+}
+
+// productURL is the address of a product in the product API.
+func productURL(partNo string) string {
+	return "/api/products/" + url.PathEscape(partNo)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// writeAPIError replies with a JSON error. problems, when not empty, holds a
+// message for each request field that was rejected.
+func writeAPIError(w http.ResponseWriter, status int, message string, problems map[string]string) {
+	body := map[string]interface{}{"status": "error", "message": message}
+	if len(problems) > 0 {
+		body["errors"] = problems
+	}
+	writeJSON(w, status, body)
+}
+
+// decodeProductInput reads a JSON product body over in.
+func decodeProductInput(r *http.Request, in *productInput) error {
+	if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+		return fmt.Errorf("Invalid request: %v", err)
+	}
+	return nil
+}
+
+// writeProductChangeError replies to a rejected product change: 422 with the
+// problems of an invalid body, 409 for a part number in use.
+func writeProductChangeError(w http.ResponseWriter, problems map[string]string, err error) {
+	switch {
+	case len(problems) > 0:
+		writeAPIError(w, http.StatusUnprocessableEntity, "Invalid product", problems)
+	case errors.Is(err, errPartNoInUse):
+		writeAPIError(w, http.StatusConflict, "Part number already exists",
+			map[string]string{"partNo": err.Error()})
+	default:
+		writeAPIError(w, http.StatusInternalServerError, "Error checking product: "+err.Error(), nil)
+	}
+}
+
+// apiCreateProduct creates a product from a JSON body posted to
+// /api/products and returns it with status 201.
+func apiCreateProduct(w http.ResponseWriter, r *http.Request) {
+	var in productInput
+	if err := decodeProductInput(r, &in); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	c, problems, err := in.resolve(nil)
+	if problems != nil || err != nil {
+		writeProductChangeError(w, problems, err)
+		return
+	}
+
+	productID, err := createProduct(c)
+	if errors.Is(err, errPartNoInUse) {
+		writeProductChangeError(w, nil, err)
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Error creating product: "+err.Error(), nil)
+		return
+	}
+	if _, err := recalculateCosts(productID); err != nil {
+		log.Printf("Error costing product %d: %v", productID, err)
+	}
+	auditProductChange(productID, "create", map[string]string{})
+
+	p, err := loadProductByPartNo(c.PartNo)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Error loading product: "+err.Error(), nil)
+		return
+	}
+	w.Header().Set("Location", productURL(p.PartNo))
+	writeJSON(w, http.StatusCreated, p)
+}
+
+// apiProductHandler serves the product whose part number follows
+// /api/products/: GET returns it, PUT replaces it, PATCH changes the fields
+// given and DELETE moves it to the trash. Its files are served under
+// /api/products/{partNo}/attachments. A / in the part number is escaped.
+func apiProductHandler(w http.ResponseWriter, r *http.Request) {
+	escaped, sub, hasSub := strings.Cut(strings.TrimPrefix(r.URL.EscapedPath(), "/api/products/"), "/")
+	partNo, err := url.PathUnescape(escaped)
+	if err != nil || hasSub && sub != "attachments" && !strings.HasPrefix(sub, "attachments/") {
+		writeAPIError(w, http.StatusNotFound, "Not found", nil)
+		return
+	}
+	p, err := loadProductByPartNo(partNo)
+	if err == sql.ErrNoRows {
+		writeAPIError(w, http.StatusNotFound, "Product not found", nil)
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Error loading product: "+err.Error(), nil)
+		return
+	}
+	if hasSub {
+		apiAttachmentsHandler(w, r, p, strings.TrimPrefix(strings.TrimPrefix(sub, "attachments"), "/"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, p)
+
+	case http.MethodPut, http.MethodPatch:
+		var in productInput
+		if r.Method == http.MethodPatch {
+			in = patchInput(p)
+		}
+		if err := decodeProductInput(r, &in); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error(), nil)
+			return
+		}
+		c, problems, err := in.resolve(&p)
+		if problems != nil || err != nil {
+			writeProductChangeError(w, problems, err)
+			return
+		}
+
+		before := auditSnapshot(p.ID)
+		err = updateProduct(p, c)
+		if errors.Is(err, errPartNoInUse) {
+			writeProductChangeError(w, nil, err)
+			return
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "Error updating product: "+err.Error(), nil)
+			return
+		}
+		if _, err := recalculateCostsWithParents(p.ID); err != nil {
+			log.Printf("Error costing product %d: %v", p.ID, err)
+		}
+		auditProductChange(p.ID, "update", before)
+
+		if p, err = loadProductByPartNo(c.PartNo); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "Error loading product: "+err.Error(), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, p)
+
+	case http.MethodDelete:
+		before := auditSnapshot(p.ID)
+		trashID, err := trashProduct(int64(p.ID), currentUsername())
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "Error deleting product: "+err.Error(), nil)
+			return
+		}
+		auditProductChange(p.ID, "delete", before)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status":  "success",
+			"message": "Product " + p.PartNo + " moved to the trash",
+			"trashId": trashID,
+		})
+
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed", nil)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestProductPartNoTakenConcurrently stores a product change whose part
+// number another product took after it was validated: the change fails with
+// errPartNoInUse and leaves the upload folders as they were.
+func TestProductPartNoTakenConcurrently(t *testing.T) {
+	setupTestDB(t)
+	exists := func(partNo string) bool {
+		_, err := os.Stat(filepath.Join(uploadDir, sanitizeFilename(partNo)))
+		return err == nil
+	}
+
+	c, problems, err := productInput{PartNo: "NEW-1"}.resolve(nil)
+	if problems != nil || err != nil {
+		t.Fatalf("resolving: %v %v", problems, err)
+	}
+	if _, err := db.Exec("INSERT INTO products(partNo) VALUES('NEW-1')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createProduct(c); !errors.Is(err, errPartNoInUse) {
+		t.Errorf("createProduct: %v, want errPartNoInUse", err)
+	}
+	if exists("NEW-1") {
+		t.Error("createProduct left an upload folder for NEW-1")
+	}
+
+	if w := serve(http.MethodPost, "/api/products", "application/json", strings.NewReader(`{"partNo": "OLD-1"}`)); w.Code != http.StatusCreated {
+		t.Fatalf("creating product: %d %s", w.Code, w.Body)
+	}
+	current, err := loadProductByPartNo("OLD-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := patchInput(current)
+	in.PartNo = "OLD-2"
+	c, problems, err = in.resolve(&current)
+	if problems != nil || err != nil {
+		t.Fatalf("resolving: %v %v", problems, err)
+	}
+	if _, err := db.Exec("INSERT INTO products(partNo) VALUES('OLD-2')"); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateProduct(current, c); !errors.Is(err, errPartNoInUse) {
+		t.Errorf("updateProduct: %v, want errPartNoInUse", err)
+	}
+	if !exists("OLD-1") || exists("OLD-2") {
+		t.Error("updateProduct moved the upload folder of OLD-1")
+	}
+}
+
+// TestProductListErrorsAreJSON checks that /api/products reports errors in
+// the JSON error shape of the other API endpoints.
+func TestProductListErrorsAreJSON(t *testing.T) {
+	setupTestDB(t)
+	for _, tc := range []struct {
+		method, target string
+		status         int
+	}{
+		{http.MethodGet, "/api/products?cursor=not-a-cursor", http.StatusBadRequest},
+		{http.MethodGet, "/api/products?view=missing", http.StatusBadRequest},
+		{http.MethodGet, "/api/products?q=%22open", http.StatusBadRequest},
+		{http.MethodDelete, "/api/products", http.StatusMethodNotAllowed},
+	} {
+		w := serve(tc.method, tc.target, "", nil)
+		var reply struct {
+			Status  string `json:"status"`
+			Message string `json:"message"`
+		}
+		err := json.Unmarshal(w.Body.Bytes(), &reply)
+		if w.Code != tc.status || err != nil || reply.Status != "error" || reply.Message == "" {
+			t.Errorf("%s %s: %d %q, want %d with a JSON error", tc.method, tc.target, w.Code, w.Body, tc.status)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s %s: Content-Type %q", tc.method, tc.target, ct)
+		}
+	}
+}
+
+// TestAddFormPartNoTakenConcurrently posts the add form for a part number
+// another product takes between the check and the insert: the form is shown
+// again with the error and no upload folder is created.
+func TestAddFormPartNoTakenConcurrently(t *testing.T) {
+	setupTestDB(t)
+	// The trigger stores RACE-1 just before the form's own insert does.
+	_, err := db.Exec(`CREATE TEMP TRIGGER race BEFORE INSERT ON products WHEN NEW.partName = 'Form'
+		BEGIN INSERT INTO products(partNo) VALUES(NEW.partNo); END`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func(partNo string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("partNo", partNo)
+		mw.WriteField("partName", "Form")
+		mw.Close()
+		return serve(http.MethodPost, "/save", mw.FormDataContentType(), &body)
+	}
+
+	w := post("RACE-1")
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "PartNo number already exists") {
+		t.Errorf("saving RACE-1: %d %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(filepath.Join(uploadDir, "race-1")); !os.IsNotExist(err) {
+		t.Errorf("saving RACE-1 left an upload folder: %v", err)
+	}
+
+	if _, err := db.Exec("DROP TRIGGER race"); err != nil {
+		t.Fatal(err)
+	}
+	if w := post("RACE-2"); w.Code != http.StatusSeeOther {
+		t.Fatalf("saving RACE-2: %d %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(filepath.Join(uploadDir, "race-2", "photos")); err != nil {
+		t.Errorf("saving RACE-2: %v", err)
+	}
+}
+
+// TestRenameMovesFolderLast renames a product whose change cannot be
+// committed, then one that can: the folder and the stored attachment paths
+// only move with the part number.
+func TestRenameMovesFolderLast(t *testing.T) {
+	setupTestDB(t)
+	if w := serve(http.MethodPost, "/api/products", "application/json", strings.NewReader(`{"partNo": "OLD-1"}`)); w.Code != http.StatusCreated {
+		t.Fatalf("creating product: %d %s", w.Code, w.Body)
+	}
+	if code, reply := uploadFiles(t, "OLD-1", map[string]map[string]string{"photos": {"a.jpg": "jpeg"}}); code != http.StatusCreated {
+		t.Fatalf("uploading: %d %v", code, reply)
+	}
+	check := func(partNo string) {
+		t.Helper()
+		var path string
+		if err := db.QueryRow("SELECT path FROM attachments").Scan(&path); err != nil {
+			t.Fatal(err)
+		}
+		if want := sanitizeFilename(partNo) + "/photos/a.jpg"; path != want {
+			t.Errorf("attachment path %q, want %q", path, want)
+		}
+		if _, err := os.Stat(filepath.Join(uploadDir, filepath.FromSlash(path))); err != nil {
+			t.Error(err)
+		}
+	}
+
+	current, err := loadProductByPartNo("OLD-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	undo, err := moveProductDir(tx, current.ID, "OLD-1", "NEW-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+	undo()
+	check("OLD-1")
+
+	in := patchInput(current)
+	in.PartNo = "NEW-1"
+	c, problems, err := in.resolve(&current)
+	if problems != nil || err != nil {
+		t.Fatalf("resolving: %v %v", problems, err)
+	}
+	// A revision that already exists fails the change with the new part number.
+	c.revision = current.CurrentRevision
+	if err := updateProduct(current, c); err == nil {
+		t.Fatal("updateProduct stored an existing revision")
+	}
+	check("OLD-1")
+
+	c.revision = ""
+	if err := updateProduct(current, c); err != nil {
+		t.Fatal(err)
+	}
+	check("NEW-1")
+	if _, err := os.Stat(filepath.Join(uploadDir, "old-1")); !os.IsNotExist(err) {
+		t.Errorf("old folder: %v", err)
+	}
+}
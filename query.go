@@ -0,0 +1,366 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// QueryError is a search query that cannot be understood. Position is the
+// byte offset of the term at fault.
+type QueryError struct {
+	Message  string `json:"message"`
+	Position int    `json:"position"`
+}
+
+func (e *QueryError) Error() string {
+	return e.Message
+}
+
+// queryTerm is one space separated part of a search query: free text, or a
+// field filter such as material:6061 or qty<5.
+type queryTerm struct {
+	pos    int
+	negate bool
+	field  string
+	op     string
+	value  string
+	phrase bool
+}
+
+// searchField is a field a query can filter on. Kinds are text, number,
+// money, date, has, tag and category.
+type searchField struct {
+	kind   string
+	column string
+}
+
+var searchFields = map[string]searchField{
+	"partno":        {"text", "partNo"},
+	"name":          {"text", "partName"},
+	"description":   {"text", "description"},
+	"material":      {"text", "material"},
+	"size":          {"text", "material_size"},
+	"finishing":     {"text", "finishing_type"},
+	"currency":      {"text", "currency"},
+	"qty":           {"number", "qty"},
+	"cost":          {"money", "cost_minor"},
+	"materialcost":  {"money", "material_cost_minor"},
+	"finishingcost": {"money", "finishing_cost_minor"},
+	"created":       {"date", "created_at"},
+	"updated":       {"date", "updated_at"},
+	"has":           {"has", ""},
+	"tag":           {"tag", ""},
+	"category":      {"category", ""},
+}
+
+// hasAliases maps the words accepted after has: to attachment categories.
+var hasAliases = map[string]string{
+	"photo": "photos", "drawing": "drawings", "2d": "drawings",
+	"3d": "cad", "program": "cnc", "invoices": "invoice",
+}
+
+// parseSearchQuery splits a query into terms. Terms are separated by spaces;
+// a leading - negates a term, double quotes group words into a phrase or a
+// value, and a field name followed by :, =, <, <=, > or >= makes a filter.
+func parseSearchQuery(q string) ([]queryTerm, error) {
+	var terms []queryTerm
+	i := 0
+	for i < len(q) {
+		if isQuerySpace(q[i]) {
+			i++
+			continue
+		}
+		t := queryTerm{pos: i}
+		if q[i] == '-' && i+1 < len(q) && !isQuerySpace(q[i+1]) {
+			t.negate = true
+			i++
+		}
+
+		// The field name, or the whole term when no operator follows.
+		var key string
+		quoted := false
+		if q[i] == '"' {
+			value, next, err := readQuoted(q, i)
+			if err != nil {
+				return nil, err
+			}
+			key, quoted, i = value, true, next
+		} else {
+			j := i
+			for j < len(q) && !isQuerySpace(q[j]) && !strings.ContainsRune(`:<>="`, rune(q[j])) {
+				j++
+			}
+			key, i = q[i:j], j
+		}
+
+		if i >= len(q) || !strings.ContainsRune(":<>=", rune(q[i])) {
+			if !quoted {
+				// Not a filter: the rest of the word is free text.
+				for i < len(q) && !isQuerySpace(q[i]) {
+					i++
+				}
+				key = q[t.pos:i]
+				if t.negate {
+					key = key[1:]
+				}
+			}
+			t.value, t.phrase = key, quoted
+			terms = append(terms, t)
+			continue
+		}
+		if key == "" {
+			return nil, &QueryError{fmt.Sprintf("missing field name before %q", q[i]), i}
+		}
+
+		t.field, t.op = strings.ToLower(key), q[i:i+1]
+		i++
+		if (t.op == "<" || t.op == ">") && i < len(q) && q[i] == '=' {
+			t.op += "="
+			i++
+		}
+		if i < len(q) && q[i] == '"' {
+			value, next, err := readQuoted(q, i)
+			if err != nil {
+				return nil, err
+			}
+			t.value, t.phrase, i = value, true, next
+		} else {
+			j := i
+			for j < len(q) && !isQuerySpace(q[j]) {
+				j++
+			}
+			t.value, i = q[i:j], j
+		}
+		if strings.TrimSpace(t.value) == "" {
+			return nil, &QueryError{fmt.Sprintf("missing value after %s%s", key, t.op), t.pos}
+		}
+		terms = append(terms, t)
+	}
+	return terms, nil
+}
+
+func isQuerySpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// readQuoted reads the double quoted text starting at q[i] and returns it
+// with the offset just past the closing quote.
+func readQuoted(q string, i int) (string, int, error) {
+	end := strings.IndexByte(q[i+1:], '"')
+	if end < 0 {
+		return "", 0, &QueryError{"missing closing quote", i}
+	}
+	return q[i+1 : i+1+end], i + end + 2, nil
+}
+
+// compiledQuery is a search query turned into SQL: a full-text match for the
+// free text, empty when there is none, and conditions on products.
+type compiledQuery struct {
+	match      string
+	conditions []string
+	args       []interface{}
+}
+
+// compileSearchQuery parses q and turns it into parameterised SQL. Every term
+// must hold: free words match as word prefixes in the full-text index,
+// quoted phrases match as they are, and filters compare a field.
+func compileSearchQuery(q string) (compiledQuery, error) {
+	var c compiledQuery
+	terms, err := parseSearchQuery(q)
+	if err != nil {
+		return c, err
+	}
+
+	var match []string
+	for _, t := range terms {
+		if t.field == "" {
+			text := ftsText(t.value, t.phrase)
+			if text == "" {
+				continue
+			}
+			if t.negate {
+				c.conditions = append(c.conditions, "id NOT IN (SELECT rowid FROM product_search WHERE product_search MATCH ?)")
+				c.args = append(c.args, text)
+			} else {
+				match = append(match, text)
+			}
+			continue
+		}
+
+		condition, args, err := compileFilter(t)
+		if err != nil {
+			return c, err
+		}
+		if t.negate {
+			condition = "NOT IFNULL(" + condition + ", 0)"
+		}
+		c.conditions = append(c.conditions, condition)
+		c.args = append(c.args, args...)
+	}
+	c.match = strings.Join(match, " ")
+
+	if c.match == "" && len(c.conditions) == 0 && strings.TrimSpace(q) != "" {
+		// Nothing searchable was typed, such as only punctuation.
+		c.conditions = append(c.conditions, "0")
+	}
+	return c, nil
+}
+
+// ftsText turns free text into an FTS5 query. Words are split the way the
+// unicode61 tokenizer splits the indexed text, so "AB-12" finds part AB-1234;
+// each word matches as a prefix unless the text was a quoted phrase.
+func ftsText(text string, phrase bool) string {
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	if len(words) == 0 {
+		return ""
+	}
+	if phrase {
+		return `"` + strings.Join(words, " ") + `"`
+	}
+	for i, w := range words {
+		words[i] = `"` + w + `"*`
+	}
+	return strings.Join(words, " ")
+}
+
+// compileFilter turns a field filter into a condition on products.
+func compileFilter(t queryTerm) (string, []interface{}, error) {
+	fail := func(format string, args ...interface{}) (string, []interface{}, error) {
+		return "", nil, &QueryError{t.field + ": " + fmt.Sprintf(format, args...), t.pos}
+	}
+
+	f, ok := searchFields[t.field]
+	if !ok {
+		cf, err := findCustomFieldByName(strings.TrimPrefix(t.field, customFieldPrefix))
+		if err == sql.ErrNoRows {
+			return "", nil, &QueryError{fmt.Sprintf("unknown field %q", t.field), t.pos}
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		f = searchField{kind: cf.Type, column: cf.valueColumn()}
+		switch cf.Type {
+		case "select", "boolean":
+			value, err := cf.normalize(t.value)
+			if err != nil {
+				return fail("%v", err)
+			}
+			if t.op != ":" && t.op != "=" {
+				return fail("%s only matches a value, use %s:%s", t.op, t.field, t.value)
+			}
+			if cf.Type == "boolean" && value == "" {
+				return f.column + " IS NULL", nil, nil
+			}
+			return f.column + " = ?", []interface{}{value}, nil
+		}
+	}
+
+	switch f.kind {
+	case "text":
+		switch t.op {
+		case ":":
+			return f.column + ` LIKE ? ESCAPE '\'`, []interface{}{"%" + escapeLike(t.value) + "%"}, nil
+		case "=":
+			return f.column + " = ? COLLATE NOCASE", []interface{}{t.value}, nil
+		}
+		return fail("%s compares numbers and dates, use %s:%s to find text", t.op, t.field, t.value)
+
+	case "number", "money":
+		n, err := strconv.ParseFloat(t.value, 64)
+		if err != nil {
+			return fail("%q is not a number", t.value)
+		}
+		column := f.column
+		if f.kind == "money" {
+			column = moneyMajorUnits(f.column)
+		}
+		return column + " " + sqlComparison(t.op) + " ?", []interface{}{n}, nil
+
+	case "date":
+		d, err := time.Parse("2006-01-02", t.value)
+		if err != nil {
+			return fail("%q is not a date, use YYYY-MM-DD", t.value)
+		}
+		day := d.Format("2006-01-02")
+		switch t.op {
+		case "<":
+			return f.column + " < ?", []interface{}{day}, nil
+		case "<=":
+			return f.column + " < DATE(?, '+1 day')", []interface{}{day}, nil
+		case ">":
+			return f.column + " >= DATE(?, '+1 day')", []interface{}{day}, nil
+		case ">=":
+			return f.column + " >= ?", []interface{}{day}, nil
+		}
+		return "DATE(" + f.column + ") = ?", []interface{}{day}, nil
+
+	case "has":
+		category := strings.ToLower(t.value)
+		if alias, ok := hasAliases[category]; ok {
+			category = alias
+		}
+		if t.op != ":" || !isAttachmentCategory(category) {
+			return fail("use has:photos, has:drawings, has:cad, has:cnc or has:invoice")
+		}
+		return "EXISTS (SELECT 1 FROM attachments WHERE product_id = products.id AND category = ?)",
+			[]interface{}{category}, nil
+
+	case "tag":
+		if t.op != ":" && t.op != "=" {
+			return fail("%s only matches a value, use tag:%s", t.op, t.value)
+		}
+		return taggedFilter, []interface{}{t.value}, nil
+
+	case "category":
+		if t.op != ":" && t.op != "=" {
+			return fail("%s only matches a value, use category:%s", t.op, t.value)
+		}
+		return `category_id IN (
+			WITH RECURSIVE sub(id) AS (
+				SELECT id FROM categories WHERE name LIKE ? ESCAPE '\'
+				UNION SELECT c.id FROM categories c JOIN sub ON c.parent_id = sub.id
+			)
+			SELECT id FROM sub
+		)`, []interface{}{"%" + escapeLike(t.value) + "%"}, nil
+	}
+	return fail("cannot be searched")
+}
+
+// sqlComparison maps a query operator to SQL; : and = both test equality.
+func sqlComparison(op string) string {
+	if op == ":" {
+		return "="
+	}
+	return op
+}
+
+// moneyMajorUnits converts a minor unit column to whole currency units of
+// the product currency, so cost<12.50 means the same in every currency.
+func moneyMajorUnits(column string) string {
+	expr := "(" + column + " * 1.0 / CASE currency"
+	for _, c := range currencies {
+		if c.Decimals != 2 {
+			expr += fmt.Sprintf(" WHEN '%s' THEN %d", c.Code, pow10(c.Decimals))
+		}
+	}
+	return expr + " ELSE 100 END)"
+}
+
+func pow10(n int) int {
+	p := 1
+	for ; n > 0; n-- {
+		p *= 10
+	}
+	return p
+}
+
+// escapeLike escapes the LIKE wildcards in s, for use with ESCAPE '\'.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	for _, tc := range []struct {
+		q     string
+		terms []queryTerm
+	}{
+		{"", nil},
+		{"bracket AB-12", []queryTerm{
+			{pos: 0, value: "bracket"},
+			{pos: 8, value: "AB-12"},
+		}},
+		// Quoted phrases, as free text and as a filter value.
+		{`"mounting bracket" plate`, []queryTerm{
+			{pos: 0, value: "mounting bracket", phrase: true},
+			{pos: 19, value: "plate"},
+		}},
+		{`material:"6061 T6"`, []queryTerm{
+			{pos: 0, field: "material", op: ":", value: "6061 T6", phrase: true},
+		}},
+		// Negation, which a lone or trailing - does not start.
+		{`-bracket -"old stock" -tag:obsolete`, []queryTerm{
+			{pos: 0, negate: true, value: "bracket"},
+			{pos: 9, negate: true, value: "old stock", phrase: true},
+			{pos: 22, negate: true, field: "tag", op: ":", value: "obsolete"},
+		}},
+		{"a - b-", []queryTerm{
+			{pos: 0, value: "a"},
+			{pos: 2, value: "-"},
+			{pos: 4, value: "b-"},
+		}},
+		// has:, tag: and category:, with field names in any case.
+		{"has:photos Tag:urgent CATEGORY:Fasteners", []queryTerm{
+			{pos: 0, field: "has", op: ":", value: "photos"},
+			{pos: 11, field: "tag", op: ":", value: "urgent"},
+			{pos: 22, field: "category", op: ":", value: "Fasteners"},
+		}},
+		// Comparison operators on numbers and money.
+		{"qty<5 qty<=5 qty>5 qty>=5 qty=5 qty:5", []queryTerm{
+			{pos: 0, field: "qty", op: "<", value: "5"},
+			{pos: 6, field: "qty", op: "<=", value: "5"},
+			{pos: 13, field: "qty", op: ">", value: "5"},
+			{pos: 19, field: "qty", op: ">=", value: "5"},
+			{pos: 26, field: "qty", op: "=", value: "5"},
+			{pos: 32, field: "qty", op: ":", value: "5"},
+		}},
+		{"cost>=12.50 -materialcost<3", []queryTerm{
+			{pos: 0, field: "cost", op: ">=", value: "12.50"},
+			{pos: 12, negate: true, field: "materialcost", op: "<", value: "3"},
+		}},
+		// Only the first operator separates the field from the value.
+		{"size:50x120=x", []queryTerm{
+			{pos: 0, field: "size", op: ":", value: "50x120=x"},
+		}},
+	} {
+		terms, err := parseSearchQuery(tc.q)
+		if err != nil {
+			t.Errorf("parseSearchQuery(%q): %v", tc.q, err)
+			continue
+		}
+		if !reflect.DeepEqual(terms, tc.terms) {
+			t.Errorf("parseSearchQuery(%q) =\n%+v\nwant\n%+v", tc.q, terms, tc.terms)
+		}
+	}
+}
+
+func TestCompileFilter(t *testing.T) {
+	for _, tc := range []struct {
+		q         string
+		condition string
+		arg       interface{}
+	}{
+		{"qty<5", "qty < ?", 5.0},
+		{"qty<=5", "qty <= ?", 5.0},
+		{"qty>5", "qty > ?", 5.0},
+		{"qty>=5", "qty >= ?", 5.0},
+		{"qty=5", "qty = ?", 5.0},
+		{"qty:5", "qty = ?", 5.0},
+		{"cost<12.50", moneyMajorUnits("cost_minor") + " < ?", 12.5},
+		{"finishingcost:0", moneyMajorUnits("finishing_cost_minor") + " = ?", 0.0},
+		{"has:photo", "EXISTS (SELECT 1 FROM attachments WHERE product_id = products.id AND category = ?)", "photos"},
+		{"tag:urgent", taggedFilter, "urgent"},
+		{"material:60_1", `material LIKE ? ESCAPE '\'`, `%60\_1%`},
+		{"name=Bracket", "partName = ? COLLATE NOCASE", "Bracket"},
+	} {
+		terms, err := parseSearchQuery(tc.q)
+		if err != nil || len(terms) != 1 {
+			t.Fatalf("parseSearchQuery(%q) = %v, %v", tc.q, terms, err)
+		}
+		condition, args, err := compileFilter(terms[0])
+		if err != nil {
+			t.Errorf("compileFilter(%q): %v", tc.q, err)
+			continue
+		}
+		if condition != tc.condition || !reflect.DeepEqual(args, []interface{}{tc.arg}) {
+			t.Errorf("compileFilter(%q) = %q %v, want %q [%v]", tc.q, condition, args, tc.condition, tc.arg)
+		}
+	}
+
+	terms, _ := parseSearchQuery("category:Fas_teners")
+	condition, args, err := compileFilter(terms[0])
+	if err != nil || !strings.HasPrefix(condition, "category_id IN (") || !reflect.DeepEqual(args, []interface{}{`%Fas\_teners%`}) {
+		t.Errorf("compileFilter(category:Fas_teners) = %q %v, %v", condition, args, err)
+	}
+}
+
+// TestSearchQueryErrors checks that a query that cannot be understood points
+// at the term at fault.
+func TestSearchQueryErrors(t *testing.T) {
+	setupTestDB(t)
+	for _, tc := range []struct {
+		q        string
+		message  string
+		position int
+	}{
+		{`bracket "mounting plate`, "missing closing quote", 8},
+		{`bracket material:"6061`, "missing closing quote", 17},
+		{"bracket :5", `missing field name before ':'`, 8},
+		{"a >=5", `missing field name before '>'`, 2},
+		{"bracket qty<", "missing value after qty<", 8},
+		{`name:"  "`, `missing value after name:`, 0},
+		{"bracket colour:red", `unknown field "colour"`, 8},
+		{"bracket -Colour:red", `unknown field "colour"`, 8},
+		{"bracket qty>abc", `qty: "abc" is not a number`, 8},
+		{"a cost<=12,50", `cost: "12,50" is not a number`, 2},
+		{"a b created>last-week", `created: "last-week" is not a date, use YYYY-MM-DD`, 4},
+		{"has:video", "has: use has:photos, has:drawings, has:cad, has:cnc or has:invoice", 0},
+		{"x tag<urgent", "tag: < only matches a value, use tag:urgent", 2},
+		{"material>6061", "material: > compares numbers and dates, use material:6061 to find text", 0},
+	} {
+		_, err := compileSearchQuery(tc.q)
+		var qe *QueryError
+		if !errors.As(err, &qe) {
+			t.Errorf("compileSearchQuery(%q): %v, want a *QueryError", tc.q, err)
+			continue
+		}
+		if qe.Message != tc.message || qe.Position != tc.position {
+			t.Errorf("compileSearchQuery(%q): %q at %d, want %q at %d", tc.q, qe.Message, qe.Position, tc.message, tc.position)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// revisionCategories are the attachment categories that belong to a part
+// revision rather than to the product as a whole. Their files are stored
+// under uploads/<partNo>/<rev>/<category>/.
+var revisionCategories = []string{"drawings", "cad", "cnc"}
+
+func isRevisionCategory(category string) bool {
+	for _, c := range revisionCategories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// Revision is one revision (A, B, C…) of a part together with the drawing,
+// CAD and CNC files released for it.
+type Revision struct {
+	ID        int64      `json:"id"`
+	Rev       string     `json:"rev"`
+	Notes     string     `json:"notes,omitempty"`
+	IsCurrent bool       `json:"isCurrent"`
+	CreatedAt string     `json:"createdAt"`
+	Drawings  []FileInfo `json:"drawings,omitempty"`
+	Cad       []FileInfo `json:"cad,omitempty"`
+	Cnc       []FileInfo `json:"cnc,omitempty"`
+}
+
+func (r *Revision) addFile(f FileInfo) {
+	switch f.Category {
+	case "drawings":
+		r.Drawings = append(r.Drawings, f)
+	case "cad":
+		r.Cad = append(r.Cad, f)
+	case "cnc":
+		r.Cnc = append(r.Cnc, f)
+	}
+}
+
+// loadRevisions fills in the revision history of every product in the slice,
+// oldest first, and sets CurrentRevision.
+func loadRevisions(products []Product) error {
+	index := make(map[int]int, len(products))
+	placeholders := make([]string, len(products))
+	args := make([]interface{}, len(products))
+	for i, p := range products {
+		index[p.ID] = i
+		placeholders[i] = "?"
+		args[i] = p.ID
+		products[i].Revisions = nil
+	}
+
+	rows, err := db.Query(`
+		SELECT id, product_id, rev, notes, is_current, created_at
+		FROM revisions WHERE product_id IN (`+strings.Join(placeholders, ",")+`)
+		ORDER BY id`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rev Revision
+		var productID int
+		var notes sql.NullString
+		if err := rows.Scan(&rev.ID, &productID, &rev.Rev, &notes, &rev.IsCurrent, &rev.CreatedAt); err != nil {
+			return err
+		}
+		rev.Notes = notes.String
+		i, ok := index[productID]
+		if !ok {
+			continue
+		}
+		products[i].Revisions = append(products[i].Revisions, rev)
+		if rev.IsCurrent {
+			products[i].CurrentRevision = rev.Rev
+			products[i].CurrentRevisionID = rev.ID
+		}
+	}
+	return rows.Err()
+}
+
+// validateRevisionLabel checks a user supplied revision label. Labels become
+// folder names, so they are kept short and must not clash with the attachment
+// category folders.
+func validateRevisionLabel(rev string) error {
+	if rev == "" {
+		return fmt.Errorf("revision label is required")
+	}
+	if len(rev) > 10 {
+		return fmt.Errorf("revision label %q is longer than 10 characters", rev)
+	}
+	for _, r := range rev {
+		if !(r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '.') {
+			return fmt.Errorf("revision label %q may only contain letters, digits, '-' and '.'", rev)
+		}
+	}
+	if isAttachmentCategory(sanitizeFilename(rev)) {
+		return fmt.Errorf("revision label %q is reserved", rev)
+	}
+	return nil
+}
+
+// nextRevisionLabel suggests the label following rev: A becomes B, Z becomes
+// AA and numeric labels are incremented.
+func nextRevisionLabel(rev string) string {
+	if rev == "" {
+		return "A"
+	}
+	b := []byte(strings.ToUpper(rev))
+	for i := len(b) - 1; i >= 0; i-- {
+		switch {
+		case b[i] == 'Z':
+			b[i] = 'A'
+		case b[i] == '9':
+			b[i] = '0'
+		case b[i] >= 'A' && b[i] < 'Z' || b[i] >= '0' && b[i] < '9':
+			b[i]++
+			return string(b)
+		default:
+			return string(b) + "-1"
+		}
+	}
+	if b[0] == '0' {
+		return "1" + string(b)
+	}
+	return "A" + string(b)
+}
+
+// checkRevisionFolder rejects a new revision label whose folder would be the
+// folder of an existing revision of the product. Folder names ignore case and
+// dots, so A and a, or A.1 and A1, would otherwise share their files.
+func checkRevisionFolder(q rowQuerier, productID int, rev string) error {
+	var existing string
+	err := q.QueryRow("SELECT rev FROM revisions WHERE product_id = ? AND LOWER(REPLACE(rev, '.', '')) = ?",
+		productID, sanitizeFilename(rev)).Scan(&existing)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		return err
+	case existing == rev:
+		return fmt.Errorf("revision %s already exists", rev)
+	}
+	return fmt.Errorf("revision %s would share the folder of revision %s", rev, existing)
+}
+
+// revisionDir is the upload sub folder, relative to the part folder, holding
+// the files of category for the given revision.
+func revisionDir(rev, category string) string {
+	return path.Join(sanitizeFilename(rev), category)
+}
+
+// createRevision adds a revision to a product and makes it the current one.
+func createRevision(tx *sql.Tx, productID int, rev, notes string) (int64, error) {
+	if err := checkRevisionFolder(tx, productID, rev); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("UPDATE revisions SET is_current = 0 WHERE product_id = ?", productID); err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(`INSERT INTO revisions(product_id, rev, notes, is_current) VALUES(?, ?, ?, 1)`,
+		productID, rev, notes)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			return 0, fmt.Errorf("revision %s already exists", rev)
+		}
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// currentRevision returns the id and label of the current revision of a
+// product, creating revision A for products that have none yet.
+func currentRevision(tx *sql.Tx, productID int) (int64, string, error) {
+	var id int64
+	var rev string
+	err := tx.QueryRow("SELECT id, rev FROM revisions WHERE product_id = ? AND is_current = 1", productID).Scan(&id, &rev)
+	if err == sql.ErrNoRows {
+		id, err = createRevision(tx, productID, "A", "")
+		return id, "A", err
+	}
+	return id, rev, err
+}
+
+func setCurrentRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		ProductID  int   `json:"productId"`
+		RevisionID int64 `json:"revisionId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	before := auditSnapshot(request.ProductID)
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var rev string
+	err = tx.QueryRow("SELECT rev FROM revisions WHERE id = ? AND product_id = ?",
+		request.RevisionID, request.ProductID).Scan(&rev)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE revisions SET is_current = 0 WHERE product_id = ?", request.ProductID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("UPDATE revisions SET is_current = 1 WHERE id = ?", request.RevisionID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	auditProductChange(request.ProductID, "update", before)
+	log.Printf("Product %d: revision %s is now current", request.ProductID, rev)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "success",
+		"message": "Revision " + rev + " is now current",
+	})
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestRevisionFolderClash checks that a revision label is rejected when its
+// upload folder would be the folder of another revision of the product.
+func TestRevisionFolderClash(t *testing.T) {
+	setupTestDB(t)
+	if w := serve(http.MethodPost, "/api/products", "application/json", strings.NewReader(`{"partNo": "P-1", "revision": "A.1"}`)); w.Code != http.StatusCreated {
+		t.Fatalf("creating product: %d %s", w.Code, w.Body)
+	}
+
+	for _, tc := range []struct {
+		rev, problem string
+	}{
+		{"a1", "revision a1 would share the folder of revision A.1"},
+		{"A1", "revision A1 would share the folder of revision A.1"},
+		{"a.1", "revision a.1 would share the folder of revision A.1"},
+		{"B", ""},
+		{"b", "revision b would share the folder of revision B"},
+	} {
+		w := serve(http.MethodPatch, "/api/products/P-1", "application/json", strings.NewReader(`{"revision": "`+tc.rev+`"}`))
+		if tc.problem == "" {
+			if w.Code != http.StatusOK {
+				t.Errorf("revision %s: %d %s", tc.rev, w.Code, w.Body)
+			}
+			continue
+		}
+		var reply struct {
+			Errors map[string]string `json:"errors"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil || reply.Errors["revision"] != tc.problem {
+			t.Errorf("revision %s: %d %s, want %q", tc.rev, w.Code, w.Body, tc.problem)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	var productID int
+	if err := tx.QueryRow("SELECT id FROM products WHERE partNo = 'P-1'").Scan(&productID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createRevision(tx, productID, "B", ""); err == nil || err.Error() != "revision B already exists" {
+		t.Errorf("createRevision(B): %v", err)
+	}
+	if _, err := createRevision(tx, productID, "a-1", ""); err != nil {
+		t.Errorf("createRevision(a-1): %v", err)
+	}
+}
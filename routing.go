@@ -0,0 +1,384 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// WorkCenter is a machine or station operations are carried out at, with its
+// hourly rate.
+type WorkCenter struct {
+	ID       int64  `json:"id"`
+	Code     string `json:"code"`
+	Name     string `json:"name,omitempty"`
+	Rate     Amount `json:"rateMinor"`
+	Currency string `json:"currency"`
+}
+
+// Operation is one step of a part's routing, e.g. "op 20, mill the second
+// side". Times are in minutes; the setup is done once per batch and the cycle
+// once per part. CNCProgramID links one of the part's CNC attachments.
+type Operation struct {
+	ID           int64   `json:"id"`
+	ProductID    int     `json:"productId"`
+	OpNo         int     `json:"opNo"`
+	WorkCenterID int64   `json:"workCenterId"`
+	WorkCenter   string  `json:"workCenter"`
+	Rate         Amount  `json:"rateMinor"`
+	Currency     string  `json:"currency"`
+	Description  string  `json:"description,omitempty"`
+	SetupMinutes float64 `json:"setupMinutes"`
+	CycleMinutes float64 `json:"cycleMinutes"`
+	CNCProgramID int64   `json:"cncProgramId,omitempty"`
+	CNCProgram   string  `json:"cncProgram,omitempty"`
+	CNCPath      string  `json:"-"`
+}
+
+// minutesCost prices minutes at the work center's hourly rate.
+func (o Operation) minutesCost(minutes float64) Amount {
+	if !o.Rate.Valid {
+		return Amount{}
+	}
+	return Amount{Minor: int64(math.Round(minutes / 60 * float64(o.Rate.Minor))), Valid: true}
+}
+
+// SetupCost is the cost of setting up the operation once.
+func (o Operation) SetupCost() Amount {
+	return o.minutesCost(o.SetupMinutes)
+}
+
+// CycleCost is the cost of running the operation on one part.
+func (o Operation) CycleCost() Amount {
+	return o.minutesCost(o.CycleMinutes)
+}
+
+func loadWorkCenters() ([]WorkCenter, error) {
+	rows, err := db.Query("SELECT id, code, IFNULL(name, ''), rate_minor, currency FROM work_centers ORDER BY code")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var centers []WorkCenter
+	for rows.Next() {
+		var c WorkCenter
+		if err := rows.Scan(&c.ID, &c.Code, &c.Name, &c.Rate, &c.Currency); err != nil {
+			return nil, err
+		}
+		centers = append(centers, c)
+	}
+	return centers, rows.Err()
+}
+
+// saveWorkCenter inserts c, or updates it when c.ID is set and recalculates
+// the unit cost of the products routed through it.
+func saveWorkCenter(c WorkCenter) error {
+	if c.Code == "" {
+		return fmt.Errorf("Code: work center code is required")
+	}
+	var err error
+	if c.ID == 0 {
+		_, err = db.Exec("INSERT INTO work_centers(code, name, rate_minor, currency) VALUES(?, ?, ?, ?)",
+			c.Code, c.Name, c.Rate, c.Currency)
+	} else {
+		var res sql.Result
+		res, err = db.Exec("UPDATE work_centers SET code = ?, name = ?, rate_minor = ?, currency = ? WHERE id = ?",
+			c.Code, c.Name, c.Rate, c.Currency, c.ID)
+		if err == nil {
+			if n, _ := res.RowsAffected(); n == 0 {
+				return fmt.Errorf("work center %d does not exist", c.ID)
+			}
+		}
+	}
+	if err != nil && strings.Contains(err.Error(), "UNIQUE") {
+		return fmt.Errorf("Code: work center %s already exists", c.Code)
+	}
+	if err != nil {
+		return err
+	}
+	if c.ID != 0 {
+		if _, err := recalculateCostsWhere("id IN (SELECT product_id FROM routing_operations WHERE work_center_id = ?)", c.ID); err != nil {
+			log.Printf("Error costing the products routed through %s: %v", c.Code, err)
+		}
+	}
+	return nil
+}
+
+// loadRouting returns the operations of a product in operation number order.
+func loadRouting(productID int) ([]Operation, error) {
+	rows, err := db.Query(`
+		SELECT o.id, o.product_id, o.op_no, o.work_center_id, wc.code, wc.rate_minor, wc.currency,
+			   IFNULL(o.description, ''), o.setup_minutes, o.cycle_minutes,
+			   o.cnc_attachment_id, IFNULL(a.name, ''), IFNULL(a.path, '')
+		FROM routing_operations o
+		JOIN work_centers wc ON wc.id = o.work_center_id
+		LEFT JOIN attachments a ON a.id = o.cnc_attachment_id
+		WHERE o.product_id = ?
+		ORDER BY o.op_no`, productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ops []Operation
+	for rows.Next() {
+		var o Operation
+		var cncID sql.NullInt64
+		if err := rows.Scan(&o.ID, &o.ProductID, &o.OpNo, &o.WorkCenterID, &o.WorkCenter, &o.Rate, &o.Currency,
+			&o.Description, &o.SetupMinutes, &o.CycleMinutes, &cncID, &o.CNCProgram, &o.CNCPath); err != nil {
+			return nil, err
+		}
+		o.CNCProgramID = cncID.Int64
+		ops = append(ops, o)
+	}
+	return ops, rows.Err()
+}
+
+// workCentersHandler lists the work centers (GET) and adds one, or updates
+// the one named by the id field, from the form on the same page (POST).
+func workCentersHandler(w http.ResponseWriter, r *http.Request) {
+	var formError string
+	if r.Method == http.MethodPost {
+		c := WorkCenter{
+			ID:       parseOptionalID(r.FormValue("id")).Int64,
+			Code:     strings.TrimSpace(r.FormValue("code")),
+			Name:     strings.TrimSpace(r.FormValue("name")),
+			Currency: strings.ToUpper(strings.TrimSpace(r.FormValue("currency"))),
+		}
+		if c.Currency == "" {
+			c.Currency = defaultCurrency
+		}
+		var err error
+		if !isCurrency(c.Currency) {
+			err = fmt.Errorf("Currency: %q is not supported", c.Currency)
+		} else if c.Rate, err = parseAmount(r.FormValue("rate"), c.Currency); err != nil {
+			err = fmt.Errorf("Hourly Rate: %v", err)
+		} else {
+			err = saveWorkCenter(c)
+		}
+		if err == nil {
+			http.Redirect(w, r, "/work-centers", http.StatusSeeOther)
+			return
+		}
+		formError = err.Error()
+		w.WriteHeader(http.StatusBadRequest)
+	}
+
+	centers, err := loadWorkCenters()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tmpl := template.Must(template.New("work_centers.html").Funcs(funcMap).ParseFiles("templates/work_centers.html"))
+	err = tmpl.Execute(w, struct {
+		WorkCenters []WorkCenter
+		Error       string
+	}{centers, formError})
+	if err != nil {
+		log.Printf("Error rendering work centers: %v", err)
+	}
+}
+
+// routingAddHandler adds an operation to a product's routing, or replaces the
+// operation with the same number.
+func routingAddHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		ProductID    int     `json:"productId"`
+		OpNo         int     `json:"opNo"`
+		WorkCenterID int64   `json:"workCenterId"`
+		Description  string  `json:"description"`
+		SetupMinutes float64 `json:"setupMinutes"`
+		CycleMinutes float64 `json:"cycleMinutes"`
+		CNCProgramID int64   `json:"cncProgramId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.OpNo <= 0 {
+		http.Error(w, "Operation number must be greater than zero", http.StatusBadRequest)
+		return
+	}
+	if request.SetupMinutes < 0 || request.CycleMinutes < 0 {
+		http.Error(w, "Setup and cycle times must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	var productExists, centerExists bool
+	err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM products WHERE id = ?),
+		EXISTS(SELECT 1 FROM work_centers WHERE id = ?)`,
+		request.ProductID, request.WorkCenterID).Scan(&productExists, &centerExists)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !productExists {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+	if !centerExists {
+		http.Error(w, "Work center not found", http.StatusNotFound)
+		return
+	}
+
+	cncID := sql.NullInt64{Int64: request.CNCProgramID, Valid: request.CNCProgramID != 0}
+	if cncID.Valid {
+		var isProgram bool
+		err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM attachments WHERE id = ? AND product_id = ? AND category = 'cnc')",
+			request.CNCProgramID, request.ProductID).Scan(&isProgram)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !isProgram {
+			http.Error(w, "CNC program must be one of the part's CNC files", http.StatusBadRequest)
+			return
+		}
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO routing_operations(product_id, op_no, work_center_id, description, setup_minutes, cycle_minutes, cnc_attachment_id)
+		VALUES(?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(product_id, op_no) DO UPDATE SET
+			work_center_id = excluded.work_center_id, description = excluded.description,
+			setup_minutes = excluded.setup_minutes, cycle_minutes = excluded.cycle_minutes,
+			cnc_attachment_id = excluded.cnc_attachment_id`,
+		request.ProductID, request.OpNo, request.WorkCenterID, strings.TrimSpace(request.Description),
+		request.SetupMinutes, request.CycleMinutes, cncID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Routing: product %d op %d at work center %d", request.ProductID, request.OpNo, request.WorkCenterID)
+	if _, err := recalculateCostsWithParents(request.ProductID); err != nil {
+		log.Printf("Error costing product %d: %v", request.ProductID, err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "success",
+		"message": "Operation saved",
+	})
+}
+
+func routingRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		ProductID int `json:"productId"`
+		OpNo      int `json:"opNo"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM routing_operations WHERE product_id = ? AND op_no = ?", request.ProductID, request.OpNo)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Operation not found", http.StatusNotFound)
+		return
+	}
+	if _, err := recalculateCostsWithParents(request.ProductID); err != nil {
+		log.Printf("Error costing product %d: %v", request.ProductID, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "success",
+		"message": "Operation removed",
+	})
+}
+
+// writeRoutingSheet adds a "Routing" sheet listing the operations of every
+// product that has a routing.
+func writeRoutingSheet(f *excelize.File, headerStyle int) error {
+	sheetName := "Routing"
+	if _, err := f.NewSheet(sheetName); err != nil {
+		return err
+	}
+
+	headers := []string{"PartNo", "Part Name", "Op", "Work Center", "Description", "Setup (min)", "Cycle (min)",
+		"Hourly Rate", "Currency", "Setup Cost", "Cycle Cost", "CNC Program"}
+	for i, header := range headers {
+		cell := fmt.Sprintf("%c1", 'A'+i)
+		f.SetCellValue(sheetName, cell, header)
+		f.SetCellStyle(sheetName, cell, cell, headerStyle)
+	}
+
+	rows, err := db.Query(`
+		SELECT id, partNo, partName FROM products
+		WHERE id IN (SELECT product_id FROM routing_operations) ORDER BY partNo`)
+	if err != nil {
+		return err
+	}
+	type routedPart struct {
+		id       int
+		partNo   string
+		partName sql.NullString
+	}
+	var parts []routedPart
+	for rows.Next() {
+		var p routedPart
+		if err := rows.Scan(&p.id, &p.partNo, &p.partName); err != nil {
+			rows.Close()
+			return err
+		}
+		parts = append(parts, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rowNum := 2
+	for _, p := range parts {
+		ops, err := loadRouting(p.id)
+		if err != nil {
+			return err
+		}
+		for _, o := range ops {
+			f.SetCellValue(sheetName, fmt.Sprintf("A%d", rowNum), p.partNo)
+			f.SetCellValue(sheetName, fmt.Sprintf("B%d", rowNum), p.partName.String)
+			f.SetCellValue(sheetName, fmt.Sprintf("C%d", rowNum), o.OpNo)
+			f.SetCellValue(sheetName, fmt.Sprintf("D%d", rowNum), o.WorkCenter)
+			f.SetCellValue(sheetName, fmt.Sprintf("E%d", rowNum), o.Description)
+			f.SetCellValue(sheetName, fmt.Sprintf("F%d", rowNum), o.SetupMinutes)
+			f.SetCellValue(sheetName, fmt.Sprintf("G%d", rowNum), o.CycleMinutes)
+			f.SetCellValue(sheetName, fmt.Sprintf("H%d", rowNum), formatAmount(o.Rate, o.Currency))
+			f.SetCellValue(sheetName, fmt.Sprintf("I%d", rowNum), o.Currency)
+			f.SetCellValue(sheetName, fmt.Sprintf("J%d", rowNum), formatAmount(o.SetupCost(), o.Currency))
+			f.SetCellValue(sheetName, fmt.Sprintf("K%d", rowNum), formatAmount(o.CycleCost(), o.Currency))
+			f.SetCellValue(sheetName, fmt.Sprintf("L%d", rowNum), o.CNCProgram)
+			rowNum++
+		}
+	}
+
+	f.SetColWidth(sheetName, "A", "A", 18)
+	f.SetColWidth(sheetName, "B", "B", 30)
+	f.SetColWidth(sheetName, "D", "D", 14)
+	f.SetColWidth(sheetName, "E", "E", 30)
+	f.SetColWidth(sheetName, "F", "K", 12)
+	f.SetColWidth(sheetName, "L", "L", 25)
+	return nil
+}
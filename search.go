@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"net/url"
+	"strings"
+)
+
+// Pages of the product list hold defaultProductPageSize products unless a
+// limit or a saved view asks for another size, up to maxProductPageSize.
+const (
+	defaultProductPageSize = 100
+	maxProductPageSize     = 1000
+)
+
+// Matched terms are wrapped in these markers by the full-text index and
+// turned into <mark> tags once the rest of the snippet has been escaped.
+const (
+	snippetStart = "\x02"
+	snippetEnd   = "\x03"
+)
+
+// productMatchesCTE runs the full-text query, bound to the first argument,
+// ranking matches with the column weights set in createProductSearch.
+const productMatchesCTE = `WITH matches AS (
+	SELECT rowid AS product_id, rank AS score,
+	       snippet(product_search, -1, char(2), char(3), '…', 12) AS snippet
+	FROM product_search WHERE product_search MATCH ?
+) `
+
+// productListing is a product list request, shared by the product list, the
+// search page, the export and /api/products: an optional full-text query,
+// filters, facet filters and a sort order.
+type productListing struct {
+	Query     string
+	Category  sql.NullInt64
+	SortBy    string
+	SortOrder string
+
+	params     url.Values
+	match      string
+	conditions []string
+	args       []interface{}
+	filters    []facetFilter
+	ranges     Facets
+	sortColumn string
+}
+
+// parseProductListing reads q, category, tag, location, field.<name>, the
+// facet parameters read by parseFacetFilters, sort and order. A malformed q
+// is reported as a *QueryError. Without a sort, a search is ordered by
+// relevance and anything else by last update.
+func parseProductListing(params url.Values) (productListing, error) {
+	l := productListing{
+		Query:     params.Get("q"),
+		Category:  parseOptionalID(params.Get("category")),
+		SortBy:    params.Get("sort"),
+		SortOrder: params.Get("order"),
+		params:    params,
+	}
+
+	compiled, err := compileSearchQuery(l.Query)
+	if err != nil {
+		return l, err
+	}
+	l.match = compiled.match
+	l.conditions = append(l.conditions, compiled.conditions...)
+	l.args = append(l.args, compiled.args...)
+
+	fieldConditions, fieldArgs, err := customFieldFilters(params)
+	if err != nil {
+		return l, err
+	}
+	l.conditions = append(l.conditions, fieldConditions...)
+	l.args = append(l.args, fieldArgs...)
+	if l.Category.Valid {
+		l.conditions = append(l.conditions, inCategoryFilter)
+		l.args = append(l.args, l.Category.Int64)
+	}
+	for _, tag := range params["tag"] {
+		l.conditions = append(l.conditions, taggedFilter)
+		l.args = append(l.args, strings.TrimSpace(tag))
+	}
+	if location := params.Get("location"); location != "" {
+		locationID, err := findLocation(db, location)
+		if err == sql.ErrNoRows {
+			return l, fmt.Errorf("Unknown location %s", location)
+		}
+		if err != nil {
+			return l, fmt.Errorf("Error finding location: %v", err)
+		}
+		l.conditions = append(l.conditions, stockAtLocationFilter)
+		l.args = append(l.args, locationID)
+	}
+	if l.filters, l.ranges, err = parseFacetFilters(params); err != nil {
+		return l, err
+	}
+
+	if l.SortBy == "" {
+		l.SortBy, l.SortOrder = "updated_at", "DESC"
+		if l.match != "" {
+			l.SortBy = "relevance"
+		}
+	}
+	var ok bool
+	if l.SortBy == "relevance" && l.match != "" {
+		// Best match first, whichever order was asked for.
+		l.sortColumn, l.SortOrder, ok = "matches.score", "ASC", true
+	} else if l.sortColumn, ok = productSortColumns[l.SortBy]; !ok {
+		l.sortColumn, ok = customFieldSortColumn(l.SortBy)
+	}
+	if !ok {
+		l.SortBy = "updated_at"
+		l.sortColumn = productSortColumns[l.SortBy]
+	}
+	if l.SortOrder != "ASC" && l.SortOrder != "DESC" {
+		l.SortOrder = "DESC"
+	}
+	return l, nil
+}
+
+// source returns the start of a query over the listing up to its WHERE
+// clause, selecting columns, and the arguments it binds.
+func (l productListing) source(columns string) (string, []interface{}) {
+	if l.match == "" {
+		return "SELECT " + columns + " FROM products", nil
+	}
+	return productMatchesCTE + "SELECT " + columns + " FROM products JOIN matches ON matches.product_id = products.id",
+		[]interface{}{l.match}
+}
+
+// filter returns the WHERE clause of the listing and the arguments it binds,
+// leaving out the filters of the facet named by except, if any, and adding
+// the extra conditions.
+func (l productListing) filter(except string, extra ...string) (string, []interface{}) {
+	conditions := append([]string{}, l.conditions...)
+	args := append([]interface{}{}, l.args...)
+	for _, f := range l.filters {
+		if f.facet != except {
+			conditions = append(conditions, f.condition)
+			args = append(args, f.args...)
+		}
+	}
+	conditions = append(conditions, extra...)
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// count returns how many products the listing matches.
+func (l productListing) count() (int, error) {
+	query, args := l.source("COUNT(*)")
+	where, whereArgs := l.filter("")
+	var n int
+	err := db.QueryRow(query+where, append(args, whereArgs...)...).Scan(&n)
+	return n, err
+}
+
+// extraScanner reads the columns selected after productColumns.
+type extraScanner struct {
+	rows  *sql.Rows
+	extra []any
+}
+
+func (s extraScanner) Scan(dest ...any) error {
+	return s.rows.Scan(append(dest, s.extra...)...)
+}
+
+// errInvalidCursor is returned by load for a cursor it did not hand out or
+// one made for another sort order.
+var errInvalidCursor = errors.New("invalid cursor")
+
+// productCursor is the position after the last product of a page: the value
+// it was sorted on and its id, which breaks ties. Pages read after a cursor
+// neither skip nor repeat products when others are added or removed.
+type productCursor struct {
+	Sort  string      `json:"s"`
+	Order string      `json:"o"`
+	Value interface{} `json:"v"`
+	ID    int64       `json:"id"`
+}
+
+func (c productCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeProductCursor(s string) (productCursor, error) {
+	var c productCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, errInvalidCursor
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(&c); err != nil {
+		return c, errInvalidCursor
+	}
+	if n, ok := c.Value.(json.Number); ok {
+		if i, err := n.Int64(); err == nil {
+			c.Value = i
+		} else if c.Value, err = n.Float64(); err != nil {
+			return c, errInvalidCursor
+		}
+	}
+	return c, nil
+}
+
+// orderBy is the ORDER BY clause of the listing, ordering ties by id.
+func (l productListing) orderBy() string {
+	return " ORDER BY " + l.sortColumn + " " + l.SortOrder + ", products.id " + l.SortOrder
+}
+
+// after returns the condition selecting the products that follow the cursor
+// in the listing's order. SQLite sorts NULL before any value, so NULL sort
+// values come first in ascending order and last in descending order.
+func (l productListing) after(c productCursor) (string, []interface{}) {
+	col := "(" + l.sortColumn + ")"
+	if l.SortOrder == "ASC" {
+		if c.Value == nil {
+			return "((" + col + " IS NULL AND products.id > ?) OR " + col + " IS NOT NULL)", []interface{}{c.ID}
+		}
+		return "(" + col + " > ? OR (" + col + " = ? AND products.id > ?))", []interface{}{c.Value, c.Value, c.ID}
+	}
+	if c.Value == nil {
+		return "(" + col + " IS NULL AND products.id < ?)", []interface{}{c.ID}
+	}
+	return "(" + col + " < ? OR (" + col + " = ? AND products.id < ?) OR " + col + " IS NULL)", []interface{}{c.Value, c.Value, c.ID}
+}
+
+// load returns a page of up to limit products of the listing, read after
+// the cursor if one is given and after skipping offset products otherwise,
+// with the cursor of the next page, empty on the last page. Products found
+// by a search carry a snippet of the text that matched.
+func (l productListing) load(limit, offset int, cursor string) ([]Product, string, error) {
+	snippet := "''"
+	if l.match != "" {
+		snippet = "matches.snippet"
+	}
+	// The unary + keeps the sort value as stored: without it, the driver
+	// would turn DATETIME columns into times that no longer compare equal.
+	query, args := l.source(productColumns + ", " + snippet + ", +(" + l.sortColumn + ")")
+	where, whereArgs := l.filter("")
+	args = append(args, whereArgs...)
+	if cursor != "" {
+		c, err := decodeProductCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		if c.Sort != l.SortBy || c.Order != l.SortOrder {
+			return nil, "", fmt.Errorf("%w: it was made for another sort order", errInvalidCursor)
+		}
+		condition, afterArgs := l.after(c)
+		if where == "" {
+			where = " WHERE " + condition
+		} else {
+			where += " AND " + condition
+		}
+		args = append(args, afterArgs...)
+		offset = 0
+	}
+	// One more product than asked for tells whether there is a next page.
+	args = append(args, limit+1, offset)
+	rows, err := db.Query(query+where+l.orderBy()+" LIMIT ? OFFSET ?", args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var products []Product
+	var next string
+	var lastValue interface{}
+	for rows.Next() {
+		var p Product
+		var snippet string
+		var sortValue interface{}
+		if err := scanProduct(extraScanner{rows, []any{&snippet, &sortValue}}, &p); err != nil {
+			return nil, "", err
+		}
+		if len(products) == limit {
+			last := products[len(products)-1]
+			next = productCursor{l.SortBy, l.SortOrder, lastValue, int64(last.ID)}.encode()
+			break
+		}
+		if b, ok := sortValue.([]byte); ok {
+			sortValue = string(b)
+		}
+		lastValue = sortValue
+		p.Snippet = highlightSnippet(snippet)
+		products = append(products, p)
+	}
+	return products, next, rows.Err()
+}
+
+// highlightSnippet escapes a snippet from the full-text index and marks the
+// matched terms.
+func highlightSnippet(s string) template.HTML {
+	s = html.EscapeString(s)
+	return template.HTML(strings.NewReplacer(snippetStart, "<mark>", snippetEnd, "</mark>").Replace(s))
+}
+
+// productSearchRefresh rebuilds the full-text entries of the products
+// selected by the condition on products. It is used by the triggers that
+// keep product_search in sync, so changing it needs a new migration.
+func productSearchRefresh(condition string) string {
+	return `
+		DELETE FROM product_search WHERE rowid IN (SELECT id FROM products WHERE ` + condition + `);
+		INSERT INTO product_search(rowid, part_no, part_name, description, material, material_size,
+			finishing_type, tags, fields, files)
+		SELECT id, partNo, partName, description, material, material_size, finishing_type,
+			(SELECT group_concat(t.name, ' ') FROM product_tags pt JOIN tags t ON t.id = pt.tag_id
+			 WHERE pt.product_id = products.id),
+			(SELECT group_concat(value, ' ') FROM product_field_values WHERE product_id = products.id),
+			(SELECT group_concat(name, ' ') FROM attachments WHERE product_id = products.id)
+		FROM products WHERE ` + condition + `;`
+}
+
+// createProductSearch adds the product_search full-text index over the text
+// of each product, its tags, custom field values and attachment names, and
+// the triggers keeping it up to date.
+func createProductSearch(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE VIRTUAL TABLE product_search USING fts5(
+			part_no, part_name, description, material, material_size,
+			finishing_type, tags, fields, files,
+			tokenize = 'unicode61 remove_diacritics 2', prefix = '2 3'
+		)`)
+	if err != nil && strings.Contains(err.Error(), "no such module") {
+		return fmt.Errorf("%v: SQLite was built without FTS5, build with make or go build -tags sqlite_fts5", err)
+	}
+	if err != nil {
+		return err
+	}
+
+	refresh := productSearchRefresh
+	_, err = tx.Exec(`
+		INSERT INTO product_search(product_search, rank) VALUES('rank', 'bm25(10.0, 5.0, 2.0, 2.0, 1.0, 2.0, 3.0, 1.0, 1.0)');
+		` + refresh("1") + `
+
+		CREATE TRIGGER product_search_insert AFTER INSERT ON products BEGIN` + refresh("id = NEW.id") + ` END;
+		CREATE TRIGGER product_search_update
+		AFTER UPDATE OF partNo, partName, description, material, material_size, finishing_type ON products
+		BEGIN` + refresh("id = NEW.id") + ` END;
+		CREATE TRIGGER product_search_delete AFTER DELETE ON products BEGIN
+			DELETE FROM product_search WHERE rowid = OLD.id;
+		END;
+
+		CREATE TRIGGER product_search_attachment_insert AFTER INSERT ON attachments
+		BEGIN` + refresh("id = NEW.product_id") + ` END;
+		CREATE TRIGGER product_search_attachment_update AFTER UPDATE OF name ON attachments
+		BEGIN` + refresh("id = NEW.product_id") + ` END;
+		CREATE TRIGGER product_search_attachment_delete AFTER DELETE ON attachments
+		BEGIN` + refresh("id = OLD.product_id") + ` END;
+
+		CREATE TRIGGER product_search_tag_insert AFTER INSERT ON product_tags
+		BEGIN` + refresh("id = NEW.product_id") + ` END;
+		CREATE TRIGGER product_search_tag_delete AFTER DELETE ON product_tags
+		BEGIN` + refresh("id = OLD.product_id") + ` END;
+		CREATE TRIGGER product_search_tag_rename AFTER UPDATE OF name ON tags
+		BEGIN` + refresh("id IN (SELECT product_id FROM product_tags WHERE tag_id = NEW.id)") + ` END;
+
+		CREATE TRIGGER product_search_field_insert AFTER INSERT ON product_field_values
+		BEGIN` + refresh("id = NEW.product_id") + ` END;
+		CREATE TRIGGER product_search_field_update AFTER UPDATE ON product_field_values
+		BEGIN` + refresh("id = NEW.product_id") + ` END;
+		CREATE TRIGGER product_search_field_delete AFTER DELETE ON product_field_values
+		BEGIN` + refresh("id = OLD.product_id") + ` END;
+	`)
+	return err
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// materialForms lists the stock shapes a material size can describe and a
+// catalog material can come in, with the dimensions each one takes.
+var materialForms = []struct {
+	Code       string
+	Label      string
+	Dimensions string
+	Count      int
+}{
+	{"round_bar", "Round Bar", "Ø diameter x length", 2},
+	{"flat_bar", "Flat Bar", "width x thickness x length", 3},
+	{"plate", "Plate", "width x thickness x length", 3},
+	{"tube", "Tube", "Ø outside diameter x wall x length", 3},
+	{"hex", "Hex Bar", "across flats x length", 2},
+}
+
+func materialFormLabel(code string) string {
+	for _, f := range materialForms {
+		if f.Code == code {
+			return f.Label
+		}
+	}
+	return code
+}
+
+func materialFormDimensions(code string) string {
+	for _, f := range materialForms {
+		if f.Code == code {
+			return f.Dimensions
+		}
+	}
+	return ""
+}
+
+func materialFormCount(code string) int {
+	for _, f := range materialForms {
+		if f.Code == code {
+			return f.Count
+		}
+	}
+	return 0
+}
+
+// lengthUnits maps the units a size can be entered in to millimetres.
+var lengthUnits = map[string]float64{
+	"mm": 1,
+	"cm": 10,
+	"m":  1000,
+	"in": 25.4,
+}
+
+// shapeWords are the words and symbols in a material size that say which
+// shape it is. Words naming a dimension ("long", "thk") are accepted and
+// ignored.
+var shapeWords = map[string]string{
+	"ø": "round_bar", "⌀": "round_bar", "d": "round_bar", "dia": "round_bar", "round": "round_bar",
+	"rd": "round_bar", "rnd": "round_bar",
+	"flat": "flat_bar", "fb": "flat_bar",
+	"plate": "plate", "pl": "plate", "sheet": "plate",
+	"tube": "tube", "tubing": "tube", "pipe": "tube", "od": "tube", "wall": "tube", "wt": "tube",
+	"hex": "hex", "af": "hex", "a/f": "hex",
+	"bar": "", "l": "", "lg": "", "long": "", "length": "", "thk": "", "t": "", "x": "", "by": "",
+}
+
+// StockSize is a material size read into a shape and its dimensions. Dims are
+// in millimetres, in the order listed by materialForms; Unit is the unit the
+// size was entered in.
+type StockSize struct {
+	Shape string
+	Dims  []float64
+	Unit  string
+}
+
+type sizeToken struct {
+	text   string
+	number bool
+}
+
+// tokenizeSize splits a material size into numbers (including fractions such
+// as "1/2" and decimal commas) and words.
+func tokenizeSize(s string) []sizeToken {
+	var tokens []sizeToken
+	runes := []rune(s)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsDigit(r) || (r == '.' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			j := i
+			for j < len(runes) && (unicode.IsDigit(runes[j]) ||
+				((runes[j] == '.' || runes[j] == ',' || runes[j] == '/') && j+1 < len(runes) && unicode.IsDigit(runes[j+1]))) {
+				j++
+			}
+			tokens = append(tokens, sizeToken{strings.ReplaceAll(string(runes[i:j]), ",", "."), true})
+			i = j
+		case unicode.IsLetter(r) && r != 'ø':
+			j := i
+			for j < len(runes) && (unicode.IsLetter(runes[j]) && runes[j] != 'ø' || runes[j] == '/') {
+				j++
+			}
+			word := string(runes[i:j])
+			// "2inx1in" and "50mmx20": a unit glued to the "x" separator.
+			if prefix := strings.TrimSuffix(word, "x"); prefix != word && lengthUnits[prefix] != 0 {
+				tokens = append(tokens, sizeToken{prefix, false}, sizeToken{"x", false})
+			} else {
+				tokens = append(tokens, sizeToken{word, false})
+			}
+			i = j
+		default:
+			tokens = append(tokens, sizeToken{string(r), false})
+			i++
+		}
+	}
+	return tokens
+}
+
+// parseSizeNumber reads "12", "12.5", "1/2" or a whole number followed by a
+// fraction, given as two tokens.
+func parseSizeNumber(s string) (float64, error) {
+	if num, den, ok := strings.Cut(s, "/"); ok {
+		n, err1 := strconv.ParseFloat(num, 64)
+		d, err2 := strconv.ParseFloat(den, 64)
+		if err1 != nil || err2 != nil || d == 0 {
+			return 0, fmt.Errorf("%q is not a number", s)
+		}
+		return n / d, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a number", s)
+	}
+	return v, nil
+}
+
+// parseMaterialSize reads sizes such as "Ø50 x 120mm", "2in x 1in x 6in",
+// "hex 22 x 80" or "60 x 3 x 500 tube". A unit given after any dimension
+// applies to the dimensions without one; millimetres are assumed otherwise.
+// When the size does not say which shape it is, defaultShape is used if it
+// takes as many dimensions as were given.
+func parseMaterialSize(size, defaultShape string) (StockSize, error) {
+	s := strings.ToLower(strings.TrimSpace(size))
+	if s == "" {
+		return StockSize{}, fmt.Errorf("no size given")
+	}
+	s = strings.NewReplacer("×", " x ", "*", " x ", "\"", "in", "″", "in", "”", "in",
+		"inches", "in", "inch", "in").Replace(s)
+
+	type dimension struct {
+		value float64
+		unit  string
+	}
+	var dims []dimension
+	var lastUnit string
+	shapes := map[string]bool{}
+
+	tokens := tokenizeSize(s)
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		if t.number {
+			v, err := parseSizeNumber(t.text)
+			if err != nil {
+				return StockSize{}, err
+			}
+			// A whole number followed by a fraction: "1 1/2in".
+			if i+1 < len(tokens) && tokens[i+1].number && strings.Contains(tokens[i+1].text, "/") && !strings.Contains(t.text, "/") {
+				f, err := parseSizeNumber(tokens[i+1].text)
+				if err != nil {
+					return StockSize{}, err
+				}
+				v += f
+				i++
+			}
+			if v <= 0 {
+				return StockSize{}, fmt.Errorf("dimension %q must be greater than zero", t.text)
+			}
+			dims = append(dims, dimension{value: v})
+			continue
+		}
+		if _, ok := lengthUnits[t.text]; ok {
+			if len(dims) == 0 || dims[len(dims)-1].unit != "" {
+				return StockSize{}, fmt.Errorf("unit %q does not follow a dimension", t.text)
+			}
+			dims[len(dims)-1].unit = t.text
+			lastUnit = t.text
+			continue
+		}
+		shape, ok := shapeWords[t.text]
+		if !ok {
+			return StockSize{}, fmt.Errorf("cannot read %q", t.text)
+		}
+		if shape != "" {
+			shapes[shape] = true
+		}
+	}
+	if len(dims) == 0 {
+		return StockSize{}, fmt.Errorf("no dimensions given")
+	}
+
+	// Ø with a wall thickness is a tube.
+	if shapes["tube"] {
+		delete(shapes, "round_bar")
+	}
+	if len(shapes) > 1 {
+		return StockSize{}, fmt.Errorf("size names more than one shape")
+	}
+	var shape string
+	for sh := range shapes {
+		shape = sh
+	}
+	if shape == "" {
+		switch {
+		case materialFormCount(defaultShape) == len(dims):
+			shape = defaultShape
+		case len(dims) == 2:
+			shape = "round_bar"
+		case len(dims) == 3:
+			shape = "flat_bar"
+		}
+	}
+	if shape == "round_bar" && len(dims) == 3 {
+		shape = "tube"
+	}
+	if want := materialFormCount(shape); want != len(dims) {
+		if want == 0 {
+			return StockSize{}, fmt.Errorf("expected 2 or 3 dimensions, got %d", len(dims))
+		}
+		return StockSize{}, fmt.Errorf("%s needs %d dimensions (%s), got %d",
+			materialFormLabel(shape), want, materialFormDimensions(shape), len(dims))
+	}
+
+	if lastUnit == "" {
+		lastUnit = "mm"
+	}
+	parsed := StockSize{Shape: shape, Unit: lastUnit}
+	for _, d := range dims {
+		unit := d.unit
+		if unit == "" {
+			unit = lastUnit
+		}
+		parsed.Dims = append(parsed.Dims, d.value*lengthUnits[unit])
+	}
+	if shape == "tube" && 2*parsed.Dims[1] >= parsed.Dims[0] {
+		return StockSize{}, fmt.Errorf("tube wall %s is too thick for diameter %s",
+			formatLength(parsed.Dims[1], lastUnit), formatLength(parsed.Dims[0], lastUnit))
+	}
+	return parsed, nil
+}
+
+// Length returns the length of the piece in millimetres.
+func (s StockSize) Length() float64 {
+	return s.Dims[len(s.Dims)-1]
+}
+
+// Volume returns the volume of the piece in mm³.
+func (s StockSize) Volume() float64 {
+	d, length := s.Dims, s.Length()
+	switch s.Shape {
+	case "round_bar":
+		return math.Pi / 4 * d[0] * d[0] * length
+	case "tube":
+		id := d[0] - 2*d[1]
+		return math.Pi / 4 * (d[0]*d[0] - id*id) * length
+	case "hex":
+		return math.Sqrt(3) / 2 * d[0] * d[0] * length
+	default:
+		return d[0] * d[1] * length
+	}
+}
+
+// Area returns the surface area of the piece in mm², including its ends and,
+// for a tube, its bore.
+func (s StockSize) Area() float64 {
+	d, length := s.Dims, s.Length()
+	switch s.Shape {
+	case "round_bar":
+		return math.Pi*d[0]*length + math.Pi/2*d[0]*d[0]
+	case "tube":
+		id := d[0] - 2*d[1]
+		return math.Pi*(d[0]+id)*length + math.Pi/2*(d[0]*d[0]-id*id)
+	case "hex":
+		return 6*d[0]/math.Sqrt(3)*length + math.Sqrt(3)*d[0]*d[0]
+	default:
+		return 2 * (d[0]*d[1] + d[0]*length + d[1]*length)
+	}
+}
+
+// Weight returns the weight in kg of the piece in a material with the given
+// density in g/cm³.
+func (s StockSize) Weight(density float64) float64 {
+	return s.Volume() * density / 1e6
+}
+
+// formatLength shows a length in millimetres in the given unit.
+func formatLength(mm float64, unit string) string {
+	factor := lengthUnits[unit]
+	if factor == 0 {
+		factor = 1
+	}
+	return strconv.FormatFloat(math.Round(mm/factor*1000)/1000, 'f', -1, 64)
+}
+
+// Format writes the size back in the given unit, e.g. "Ø1.969 x 4.724 in".
+func (s StockSize) Format(unit string) string {
+	parts := make([]string, len(s.Dims))
+	for i, d := range s.Dims {
+		parts[i] = formatLength(d, unit)
+	}
+	switch s.Shape {
+	case "round_bar", "tube":
+		parts[0] = "Ø" + parts[0]
+	case "hex":
+		parts[0] += " AF"
+	}
+	return strings.Join(parts, " x ") + " " + unit
+}
+
+// FormatVolume shows the volume in cm³, or in³ when unit is inches.
+func (s StockSize) FormatVolume(unit string) string {
+	if unit == "in" {
+		return fmt.Sprintf("%.2f in³", s.Volume()/math.Pow(25.4, 3))
+	}
+	return fmt.Sprintf("%.1f cm³", s.Volume()/1000)
+}
+
+// FormatWeight shows the weight for a density in g/cm³ in kg, or in lb when
+// unit is inches.
+func (s StockSize) FormatWeight(density float64, unit string) string {
+	if unit == "in" {
+		return fmt.Sprintf("%.3f lb", s.Weight(density)/0.45359237)
+	}
+	return fmt.Sprintf("%.3f kg", s.Weight(density))
+}
+
+// preferredUnit is the unit sizes are shown in: "mm" or "in", remembered in
+// the "units" cookie.
+func preferredUnit(r *http.Request) string {
+	if c, err := r.Cookie("units"); err == nil && c.Value == "in" {
+		return "in"
+	}
+	return "mm"
+}
+
+// unitsHandler stores the preferred unit and returns to the page it was
+// chosen on.
+func unitsHandler(w http.ResponseWriter, r *http.Request) {
+	unit := r.FormValue("set")
+	if unit != "mm" && unit != "in" {
+		http.Error(w, "Unknown unit", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: "units", Value: unit, Path: "/", MaxAge: 10 * 365 * 24 * 3600})
+
+	back := r.Referer()
+	if back == "" {
+		back = "/"
+	}
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// checkMaterialSize reports a material size the parser cannot read, taking
+// the shape from the selected catalog material when the size does not say.
+func checkMaterialSize(size string, materialID sql.NullInt64) error {
+	if strings.TrimSpace(size) == "" {
+		return nil
+	}
+	var form string
+	if materialID.Valid {
+		if err := db.QueryRow("SELECT form FROM materials WHERE id = ?", materialID.Int64).Scan(&form); err != nil && err != sql.ErrNoRows {
+			return err
+		}
+	}
+	if _, err := parseMaterialSize(size, form); err != nil {
+		return fmt.Errorf("Material Size: %q could not be read (%v)", size, err)
+	}
+	return nil
+}
+
+// reportUnreadableMaterialSizes records every stored material size the
+// parser cannot read in migration_reports. Sizes are left as they are.
+func reportUnreadableMaterialSizes(tx *sql.Tx) error {
+	type storedSize struct {
+		id           int
+		partNo, size string
+		form         sql.NullString
+	}
+	rows, err := tx.Query(`
+		SELECT p.id, p.partNo, p.material_size, m.form
+		FROM products p LEFT JOIN materials m ON m.id = p.material_id
+		WHERE TRIM(IFNULL(p.material_size, '')) <> ''`)
+	if err != nil {
+		return err
+	}
+	var sizes []storedSize
+	for rows.Next() {
+		var s storedSize
+		if err := rows.Scan(&s.id, &s.partNo, &s.size, &s.form); err != nil {
+			rows.Close()
+			return err
+		}
+		sizes = append(sizes, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, s := range sizes {
+		if _, err := parseMaterialSize(s.size, s.form.String); err != nil {
+			failed++
+			log.Printf("Could not read material size %q of product %s: %v", s.size, s.partNo, err)
+			if err := reportMigrationIssue(tx, 10, s.id, "material_size", s.size, err.Error()); err != nil {
+				return err
+			}
+		}
+	}
+	if failed > 0 {
+		log.Printf("%d material sizes could not be read; see the migration_reports table", failed)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestParseMaterialSize(t *testing.T) {
+	for _, tc := range []struct {
+		size, defaultShape string
+		shape, unit        string
+		dims               []float64
+	}{
+		// Units: millimetres by default, a unit after any dimension applies
+		// to the others, inch marks and words are inches.
+		{"50 x 120", "", "round_bar", "mm", []float64{50, 120}},
+		{"5cm x 12cm", "", "round_bar", "cm", []float64{50, 120}},
+		{"50mm x 0.12m", "", "round_bar", "m", []float64{50, 120}},
+		{"2in x 1in x 6in", "", "flat_bar", "in", []float64{50.8, 25.4, 152.4}},
+		{"2 x 1 x 6\"", "", "flat_bar", "in", []float64{50.8, 25.4, 152.4}},
+		{"2 inches x 6 inch", "", "round_bar", "in", []float64{50.8, 152.4}},
+		{"1 1/2in dia x 3in", "", "round_bar", "in", []float64{38.1, 76.2}},
+		{"50,5 x 100", "", "round_bar", "mm", []float64{50.5, 100}},
+		// Separators.
+		{"100×10×500", "", "flat_bar", "mm", []float64{100, 10, 500}},
+		{"100*10*500", "", "flat_bar", "mm", []float64{100, 10, 500}},
+		{"100 by 10 by 500", "", "flat_bar", "mm", []float64{100, 10, 500}},
+		{"2inx1inx6in", "", "flat_bar", "in", []float64{50.8, 25.4, 152.4}},
+		{"50mmx20cm", "", "round_bar", "cm", []float64{50, 200}},
+		// Diameters and shapes.
+		{"Ø50 x 120mm", "", "round_bar", "mm", []float64{50, 120}},
+		{"⌀50 x 120", "", "round_bar", "mm", []float64{50, 120}},
+		{"50 dia x 120 long", "", "round_bar", "mm", []float64{50, 120}},
+		{"Ø60 x 3 x 500", "", "tube", "mm", []float64{60, 3, 500}},
+		{"60 od x 3 wall x 500", "", "tube", "mm", []float64{60, 3, 500}},
+		{"hex 22 x 80", "", "hex", "mm", []float64{22, 80}},
+		{"22 A/F x 80", "", "hex", "mm", []float64{22, 80}},
+		{"plate 100 x 10 x 500", "", "plate", "mm", []float64{100, 10, 500}},
+		// The default shape applies when it takes as many dimensions.
+		{"100 x 10 x 500", "plate", "plate", "mm", []float64{100, 10, 500}},
+		{"22 x 80", "hex", "hex", "mm", []float64{22, 80}},
+		{"22 x 80", "plate", "round_bar", "mm", []float64{22, 80}},
+	} {
+		s, err := parseMaterialSize(tc.size, tc.defaultShape)
+		if err != nil {
+			t.Errorf("parseMaterialSize(%q, %q): %v", tc.size, tc.defaultShape, err)
+			continue
+		}
+		if s.Shape != tc.shape || s.Unit != tc.unit || len(s.Dims) != len(tc.dims) {
+			t.Errorf("parseMaterialSize(%q, %q) = %+v, want %s %v %s", tc.size, tc.defaultShape, s, tc.shape, tc.dims, tc.unit)
+			continue
+		}
+		for i := range tc.dims {
+			if math.Abs(s.Dims[i]-tc.dims[i]) > 1e-9 {
+				t.Errorf("parseMaterialSize(%q, %q) = %v, want %v", tc.size, tc.defaultShape, s.Dims, tc.dims)
+				break
+			}
+		}
+	}
+}
+
+func TestParseMaterialSizeInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		size, err string
+	}{
+		{"", "no size given"},
+		{"round", "no dimensions given"},
+		{"about a foot", `cannot read "about"`},
+		{"50", "expected 2 or 3 dimensions, got 1"},
+		{"1 x 2 x 3 x 4", "expected 2 or 3 dimensions, got 4"},
+		{"hex 22 x 10 x 80", "Hex Bar needs 2 dimensions (across flats x length), got 3"},
+		{"hex round 5 x 5", "more than one shape"},
+		{"mm 5 x 5", `unit "mm" does not follow a dimension`},
+		{"5mm mm x 5", `unit "mm" does not follow a dimension`},
+		{"0 x 5", `dimension "0" must be greater than zero`},
+		{"1/0 x 5", `"1/0" is not a number`},
+		{"Ø60 x 40 x 500", "tube wall 40 is too thick for diameter 60"},
+	} {
+		s, err := parseMaterialSize(tc.size, "")
+		if err == nil {
+			t.Errorf("parseMaterialSize(%q) = %+v, want error %q", tc.size, s, tc.err)
+		} else if !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("parseMaterialSize(%q): %v, want %q", tc.size, err, tc.err)
+		}
+	}
+}
+
+func TestStockSizeMeasures(t *testing.T) {
+	for _, tc := range []struct {
+		size         string
+		volume, area float64
+		format       string
+	}{
+		{"Ø50 x 120", 235619.449, 22776.547, "Ø50 x 120 mm"},
+		{"100 x 10 x 500", 500000, 112000, "100 x 10 x 500 mm"},
+		{"hex 22 x 80", 33532.504, 6935.131, "22 AF x 80 mm"},
+		{"Ø60 x 3 x 500", 268606.172, 180145.206, "Ø60 x 3 x 500 mm"},
+	} {
+		s, err := parseMaterialSize(tc.size, "")
+		if err != nil {
+			t.Fatalf("parseMaterialSize(%q): %v", tc.size, err)
+		}
+		if v := s.Volume(); math.Abs(v-tc.volume) > 0.001 {
+			t.Errorf("%s: volume %.3f, want %.3f", tc.size, v, tc.volume)
+		}
+		if a := s.Area(); math.Abs(a-tc.area) > 0.001 {
+			t.Errorf("%s: area %.3f, want %.3f", tc.size, a, tc.area)
+		}
+		if w := s.Weight(2.7); math.Abs(w-tc.volume*2.7/1e6) > 1e-9 {
+			t.Errorf("%s: weight %.6f kg", tc.size, w)
+		}
+		if f := s.Format("mm"); f != tc.format {
+			t.Errorf("%s: Format(mm) = %q, want %q", tc.size, f, tc.format)
+		}
+	}
+
+	s, _ := parseMaterialSize("Ø50 x 120mm", "")
+	if f := s.Format("in"); f != "Ø1.969 x 4.724 in" {
+		t.Errorf("Format(in) = %q", f)
+	}
+	if v := s.FormatVolume("mm"); v != "235.6 cm³" {
+		t.Errorf("FormatVolume(mm) = %q", v)
+	}
+	if w := s.FormatWeight(2.7, "mm"); w != "0.636 kg" {
+		t.Errorf("FormatWeight(mm) = %q", w)
+	}
+}
+
+func TestMaterialCostFor(t *testing.T) {
+	byWeight := Material{Grade: "6061", Form: "round_bar", Density: 2.7,
+		Price: Amount{Minor: 850, Valid: true}, Currency: "USD", PriceUnit: "kg"}
+	byLength := byWeight
+	byLength.PriceUnit = "m"
+	byLength.Price = Amount{Minor: 1200, Valid: true}
+
+	for _, tc := range []struct {
+		m          Material
+		size, curr string
+		want       int64
+		err        string
+	}{
+		{byWeight, "Ø50 x 120", "USD", 541, ""},
+		{byLength, "Ø50 x 120", "USD", 144, ""},
+		{byLength, "Ø2in x 10in", "USD", 305, ""},
+		{byWeight, "Ø50 x 120", "EUR", 0, "priced in USD"},
+		{byWeight, "100 x 10 x 500", "USD", 0, "is a Flat Bar"},
+		{byWeight, "junk", "USD", 0, "cannot read"},
+	} {
+		got, err := tc.m.CostFor(tc.size, tc.curr)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s per %s, %s in %s: %v, want error %q", tc.m.Name(), tc.m.PriceUnit, tc.size, tc.curr, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || !got.Valid || got.Minor != tc.want {
+			t.Errorf("%s per %s, %s: %v %v, want %d", tc.m.Name(), tc.m.PriceUnit, tc.size, got, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+// Interactive API documentation built from /api/openapi.json: every operation
+// is listed with its parameters, body and responses, and can be tried out
+// against the running application.
+
+const METHODS = ['get', 'post', 'put', 'patch', 'delete'];
+
+let spec = null;
+
+document.addEventListener('DOMContentLoaded', function() {
+    fetch('/api/openapi.json')
+        .then(response => {
+            if (!response.ok) {
+                throw new Error('status ' + response.status);
+            }
+            return response.json();
+        })
+        .then(doc => {
+            spec = doc;
+            render();
+        })
+        .catch(err => {
+            document.getElementById('apiOperations').textContent = 'Error loading the OpenAPI document: ' + err.message;
+        });
+});
+
+function el(tag, attrs, ...children) {
+    const node = document.createElement(tag);
+    for (const [key, value] of Object.entries(attrs || {})) {
+        if (key === 'class') {
+            node.className = value;
+        } else {
+            node.setAttribute(key, value);
+        }
+    }
+    for (const child of children) {
+        if (child === null || child === undefined) {
+            continue;
+        }
+        node.append(child instanceof Node ? child : String(child));
+    }
+    return node;
+}
+
+// resolve follows a local $ref such as #/components/schemas/Product.
+function resolve(obj) {
+    while (obj && obj.$ref) {
+        obj = obj.$ref.replace(/^#\//, '').split('/').reduce((o, key) => o[key], spec);
+    }
+    return obj || {};
+}
+
+function refName(obj) {
+    return obj && obj.$ref ? obj.$ref.split('/').pop() : '';
+}
+
+function operationId(path, method) {
+    const op = spec.paths[path][method];
+    return 'op-' + (op.operationId || method + path.replace(/[^a-zA-Z0-9]+/g, '-'));
+}
+
+function render() {
+    document.getElementById('apiTitle').textContent = spec.info.title + ' ' + spec.info.version;
+    document.title = spec.info.title;
+    document.getElementById('apiDescription').textContent = spec.info.description || '';
+
+    const byTag = new Map((spec.tags || []).map(t => [t.name, []]));
+    for (const [path, item] of Object.entries(spec.paths)) {
+        for (const method of METHODS) {
+            if (!item[method]) {
+                continue;
+            }
+            const tag = (item[method].tags || ['Other'])[0];
+            if (!byTag.has(tag)) {
+                byTag.set(tag, []);
+            }
+            byTag.get(tag).push({ path, method });
+        }
+    }
+
+    const nav = document.getElementById('apiNav');
+    const main = document.getElementById('apiOperations');
+    nav.innerHTML = '';
+    main.innerHTML = '';
+    for (const [tag, operations] of byTag) {
+        if (operations.length === 0) {
+            continue;
+        }
+        nav.append(el('h3', {}, tag));
+        const list = el('ul');
+        main.append(el('h2', {}, tag));
+        for (const { path, method } of operations) {
+            list.append(el('li', {},
+                el('a', { href: '#' + operationId(path, method) },
+                    el('span', { class: 'api-method api-method-' + method }, method.toUpperCase()), ' ', path)));
+            main.append(renderOperation(path, method));
+        }
+        nav.append(list);
+    }
+
+    nav.append(el('h3', {}, 'Schemas'));
+    const schemaList = el('ul');
+    main.append(el('h2', {}, 'Schemas'));
+    for (const [name, schema] of Object.entries(spec.components.schemas)) {
+        schemaList.append(el('li', {}, el('a', { href: '#schema-' + name }, name)));
+        main.append(el('section', { class: 'api-operation', id: 'schema-' + name },
+            el('h3', {}, name), schema.description ? el('p', {}, schema.description) : null, renderSchema(schema)));
+    }
+    nav.append(schemaList);
+}
+
+function typeLabel(schema) {
+    if (!schema) {
+        return '';
+    }
+    if (schema.$ref) {
+        const name = refName(schema);
+        return el('a', { href: '#schema-' + name }, name);
+    }
+    if (schema.allOf) {
+        const span = el('span');
+        schema.allOf.forEach((s, i) => span.append(i ? ' & ' : '', typeLabel(s)));
+        return span;
+    }
+    if (schema.type === 'array') {
+        return el('span', {}, typeLabel(schema.items), '[]');
+    }
+    let label = schema.type || 'object';
+    if (schema.format) {
+        label += ' (' + schema.format + ')';
+    }
+    if (schema.enum) {
+        label += ': ' + schema.enum.join(' | ');
+    }
+    if (schema.nullable) {
+        label += ', nullable';
+    }
+    return label;
+}
+
+// renderSchema lists the properties of an object schema.
+function renderSchema(schema) {
+    schema = resolve(schema);
+    if (schema.allOf) {
+        const div = el('div');
+        schema.allOf.forEach(s => div.append(renderSchema(s)));
+        return div;
+    }
+    if (!schema.properties) {
+        return el('p', {}, 'Type: ', typeLabel(schema), schema.additionalProperties ? ' of values keyed by name' : '');
+    }
+    const required = new Set(schema.required || []);
+    const table = el('table', {}, el('thead', {}, el('tr', {}, el('th', {}, 'Field'), el('th', {}, 'Type'), el('th', {}, 'Description'))));
+    const body = el('tbody');
+    for (const [name, prop] of Object.entries(schema.properties)) {
+        body.append(el('tr', {},
+            el('td', {}, el('code', {}, name), required.has(name) ? ' *' : ''),
+            el('td', {}, typeLabel(prop)),
+            el('td', {}, prop.description || resolve(prop).description || '')));
+    }
+    table.append(body);
+    return table;
+}
+
+// example builds a sample value of a schema for the request body editor.
+function example(schema, depth) {
+    const name = refName(schema);
+    schema = resolve(schema);
+    if (depth > 3) {
+        return null;
+    }
+    if (schema.allOf) {
+        return Object.assign({}, ...schema.allOf.map(s => example(s, depth)));
+    }
+    if (schema.default !== undefined) {
+        return schema.default;
+    }
+    if (schema.enum) {
+        return schema.enum[0];
+    }
+    switch (schema.type) {
+        case 'array':
+            return [example(schema.items, depth + 1)];
+        case 'integer':
+        case 'number':
+            return name === 'Amount' ? 1250 : 0;
+        case 'boolean':
+            return false;
+        case 'string':
+            return schema.format === 'date' ? new Date().toISOString().slice(0, 10) : '';
+    }
+    const value = {};
+    for (const [key, prop] of Object.entries(schema.properties || {})) {
+        value[key] = example(prop, depth + 1);
+    }
+    return value;
+}
+
+function renderOperation(path, method) {
+    const op = spec.paths[path][method];
+    const params = (spec.paths[path].parameters || []).concat(op.parameters || []);
+    const section = el('section', { class: 'api-operation', id: operationId(path, method) },
+        el('h3', {}, el('span', { class: 'api-method api-method-' + method }, method.toUpperCase()), ' ', el('code', {}, path)),
+        el('p', {}, op.summary || ''),
+        op.description ? el('p', { class: 'api-description' }, op.description) : null);
+
+    if (params.length) {
+        const table = el('table', {}, el('thead', {}, el('tr', {},
+            el('th', {}, 'Parameter'), el('th', {}, 'In'), el('th', {}, 'Type'), el('th', {}, 'Description'))));
+        const body = el('tbody');
+        for (const p of params) {
+            body.append(el('tr', {},
+                el('td', {}, el('code', {}, p.name), p.required ? ' *' : ''),
+                el('td', {}, p.in), el('td', {}, typeLabel(p.schema)), el('td', {}, p.description || '')));
+        }
+        table.append(body);
+        section.append(el('h4', {}, 'Parameters'), table);
+    }
+
+    let bodyType = null;
+    let bodySchema = null;
+    if (op.requestBody) {
+        [bodyType] = Object.keys(op.requestBody.content);
+        bodySchema = op.requestBody.content[bodyType].schema;
+        section.append(el('h4', {}, 'Request body (' + bodyType + ')'), renderSchema(bodySchema));
+    }
+
+    const responses = el('ul', { class: 'api-responses' });
+    for (const [status, response] of Object.entries(op.responses)) {
+        const r = resolve(response);
+        const schemas = Object.entries(r.content || {}).map(([type, c]) => el('span', {}, ' ', typeLabel(c.schema), ' (' + type + ')'));
+        responses.append(el('li', {}, el('strong', {}, status), ' ', r.description || '', ...schemas));
+    }
+    section.append(el('h4', {}, 'Responses'), responses);
+
+    section.append(renderTryIt(path, method, params, bodyType, bodySchema));
+    return section;
+}
+
+// renderTryIt builds a form sending the operation to the application.
+function renderTryIt(path, method, params, bodyType, bodySchema) {
+    const form = el('form', { class: 'api-try' });
+    const details = el('details', {}, el('summary', {}, 'Try it'), form);
+
+    for (const p of params) {
+        form.append(el('label', {}, p.name + ' (' + p.in + ')',
+            el('input', { type: 'text', name: 'param-' + p.name, placeholder: p.description || '' })));
+    }
+    if (bodyType === 'application/json') {
+        const textarea = el('textarea', { name: 'body', rows: 10 });
+        textarea.value = JSON.stringify(example(bodySchema, 0), null, 2);
+        form.append(el('label', {}, 'Body', textarea));
+    } else if (bodyType === 'multipart/form-data') {
+        for (const [name, prop] of Object.entries(resolve(bodySchema).properties || {})) {
+            const binary = prop.format === 'binary' || (prop.items && prop.items.format === 'binary');
+            form.append(el('label', {}, name, binary ?
+                el('input', { type: 'file', name: 'file-' + name, multiple: '' }) :
+                el('input', { type: 'text', name: 'field-' + name, placeholder: (prop.enum || []).join(' | ') })));
+        }
+    }
+
+    const output = el('pre', { class: 'api-output' });
+    form.append(el('button', { type: 'submit', class: 'btn' }, 'Send'), output);
+    form.addEventListener('submit', function(e) {
+        e.preventDefault();
+        send(form, path, method, params, bodyType, output);
+    });
+    return details;
+}
+
+function send(form, path, method, params, bodyType, output) {
+    let url = path;
+    const query = new URLSearchParams();
+    for (const p of params) {
+        const value = form.elements['param-' + p.name].value;
+        if (p.in === 'path') {
+            url = url.replace('{' + p.name + '}', encodeURIComponent(value));
+        } else if (value !== '') {
+            value.split(',').forEach(v => query.append(p.name, v.trim()));
+        }
+    }
+    if (query.toString()) {
+        url += '?' + query.toString();
+    }
+
+    const options = { method: method.toUpperCase(), headers: {} };
+    if (bodyType === 'application/json') {
+        options.headers['Content-Type'] = 'application/json';
+        options.body = form.elements.body.value;
+    } else if (bodyType === 'multipart/form-data') {
+        const data = new FormData();
+        for (const input of form.querySelectorAll('input[name^="file-"]')) {
+            for (const file of input.files) {
+                data.append(input.name.slice(5), file);
+            }
+        }
+        for (const input of form.querySelectorAll('input[name^="field-"]')) {
+            if (input.value !== '') {
+                data.append(input.name.slice(6), input.value);
+            }
+        }
+        options.body = data;
+    }
+
+    output.textContent = options.method + ' ' + url + ' ...';
+    fetch(url, options)
+        .then(response => {
+            const type = response.headers.get('Content-Type') || '';
+            const status = response.status + ' ' + response.statusText + '\n';
+            if (type.includes('json')) {
+                return response.json().then(json => status + JSON.stringify(json, null, 2));
+            }
+            if (type.startsWith('text/')) {
+                return response.text().then(text => status + text);
+            }
+            return response.blob().then(blob => status + type + ', ' + blob.size + ' bytes');
+        })
+        .then(text => {
+            output.textContent = options.method + ' ' + url + '\n' + text;
+        })
+        .catch(err => {
+            output.textContent = 'Request failed: ' + err.message;
+        });
+}
@@ -53,6 +53,10 @@
                     if (searchQuery) {
                         newUrl.searchParams.set('q', searchQuery);
                     }
+                    const category = urlParams.get('category');
+                    if (category) {
+                        newUrl.searchParams.set('category', category);
+                    }
 
                     // Navigate to new URL
                     window.location.href = newUrl.toString();
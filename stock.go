@@ -0,0 +1,257 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os/user"
+	"strings"
+)
+
+// stockMovementTypes lists the kinds of stock movement that can be posted.
+// Receipts add stock, issues and scrap remove it, and adjustments correct the
+// balance either way. Transfers between locations are recorded as a pair of
+// "transfer" movements by transferStock.
+var stockMovementTypes = []string{"receipt", "issue", "adjustment", "scrap"}
+
+func isStockMovementType(t string) bool {
+	for _, s := range stockMovementTypes {
+		if s == t {
+			return true
+		}
+	}
+	return false
+}
+
+// errInsufficientStock is returned when a movement would take the on-hand
+// balance of its location below zero.
+var errInsufficientStock = errors.New("insufficient stock")
+
+// errUnknownLocation is returned for a movement naming a location that does
+// not exist.
+var errUnknownLocation = errors.New("unknown location")
+
+// StockMovement is one entry of the stock ledger. Quantity is signed: positive
+// movements add to the on-hand balance, negative ones remove from it. Balance
+// is the total on-hand quantity, over all locations, after the movement.
+type StockMovement struct {
+	ID         int64  `json:"id"`
+	ProductID  int    `json:"productId"`
+	LocationID int64  `json:"locationId"`
+	Location   string `json:"location,omitempty"`
+	Type       string `json:"type"`
+	Quantity   int    `json:"quantity"`
+	Balance    int    `json:"balance"`
+	Reason     string `json:"reason,omitempty"`
+	Reference  string `json:"reference,omitempty"`
+	CreatedBy  string `json:"createdBy,omitempty"`
+	CreatedAt  string `json:"createdAt"`
+}
+
+// signedStockQuantity converts the quantity entered for a movement into the
+// signed change of the on-hand balance. Receipts, issues and scrap are entered
+// as positive numbers; adjustments carry their own sign.
+func signedStockQuantity(movementType string, qty int) (int, error) {
+	if !isStockMovementType(movementType) {
+		return 0, fmt.Errorf("unknown movement type %q", movementType)
+	}
+	if qty == 0 {
+		return 0, fmt.Errorf("quantity must not be zero")
+	}
+	switch movementType {
+	case "adjustment":
+		return qty, nil
+	case "receipt":
+		if qty < 0 {
+			return 0, fmt.Errorf("receipt quantity must be positive")
+		}
+		return qty, nil
+	default:
+		if qty < 0 {
+			return 0, fmt.Errorf("%s quantity must be positive", movementType)
+		}
+		return -qty, nil
+	}
+}
+
+// recordStockMovement appends m to the ledger, booking it to the default
+// location when m.LocationID is zero. The products.qty roll-up is kept up to
+// date by the update_product_on_hand trigger.
+func recordStockMovement(tx *sql.Tx, m StockMovement) (int64, error) {
+	var exists bool
+	if err := tx.QueryRow("SELECT 1 FROM products WHERE id = ?", m.ProductID).Scan(&exists); err != nil {
+		return 0, err
+	}
+
+	locationID, err := stockLocation(tx, m.LocationID)
+	if err != nil {
+		return 0, err
+	}
+	m.LocationID = locationID
+	var location string
+	err = tx.QueryRow("SELECT code FROM locations WHERE id = ?", m.LocationID).Scan(&location)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("%w %d", errUnknownLocation, m.LocationID)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var onHand int
+	err = tx.QueryRow("SELECT IFNULL(SUM(quantity), 0) FROM stock_movements WHERE product_id = ? AND location_id = ?",
+		m.ProductID, m.LocationID).Scan(&onHand)
+	if err != nil {
+		return 0, err
+	}
+	if onHand+m.Quantity < 0 {
+		return 0, fmt.Errorf("%w: %d on hand at %s", errInsufficientStock, onHand, location)
+	}
+
+	res, err := tx.Exec(`
+		INSERT INTO stock_movements(product_id, location_id, type, quantity, reason, reference, created_by)
+		VALUES(?, ?, ?, ?, ?, ?, ?)`,
+		m.ProductID, m.LocationID, m.Type, m.Quantity, m.Reason, m.Reference, m.CreatedBy)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// stockLocation returns the location a movement booked to id goes to: id
+// itself, or the default location when id is zero.
+func stockLocation(q rowQuerier, id int64) (int64, error) {
+	if id != 0 {
+		return id, nil
+	}
+	id, err := findLocation(q, defaultLocationCode)
+	if err != nil {
+		return 0, fmt.Errorf("default location %s: %w", defaultLocationCode, err)
+	}
+	return id, nil
+}
+
+// loadStockMovements returns the ledger of a product, newest first.
+func loadStockMovements(productID int) ([]StockMovement, error) {
+	rows, err := db.Query(locationPathsCTE+`
+		SELECT m.id, m.product_id, m.location_id, lp.path, m.type, m.quantity,
+			   SUM(m.quantity) OVER (ORDER BY m.id) AS balance,
+			   m.reason, m.reference, m.created_by, m.created_at
+		FROM stock_movements m JOIN location_paths lp ON lp.id = m.location_id
+		WHERE m.product_id = ?
+		ORDER BY m.id DESC`, productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var movements []StockMovement
+	for rows.Next() {
+		var m StockMovement
+		var reason, reference, createdBy sql.NullString
+		if err := rows.Scan(&m.ID, &m.ProductID, &m.LocationID, &m.Location, &m.Type, &m.Quantity, &m.Balance,
+			&reason, &reference, &createdBy, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		m.Reason, m.Reference, m.CreatedBy = reason.String, reference.String, createdBy.String
+		movements = append(movements, m)
+	}
+	return movements, rows.Err()
+}
+
+// currentUsername names the person recording a movement when the request does
+// not: the account the application runs under.
+func currentUsername() string {
+	u, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return u.Username
+}
+
+// stockMovementHandler posts a movement to the stock ledger and returns it
+// together with the new on-hand balance.
+func stockMovementHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		ProductID  int    `json:"productId"`
+		LocationID int64  `json:"locationId"`
+		Type       string `json:"type"`
+		Quantity   int    `json:"quantity"`
+		Reason     string `json:"reason"`
+		Reference  string `json:"reference"`
+		User       string `json:"user"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	movementType := strings.ToLower(strings.TrimSpace(request.Type))
+	qty, err := signedStockQuantity(movementType, request.Quantity)
+	if err != nil {
+		http.Error(w, "Invalid movement: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m := StockMovement{
+		ProductID:  request.ProductID,
+		LocationID: request.LocationID,
+		Type:       movementType,
+		Quantity:   qty,
+		Reason:     strings.TrimSpace(request.Reason),
+		Reference:  strings.TrimSpace(request.Reference),
+		CreatedBy:  strings.TrimSpace(request.User),
+	}
+	if m.CreatedBy == "" {
+		m.CreatedBy = currentUsername()
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	m.ID, err = recordStockMovement(tx, m)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errUnknownLocation) {
+		http.Error(w, "Invalid movement: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errInsufficientStock) {
+		http.Error(w, "Invalid movement: "+err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error recording movement: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.QueryRow("SELECT qty FROM products WHERE id = ?", m.ProductID).Scan(&m.Balance); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.QueryRow("SELECT created_at FROM stock_movements WHERE id = ?", m.ID).Scan(&m.CreatedAt); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Stock %s of %d for product %d, on hand %d", m.Type, m.Quantity, m.ProductID, m.Balance)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
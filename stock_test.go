@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestStockLedger migrates products with stock on hand to the ledger, posts
+// movements and checks that products.qty stays the sum of the ledger and
+// that stock cannot be issued below zero.
+func TestStockLedger(t *testing.T) {
+	skipWithoutFTS5(t)
+	legacy, path := openLegacyDB(t, `
+		INSERT INTO products(partNo, qty) VALUES('S-1', 7), ('S-2', 0), ('S-3', NULL)`)
+	if err := migrateDB(legacy, path); err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+
+	check := func(partNo string, want int) {
+		t.Helper()
+		var qty, ledger int
+		err := legacy.QueryRow(`
+			SELECT p.qty, IFNULL(SUM(m.quantity), 0)
+			FROM products p LEFT JOIN stock_movements m ON m.product_id = p.id
+			WHERE p.partNo = ?`, partNo).Scan(&qty, &ledger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if qty != want || ledger != want {
+			t.Errorf("%s: qty %d, ledger %d, want %d", partNo, qty, ledger, want)
+		}
+	}
+	check("S-1", 7)
+	check("S-2", 0)
+	check("S-3", 0)
+	var reason string
+	legacy.QueryRow("SELECT reason FROM stock_movements WHERE type = 'adjustment' AND quantity = 7").Scan(&reason)
+	if reason != "Opening balance" {
+		t.Errorf("opening balance of S-1 recorded as %q", reason)
+	}
+
+	post := func(productID int, kind string, quantity int) error {
+		tx, err := legacy.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+		if _, err := recordStockMovement(tx, StockMovement{ProductID: productID, Type: kind, Quantity: quantity}); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+	for _, m := range []struct {
+		productID int
+		kind      string
+		quantity  int
+	}{
+		{1, "receipt", 5},
+		{1, "issue", -3},
+		{2, "receipt", 4},
+		{2, "issue", -4},
+	} {
+		if err := post(m.productID, m.kind, m.quantity); err != nil {
+			t.Fatalf("%s of %d to product %d: %v", m.kind, m.quantity, m.productID, err)
+		}
+	}
+	check("S-1", 9)
+	check("S-2", 0)
+
+	if err := post(1, "issue", -10); !errors.Is(err, errInsufficientStock) {
+		t.Errorf("issuing 10 of 9: %v, want errInsufficientStock", err)
+	}
+	if err := post(3, "scrap", -1); !errors.Is(err, errInsufficientStock) {
+		t.Errorf("scrapping 1 of 0: %v, want errInsufficientStock", err)
+	}
+	check("S-1", 9)
+	check("S-3", 0)
+}
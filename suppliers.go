@@ -0,0 +1,417 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Supplier is a vendor we buy material, finishing or other services from.
+// LeadTimeDays is nil when the lead time is not known.
+type Supplier struct {
+	ID           int64  `json:"id"`
+	Name         string `json:"name"`
+	Contact      string `json:"contact,omitempty"`
+	LeadTimeDays *int   `json:"leadTimeDays,omitempty"`
+	Notes        string `json:"notes,omitempty"`
+}
+
+// InvoiceDetails tags an invoice attachment with the supplier that issued it
+// and the invoice number, date (YYYY-MM-DD) and amount.
+type InvoiceDetails struct {
+	SupplierID  int64  `json:"supplierId,omitempty"`
+	Supplier    string `json:"supplier,omitempty"`
+	InvoiceNo   string `json:"invoiceNo,omitempty"`
+	InvoiceDate string `json:"invoiceDate,omitempty"`
+	Amount      Amount `json:"amountMinor"`
+	Currency    string `json:"currency,omitempty"`
+}
+
+// supplierInvoice is an invoice listed on the supplier page.
+type supplierInvoice struct {
+	File    FileInfo
+	Details InvoiceDetails
+	PartNo  string
+}
+
+const supplierColumns = "id, name, contact, lead_time_days, notes"
+
+func scanSupplier(s rowScanner, sup *Supplier) error {
+	var contact, notes sql.NullString
+	var leadTime sql.NullInt64
+	if err := s.Scan(&sup.ID, &sup.Name, &contact, &leadTime, &notes); err != nil {
+		return err
+	}
+	sup.Contact, sup.Notes = contact.String, notes.String
+	sup.LeadTimeDays = nil
+	if leadTime.Valid {
+		days := int(leadTime.Int64)
+		sup.LeadTimeDays = &days
+	}
+	return nil
+}
+
+// loadSuppliers returns every supplier ordered by name. It is also available
+// to templates as "suppliers" for the supplier drop-downs.
+func loadSuppliers() ([]Supplier, error) {
+	rows, err := db.Query("SELECT " + supplierColumns + " FROM suppliers ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var suppliers []Supplier
+	for rows.Next() {
+		var s Supplier
+		if err := scanSupplier(rows, &s); err != nil {
+			return nil, err
+		}
+		suppliers = append(suppliers, s)
+	}
+	return suppliers, rows.Err()
+}
+
+// parseSupplierForm validates the supplier fields posted by the supplier
+// pages.
+func parseSupplierForm(r *http.Request) (Supplier, error) {
+	s := Supplier{
+		Name:    strings.TrimSpace(r.FormValue("name")),
+		Contact: strings.TrimSpace(r.FormValue("contact")),
+		Notes:   strings.TrimSpace(r.FormValue("notes")),
+	}
+	if s.Name == "" {
+		return s, fmt.Errorf("Name: supplier name is required")
+	}
+	if lt := strings.TrimSpace(r.FormValue("leadTimeDays")); lt != "" {
+		days, err := strconv.Atoi(lt)
+		if err != nil || days < 0 {
+			return s, fmt.Errorf("Lead Time: %q is not a whole number of days", lt)
+		}
+		s.LeadTimeDays = &days
+	}
+	return s, nil
+}
+
+// saveSupplier inserts s, or updates it when s.ID is set.
+func saveSupplier(s *Supplier) error {
+	var leadTime sql.NullInt64
+	if s.LeadTimeDays != nil {
+		leadTime = sql.NullInt64{Int64: int64(*s.LeadTimeDays), Valid: true}
+	}
+	var err error
+	if s.ID == 0 {
+		var res sql.Result
+		res, err = db.Exec("INSERT INTO suppliers(name, contact, lead_time_days, notes) VALUES(?, ?, ?, ?)",
+			s.Name, s.Contact, leadTime, s.Notes)
+		if err == nil {
+			s.ID, err = res.LastInsertId()
+		}
+	} else {
+		_, err = db.Exec("UPDATE suppliers SET name = ?, contact = ?, lead_time_days = ?, notes = ? WHERE id = ?",
+			s.Name, s.Contact, leadTime, s.Notes, s.ID)
+	}
+	if err != nil && strings.Contains(err.Error(), "UNIQUE") {
+		return fmt.Errorf("Name: supplier %s already exists", s.Name)
+	}
+	return err
+}
+
+// parseOptionalID reads an optional drop-down value such as a supplier or
+// catalog material; blank or 0 means none was chosen.
+func parseOptionalID(value string) sql.NullInt64 {
+	id, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || id <= 0 {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: id, Valid: true}
+}
+
+// loadInvoiceDetails attaches the invoice tags to the invoice files of every
+// product in the slice.
+func loadInvoiceDetails(products []Product) error {
+	type fileRef struct{ product, file int }
+	refs := make(map[int64]fileRef)
+	var placeholders []string
+	var args []interface{}
+	for i := range products {
+		for j, f := range products[i].Invoice {
+			refs[f.ID] = fileRef{i, j}
+			placeholders = append(placeholders, "?")
+			args = append(args, f.ID)
+		}
+	}
+	if len(args) == 0 {
+		return nil
+	}
+
+	rows, err := db.Query(`
+		SELECT i.attachment_id, i.supplier_id, s.name, i.invoice_no, i.invoice_date, i.amount_minor, i.currency
+		FROM invoices i LEFT JOIN suppliers s ON s.id = i.supplier_id
+		WHERE i.attachment_id IN (`+strings.Join(placeholders, ",")+`)`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var attachmentID int64
+		d, err := scanInvoiceDetails(rows, &attachmentID)
+		if err != nil {
+			return err
+		}
+		if ref, ok := refs[attachmentID]; ok {
+			products[ref.product].Invoice[ref.file].InvoiceDetails = &d
+		}
+	}
+	return rows.Err()
+}
+
+// scanInvoiceDetails scans the attachment id and invoice columns selected by
+// loadInvoiceDetails, followed by any extra columns into extra.
+func scanInvoiceDetails(s rowScanner, attachmentID *int64, extra ...any) (InvoiceDetails, error) {
+	var d InvoiceDetails
+	var supplierID sql.NullInt64
+	var supplier, invoiceNo, invoiceDate, currency sql.NullString
+	dest := append([]any{attachmentID, &supplierID, &supplier, &invoiceNo, &invoiceDate, &d.Amount, &currency}, extra...)
+	err := s.Scan(dest...)
+	d.SupplierID, d.Supplier = supplierID.Int64, supplier.String
+	d.InvoiceNo, d.InvoiceDate, d.Currency = invoiceNo.String, invoiceDate.String, currency.String
+	return d, err
+}
+
+// suppliersHandler lists suppliers (GET) and adds one from the form on the
+// same page (POST).
+func suppliersHandler(w http.ResponseWriter, r *http.Request) {
+	var formError string
+	if r.Method == http.MethodPost {
+		s, err := parseSupplierForm(r)
+		if err == nil {
+			err = saveSupplier(&s)
+		}
+		if err == nil {
+			http.Redirect(w, r, fmt.Sprintf("/supplier/%d", s.ID), http.StatusSeeOther)
+			return
+		}
+		formError = err.Error()
+		w.WriteHeader(http.StatusBadRequest)
+	}
+
+	suppliers, err := loadSuppliers()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tmpl := template.Must(template.New("suppliers.html").Funcs(funcMap).ParseFiles("templates/suppliers.html"))
+	err = tmpl.Execute(w, struct {
+		Suppliers []Supplier
+		Error     string
+	}{suppliers, formError})
+	if err != nil {
+		log.Printf("Error rendering suppliers: %v", err)
+	}
+}
+
+// supplierHandler shows one supplier with the parts and invoices linked to it
+// (GET) and saves changes to the supplier (POST).
+func supplierHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/supplier/"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid supplier id", http.StatusBadRequest)
+		return
+	}
+
+	data := struct {
+		Supplier
+		Error             string
+		MaterialParts     []Product
+		FinishingParts    []Product
+		Invoices          []supplierInvoice
+		InvoiceTotals     map[string]Amount
+		InvoiceCurrencies []string
+	}{}
+
+	err = scanSupplier(db.QueryRow("SELECT "+supplierColumns+" FROM suppliers WHERE id = ?", id), &data.Supplier)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Supplier not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		s, err := parseSupplierForm(r)
+		s.ID = id
+		if err == nil {
+			err = saveSupplier(&s)
+		}
+		if err == nil {
+			http.Redirect(w, r, fmt.Sprintf("/supplier/%d", id), http.StatusSeeOther)
+			return
+		}
+		data.Supplier, data.Error = s, err.Error()
+		w.WriteHeader(http.StatusBadRequest)
+	}
+
+	for _, link := range []struct {
+		column string
+		dest   *[]Product
+	}{
+		{"material_supplier_id", &data.MaterialParts},
+		{"finishing_supplier_id", &data.FinishingParts},
+	} {
+		rows, err := db.Query("SELECT "+productColumns+" FROM products WHERE "+link.column+" = ? ORDER BY partNo", id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for rows.Next() {
+			var p Product
+			if err := scanProduct(rows, &p); err != nil {
+				rows.Close()
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			*link.dest = append(*link.dest, p)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	rows, err := db.Query(`
+		SELECT i.attachment_id, i.supplier_id, s.name, i.invoice_no, i.invoice_date, i.amount_minor, i.currency,
+			   a.name, a.path, p.partNo
+		FROM invoices i
+		JOIN attachments a ON a.id = i.attachment_id
+		JOIN products p ON p.id = a.product_id
+		LEFT JOIN suppliers s ON s.id = i.supplier_id
+		WHERE i.supplier_id = ?
+		ORDER BY i.invoice_date DESC, i.invoice_no`, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	data.InvoiceTotals = map[string]Amount{}
+	for rows.Next() {
+		var inv supplierInvoice
+		inv.Details, err = scanInvoiceDetails(rows, &inv.File.ID, &inv.File.Name, &inv.File.Path, &inv.PartNo)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if d := inv.Details; d.Amount.Valid {
+			total, seen := data.InvoiceTotals[d.Currency]
+			if !seen {
+				data.InvoiceCurrencies = append(data.InvoiceCurrencies, d.Currency)
+			}
+			data.InvoiceTotals[d.Currency] = Amount{Minor: total.Minor + d.Amount.Minor, Valid: true}
+		}
+		data.Invoices = append(data.Invoices, inv)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tmpl := template.Must(template.New("supplier.html").Funcs(funcMap).ParseFiles("templates/supplier.html"))
+	if err := tmpl.Execute(w, data); err != nil {
+		log.Printf("Error rendering supplier: %v", err)
+	}
+}
+
+// invoiceDetailsHandler tags an invoice attachment with supplier, invoice
+// number, date and amount.
+func invoiceDetailsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		AttachmentID int64  `json:"attachmentId"`
+		SupplierID   int64  `json:"supplierId"`
+		InvoiceNo    string `json:"invoiceNo"`
+		InvoiceDate  string `json:"invoiceDate"`
+		Amount       string `json:"amount"`
+		Currency     string `json:"currency"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var category, productCurrency string
+	err := db.QueryRow(`
+		SELECT a.category, p.currency FROM attachments a JOIN products p ON p.id = a.product_id
+		WHERE a.id = ?`, request.AttachmentID).Scan(&category, &productCurrency)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if category != "invoice" {
+		http.Error(w, "Only invoice attachments can be tagged", http.StatusBadRequest)
+		return
+	}
+
+	currency := strings.ToUpper(strings.TrimSpace(request.Currency))
+	if currency == "" {
+		currency = productCurrency
+	}
+	if !isCurrency(currency) {
+		http.Error(w, fmt.Sprintf("Currency: %q is not supported", currency), http.StatusBadRequest)
+		return
+	}
+	amount, err := parseAmount(request.Amount, currency)
+	if err != nil {
+		http.Error(w, "Amount: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	invoiceDate := strings.TrimSpace(request.InvoiceDate)
+	if invoiceDate != "" {
+		if _, err := time.Parse("2006-01-02", invoiceDate); err != nil {
+			http.Error(w, fmt.Sprintf("Invoice Date: %q is not a YYYY-MM-DD date", invoiceDate), http.StatusBadRequest)
+			return
+		}
+	}
+
+	supplierID := sql.NullInt64{Int64: request.SupplierID, Valid: request.SupplierID != 0}
+	_, err = db.Exec(`
+		INSERT INTO invoices(attachment_id, supplier_id, invoice_no, invoice_date, amount_minor, currency)
+		VALUES(?, ?, ?, NULLIF(?, ''), ?, ?)
+		ON CONFLICT(attachment_id) DO UPDATE SET
+			supplier_id = excluded.supplier_id, invoice_no = excluded.invoice_no,
+			invoice_date = excluded.invoice_date, amount_minor = excluded.amount_minor,
+			currency = excluded.currency`,
+		request.AttachmentID, supplierID, strings.TrimSpace(request.InvoiceNo), invoiceDate, amount, currency)
+	if err != nil {
+		if strings.Contains(err.Error(), "FOREIGN KEY") {
+			http.Error(w, "Supplier not found", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Error saving invoice details: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "success",
+		"message": "Invoice details saved",
+	})
+}
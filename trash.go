@@ -0,0 +1,538 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// trashDir holds the upload folders of deleted products until they are
+// restored or purged. It sits beside the uploads folder rather than inside
+// it so that trashed files are not served under /uploads/.
+var trashDir string
+
+// defaultTrashRetentionDays is how long deleted products are kept when no
+// retention has been configured.
+const defaultTrashRetentionDays = 30
+
+// errPartNoInUse is returned when a trashed product cannot be restored
+// because another product now uses its part number.
+var errPartNoInUse = errors.New("part number is in use")
+
+// trashRef is a reference from a trashed row to a row that is not part of the
+// snapshot and may have been deleted while the product was in the trash.
+// Optional references are cleared on restore, rows with a missing required
+// reference are left out.
+type trashRef struct {
+	column   string
+	table    string
+	required bool
+}
+
+// trashTable is one table copied into a trash snapshot. where selects the
+// rows belonging to the product, whose id is bound to ?1. Tables are listed
+// parents first, which is also the order they are restored in.
+type trashTable struct {
+	name  string
+	where string
+	refs  []trashRef
+}
+
+var trashTables = []trashTable{
+	{"products", "id = ?1", []trashRef{
+		{"material_supplier_id", "suppliers", false},
+		{"finishing_supplier_id", "suppliers", false},
+		{"material_id", "materials", false},
+		{"category_id", "categories", false},
+	}},
+	{"revisions", "product_id = ?1", nil},
+	{"attachments", "product_id = ?1", nil},
+	{"invoices", "attachment_id IN (SELECT id FROM attachments WHERE product_id = ?1)", []trashRef{
+		{"supplier_id", "suppliers", false},
+	}},
+	{"bom_items", "parent_id = ?1 OR child_id = ?1", []trashRef{
+		{"parent_id", "products", true},
+		{"child_id", "products", true},
+	}},
+	{"stock_movements", "product_id = ?1", []trashRef{
+		{"location_id", "locations", true},
+	}},
+	{"product_finishes", "product_id = ?1", []trashRef{
+		{"finish_id", "finishes", true},
+	}},
+	{"routing_operations", "product_id = ?1", []trashRef{
+		{"work_center_id", "work_centers", true},
+		{"cnc_attachment_id", "attachments", false},
+	}},
+	{"product_costs", "product_id = ?1", nil},
+	{"product_field_values", "product_id = ?1", []trashRef{
+		{"field_id", "custom_fields", true},
+	}},
+	{"product_tags", "product_id = ?1", []trashRef{
+		{"tag_id", "tags", true},
+	}},
+}
+
+// TrashItem is a deleted product waiting in the trash.
+type TrashItem struct {
+	ID        int64
+	ProductID int64
+	PartNo    string
+	PartName  string
+	Folder    string
+	DeletedBy string
+	DeletedAt string
+}
+
+// trashSnapshot maps a table name to the rows copied from it.
+type trashSnapshot map[string][]map[string]interface{}
+
+// snapshotProduct copies every row belonging to the product out of the
+// tables in trashTables.
+func snapshotProduct(tx *sql.Tx, productID int64) (trashSnapshot, error) {
+	snapshot := trashSnapshot{}
+	for _, t := range trashTables {
+		rows, err := tx.Query("SELECT * FROM "+t.name+" WHERE "+t.where, productID)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", t.name, err)
+		}
+		columns, err := rows.Columns()
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		for rows.Next() {
+			values := make([]interface{}, len(columns))
+			dest := make([]interface{}, len(columns))
+			for i := range values {
+				dest[i] = &values[i]
+			}
+			if err := rows.Scan(dest...); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			row := map[string]interface{}{}
+			for i, c := range columns {
+				switch v := values[i].(type) {
+				case time.Time:
+					// Stored back in the format CURRENT_TIMESTAMP writes.
+					row[c] = v.UTC().Format("2006-01-02 15:04:05")
+				case []byte:
+					row[c] = string(v)
+				default:
+					row[c] = v
+				}
+			}
+			snapshot[t.name] = append(snapshot[t.name], row)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return snapshot, nil
+}
+
+// trashProduct moves a product into the trash: its rows are saved as a
+// snapshot and deleted, and its upload folder is moved under trashDir. The
+// assemblies that used it are costed again without it.
+func trashProduct(productID int64, deletedBy string) (int64, error) {
+	parents, err := whereUsed(int(productID))
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var partNo, partName string
+	err = tx.QueryRow("SELECT partNo, COALESCE(partName, '') FROM products WHERE id = ?", productID).Scan(&partNo, &partName)
+	if err != nil {
+		return 0, err
+	}
+	snapshot, err := snapshotProduct(tx, productID)
+	if err != nil {
+		return 0, err
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := tx.Exec(`
+		INSERT INTO trash(product_id, part_no, part_name, snapshot, deleted_by)
+		VALUES (?, ?, ?, ?, ?)`,
+		productID, partNo, partName, string(data), deletedBy)
+	if err != nil {
+		return 0, err
+	}
+	trashID, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("DELETE FROM products WHERE id = ?", productID); err != nil {
+		return 0, err
+	}
+
+	partNoDir := filepath.Join(uploadDir, sanitizeFilename(partNo))
+	var folder string
+	if _, err := os.Stat(partNoDir); err == nil {
+		folder = fmt.Sprintf("%d-%s", trashID, sanitizeFilename(partNo))
+		if _, err := tx.Exec("UPDATE trash SET folder = ? WHERE id = ?", folder, trashID); err != nil {
+			return 0, err
+		}
+		if err := os.Rename(partNoDir, filepath.Join(trashDir, folder)); err != nil {
+			return 0, fmt.Errorf("moving folder to the trash: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		if folder != "" {
+			if err := os.Rename(filepath.Join(trashDir, folder), partNoDir); err != nil {
+				log.Printf("Error moving %s back out of the trash: %v", partNoDir, err)
+			}
+		}
+		return 0, err
+	}
+	if _, err := recalculateCostsWithParents(parentIDs(parents)...); err != nil {
+		log.Printf("Error costing the assemblies using product %d: %v", productID, err)
+	}
+	return trashID, nil
+}
+
+// loadTrash returns the trashed products, most recently deleted first.
+func loadTrash() ([]TrashItem, error) {
+	rows, err := db.Query(`
+		SELECT id, product_id, part_no, COALESCE(part_name, ''), COALESCE(folder, ''),
+		       COALESCE(deleted_by, ''), deleted_at
+		FROM trash ORDER BY deleted_at DESC, id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []TrashItem
+	for rows.Next() {
+		var t TrashItem
+		if err := rows.Scan(&t.ID, &t.ProductID, &t.PartNo, &t.PartName, &t.Folder, &t.DeletedBy, &t.DeletedAt); err != nil {
+			return nil, err
+		}
+		items = append(items, t)
+	}
+	return items, rows.Err()
+}
+
+// restoreProduct puts a trashed product back, under partNo when it is not
+// empty and under its original part number otherwise, and returns its id and
+// the part number it was restored under. Rows that refer to catalog entries
+// deleted in the meantime are dropped or have the reference cleared, as
+// trashTables describes.
+func restoreProduct(trashID int64, partNo string) (int64, string, error) {
+	var item TrashItem
+	var data string
+	err := db.QueryRow(`
+		SELECT product_id, part_no, COALESCE(folder, ''), snapshot FROM trash WHERE id = ?`,
+		trashID).Scan(&item.ProductID, &item.PartNo, &item.Folder, &data)
+	if err != nil {
+		return 0, "", err
+	}
+	if partNo == "" {
+		partNo = item.PartNo
+	}
+
+	var inUse bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM products WHERE partNo = ?)", partNo).Scan(&inUse); err != nil {
+		return 0, "", err
+	}
+	if inUse {
+		return 0, "", fmt.Errorf("%w: %s already belongs to another product, restore it under a different part number", errPartNoInUse, partNo)
+	}
+	partNoDir := filepath.Join(uploadDir, sanitizeFilename(partNo))
+	if item.Folder != "" {
+		if _, err := os.Stat(partNoDir); err == nil {
+			return 0, "", fmt.Errorf("%w: the folder %s already exists, restore it under a different part number", errPartNoInUse, sanitizeFilename(partNo))
+		}
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.UseNumber()
+	var snapshot trashSnapshot
+	if err := decoder.Decode(&snapshot); err != nil {
+		return 0, "", fmt.Errorf("reading snapshot: %v", err)
+	}
+	if len(snapshot["products"]) != 1 {
+		return 0, "", errors.New("snapshot has no product row")
+	}
+	product := snapshot["products"][0]
+	product["partNo"] = partNo
+	// The stock ledger trigger rebuilds qty as the movements are restored.
+	product["qty"] = 0
+	if partNo != item.PartNo {
+		oldPrefix := sanitizeFilename(item.PartNo) + "/"
+		for _, a := range snapshot["attachments"] {
+			if path, ok := a["path"].(string); ok && strings.HasPrefix(path, oldPrefix) {
+				a["path"] = sanitizeFilename(partNo) + "/" + strings.TrimPrefix(path, oldPrefix)
+			}
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	for _, t := range trashTables {
+		for _, row := range snapshot[t.name] {
+			if err := restoreRow(tx, t, row); err != nil {
+				return 0, "", fmt.Errorf("%s: %v", t.name, err)
+			}
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM trash WHERE id = ?", trashID); err != nil {
+		return 0, "", err
+	}
+
+	trashedDir := filepath.Join(trashDir, item.Folder)
+	if item.Folder != "" {
+		if err := os.Rename(trashedDir, partNoDir); err != nil {
+			return 0, "", fmt.Errorf("moving folder out of the trash: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		if item.Folder != "" {
+			if err := os.Rename(partNoDir, trashedDir); err != nil {
+				log.Printf("Error moving %s back into the trash: %v", partNoDir, err)
+			}
+		}
+		return 0, "", err
+	}
+	return item.ProductID, partNo, nil
+}
+
+// restoreRow inserts one snapshot row. A row already present, such as a BOM
+// line restored with the product at its other end, is left alone.
+func restoreRow(tx *sql.Tx, t trashTable, row map[string]interface{}) error {
+	for _, ref := range t.refs {
+		id, ok := row[ref.column].(json.Number)
+		if !ok {
+			continue
+		}
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM "+ref.table+" WHERE id = ?)", id.String()).Scan(&exists); err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if ref.required {
+			log.Printf("Not restoring %s row: %s %s no longer exists", t.name, ref.table, id)
+			return nil
+		}
+		row[ref.column] = nil
+	}
+
+	columns := make([]string, 0, len(row))
+	values := make([]interface{}, 0, len(row))
+	for c, v := range row {
+		if n, ok := v.(json.Number); ok {
+			if i, err := n.Int64(); err == nil {
+				v = i
+			} else if f, err := n.Float64(); err == nil {
+				v = f
+			}
+		}
+		columns = append(columns, `"`+c+`"`)
+		values = append(values, v)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(columns)), ",")
+	_, err := tx.Exec("INSERT OR IGNORE INTO "+t.name+"("+strings.Join(columns, ", ")+") VALUES ("+placeholders+")", values...)
+	return err
+}
+
+// deleteTrashItem permanently removes a trashed product and its files.
+func deleteTrashItem(trashID int64) error {
+	var folder string
+	err := db.QueryRow("SELECT COALESCE(folder, '') FROM trash WHERE id = ?", trashID).Scan(&folder)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM trash WHERE id = ?", trashID); err != nil {
+		return err
+	}
+	if folder != "" {
+		if err := os.RemoveAll(filepath.Join(trashDir, folder)); err != nil {
+			log.Printf("Error removing trashed folder %s: %v", folder, err)
+		}
+	}
+	return nil
+}
+
+// trashRetentionDays returns how many days deleted products are kept. Zero
+// keeps them until they are deleted by hand.
+func trashRetentionDays() (int, error) {
+	var value string
+	err := db.QueryRow("SELECT value FROM settings WHERE key = 'trash_retention_days'").Scan(&value)
+	if err == sql.ErrNoRows {
+		return defaultTrashRetentionDays, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+func setTrashRetentionDays(days int) error {
+	_, err := db.Exec(`
+		INSERT INTO settings(key, value) VALUES ('trash_retention_days', ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value`,
+		strconv.Itoa(days))
+	return err
+}
+
+// purgeTrash permanently removes trashed products older than the retention
+// and returns how many were removed.
+func purgeTrash() (int, error) {
+	days, err := trashRetentionDays()
+	if err != nil || days <= 0 {
+		return 0, err
+	}
+
+	rows, err := db.Query("SELECT id FROM trash WHERE deleted_at < DATETIME('now', ?)", fmt.Sprintf("-%d days", days))
+	if err != nil {
+		return 0, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	for i, id := range ids {
+		if err := deleteTrashItem(id); err != nil {
+			return i, err
+		}
+	}
+	return len(ids), nil
+}
+
+// deleteHandler moves a product into the trash.
+func deleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/delete/"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+
+	before := auditSnapshot(int(id))
+	_, err = trashProduct(id, currentUsername())
+	if err == sql.ErrNoRows {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error deleting product: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	auditProductChange(int(id), "delete", before)
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// trashHandler lists deleted products and restores, deletes or purges them.
+func trashHandler(w http.ResponseWriter, r *http.Request) {
+	var formError string
+	status := http.StatusBadRequest
+	if r.Method == http.MethodPost {
+		id := parseOptionalID(r.FormValue("id")).Int64
+		var err error
+		redirect := "/trash"
+		switch r.FormValue("action") {
+		case "restore":
+			var productID int64
+			var partNo string
+			productID, partNo, err = restoreProduct(id, strings.TrimSpace(r.FormValue("partNo")))
+			if err == nil {
+				if _, err := recalculateCostsWithParents(int(productID)); err != nil {
+					log.Printf("Error recalculating costs for product %d: %v", productID, err)
+				}
+				auditProductChange(int(productID), "restore", map[string]string{})
+				redirect = "/detail/" + url.PathEscape(partNo)
+			}
+			if errors.Is(err, errPartNoInUse) {
+				status = http.StatusConflict
+			}
+		case "delete":
+			err = deleteTrashItem(id)
+		case "purge":
+			_, err = purgeTrash()
+		case "retention":
+			var days int
+			days, err = strconv.Atoi(strings.TrimSpace(r.FormValue("days")))
+			if err != nil || days < 0 {
+				err = errors.New("Keep for: enter a whole number of days, 0 to keep forever")
+			} else {
+				err = setTrashRetentionDays(days)
+			}
+		default:
+			err = errors.New("unknown action")
+		}
+		if err == sql.ErrNoRows {
+			err = errors.New("that product is no longer in the trash")
+			status = http.StatusNotFound
+		}
+		if err == nil {
+			http.Redirect(w, r, redirect, http.StatusSeeOther)
+			return
+		}
+		formError = err.Error()
+		w.WriteHeader(status)
+	}
+
+	items, err := loadTrash()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	days, err := trashRetentionDays()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tmpl := template.Must(template.New("trash.html").Funcs(funcMap).ParseFiles("templates/trash.html"))
+	err = tmpl.Execute(w, struct {
+		Items         []TrashItem
+		RetentionDays int
+		Error         string
+	}{items, days, formError})
+	if err != nil {
+		log.Printf("Error rendering trash: %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestRestoreRedirectsToDetail restores a product and follows the redirect
+// to its detail page, which is looked up by part number.
+func TestRestoreRedirectsToDetail(t *testing.T) {
+	setupTestDB(t)
+	for _, body := range []string{
+		`{"partNo": "BR/1", "partName": "Bracket"}`,
+		`{"partNo": "1", "partName": "Other part"}`,
+	} {
+		if w := serve(http.MethodPost, "/api/products", "application/json", strings.NewReader(body)); w.Code != http.StatusCreated {
+			t.Fatalf("creating product: %d %s", w.Code, w.Body)
+		}
+	}
+	if w := serve(http.MethodDelete, "/api/products/BR%2F1", "", nil); w.Code != http.StatusOK {
+		t.Fatalf("deleting product: %d %s", w.Code, w.Body)
+	}
+	items, err := loadTrash()
+	if err != nil || len(items) != 1 {
+		t.Fatalf("trash: %v %v", items, err)
+	}
+
+	w := postForm("/trash", url.Values{"action": {"restore"}, "id": {"1"}})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("restore: %d %s", w.Code, w.Body)
+	}
+	location := w.Header().Get("Location")
+	if location != "/detail/BR%2F1" {
+		t.Errorf("restore redirects to %q, want /detail/BR%%2F1", location)
+	}
+	w = serve(http.MethodGet, location, "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s: %d %s", location, w.Code, w.Body)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "Bracket") || strings.Contains(body, "Other part") {
+		t.Errorf("GET %s does not show the restored product", location)
+	}
+}
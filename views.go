@@ -0,0 +1,327 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// listColumns are the product list columns a saved view can hide. Part No,
+// the selection box and the actions are always shown; custom fields are
+// chosen by their sort key.
+var listColumns = []struct{ Key, Label string }{
+	{"partName", "Part Name"},
+	{"description", "Description"},
+	{"categoryTags", "Category / Tags"},
+	{"material", "Material Details"},
+	{"cost", "Part Cost"},
+	{"qty", "Qty"},
+	{"photos", "Photos"},
+	{"updated_at", "Updated At"},
+}
+
+// SavedView is a named product list: a search, a category, a sort order, the
+// columns shown and the number of products per page. An empty Columns shows
+// every column.
+type SavedView struct {
+	ID         int64    `json:"id"`
+	Name       string   `json:"name"`
+	Query      string   `json:"query"`
+	CategoryID int64    `json:"categoryId,omitempty"`
+	SortBy     string   `json:"sort,omitempty"`
+	SortOrder  string   `json:"order,omitempty"`
+	Columns    []string `json:"columns,omitempty"`
+	PageSize   int      `json:"pageSize"`
+	IsDefault  bool     `json:"isDefault"`
+}
+
+// URL is the address of the product list showing the view.
+func (v SavedView) URL() string {
+	return "/?view=" + url.QueryEscape(v.Name)
+}
+
+// Shows reports whether the view shows the list column with the given key.
+func (v SavedView) Shows(column string) bool {
+	if len(v.Columns) == 0 {
+		return true
+	}
+	for _, c := range v.Columns {
+		if c == column {
+			return true
+		}
+	}
+	return false
+}
+
+// params returns the view as product list parameters.
+func (v SavedView) params() url.Values {
+	params := url.Values{}
+	if v.Query != "" {
+		params.Set("q", v.Query)
+	}
+	if v.CategoryID != 0 {
+		params.Set("category", strconv.FormatInt(v.CategoryID, 10))
+	}
+	if v.SortBy != "" {
+		params.Set("sort", v.SortBy)
+		params.Set("order", v.SortOrder)
+	}
+	return params
+}
+
+const savedViewColumns = "id, name, query, IFNULL(category_id, 0), sort_by, sort_order, columns, page_size, is_default"
+
+func scanSavedView(s rowScanner) (SavedView, error) {
+	var v SavedView
+	var columns string
+	err := s.Scan(&v.ID, &v.Name, &v.Query, &v.CategoryID, &v.SortBy, &v.SortOrder, &columns, &v.PageSize, &v.IsDefault)
+	v.Columns = splitFieldOptions(columns)
+	return v, err
+}
+
+func loadSavedViews() ([]SavedView, error) {
+	rows, err := db.Query("SELECT " + savedViewColumns + " FROM saved_views ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var views []SavedView
+	for rows.Next() {
+		v, err := scanSavedView(rows)
+		if err != nil {
+			return nil, err
+		}
+		views = append(views, v)
+	}
+	return views, rows.Err()
+}
+
+// findSavedView looks a view up by name, ignoring case, or by id.
+func findSavedView(ref string) (SavedView, error) {
+	ref = strings.TrimSpace(ref)
+	return scanSavedView(db.QueryRow(`
+		SELECT `+savedViewColumns+` FROM saved_views
+		WHERE name = ? OR CAST(id AS TEXT) = ?
+		ORDER BY name = ? DESC LIMIT 1`, ref, ref, ref))
+}
+
+// applySavedView returns the product list parameters of a request with those
+// of the view named by its view parameter filled in; parameters given in the
+// request take precedence, so a view can be re-sorted or searched further.
+// When useDefault is set, a request without any parameter shows the default
+// view. The view applied, if any, is returned with the parameters.
+func applySavedView(params url.Values, useDefault bool) (url.Values, *SavedView, error) {
+	var v SavedView
+	var err error
+	switch name := params.Get("view"); {
+	case name != "":
+		v, err = findSavedView(name)
+		if err == sql.ErrNoRows {
+			return params, nil, fmt.Errorf("Unknown view %s", name)
+		}
+	case useDefault && len(params) == 0:
+		v, err = scanSavedView(db.QueryRow("SELECT " + savedViewColumns + " FROM saved_views WHERE is_default"))
+		if err == sql.ErrNoRows {
+			return params, nil, nil
+		}
+	default:
+		return params, nil, nil
+	}
+	if err != nil {
+		return params, nil, fmt.Errorf("Error loading view: %v", err)
+	}
+	if v.PageSize > maxProductPageSize {
+		v.PageSize = maxProductPageSize
+	}
+
+	applied := url.Values{}
+	for key, values := range params {
+		applied[key] = values
+	}
+	for key, values := range v.params() {
+		if _, ok := params[key]; !ok {
+			applied[key] = values
+		}
+	}
+	applied.Set("view", v.Name)
+	return applied, &v, nil
+}
+
+// saveSavedView stores v, replacing the view of the same name if there is
+// one, and makes it the only default view when IsDefault is set.
+func saveSavedView(v SavedView) error {
+	if v.Name == "" {
+		return errors.New("Name: view name is required")
+	}
+	if strings.ContainsAny(v.Name, "\n\r") {
+		return errors.New("Name: view name must be on one line")
+	}
+	if _, err := compileSearchQuery(v.Query); err != nil {
+		return fmt.Errorf("Search: %v", err)
+	}
+	if v.SortBy != "" {
+		if _, ok := productSortColumns[v.SortBy]; !ok && v.SortBy != "relevance" {
+			if _, ok := customFieldSortColumn(v.SortBy); !ok {
+				return fmt.Errorf("Sort: cannot sort by %s", v.SortBy)
+			}
+		}
+		if v.SortOrder != "ASC" {
+			v.SortOrder = "DESC"
+		}
+	}
+	if v.PageSize < 1 || v.PageSize > maxProductPageSize {
+		return fmt.Errorf("Page size: enter a number from 1 to %d", maxProductPageSize)
+	}
+	fields, err := loadCustomFields()
+	if err != nil {
+		return err
+	}
+	known := map[string]bool{}
+	for _, c := range listColumns {
+		known[c.Key] = true
+	}
+	for _, f := range fields {
+		known[f.SortKey()] = true
+	}
+	for _, c := range v.Columns {
+		if !known[c] {
+			return fmt.Errorf("Columns: unknown column %s", c)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if v.IsDefault {
+		if _, err := tx.Exec("UPDATE saved_views SET is_default = 0 WHERE is_default AND name <> ?", v.Name); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`
+		INSERT INTO saved_views(name, query, category_id, sort_by, sort_order, columns, page_size, is_default)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET
+			query = excluded.query, category_id = excluded.category_id,
+			sort_by = excluded.sort_by, sort_order = excluded.sort_order,
+			columns = excluded.columns, page_size = excluded.page_size,
+			is_default = excluded.is_default`,
+		v.Name, v.Query, sql.NullInt64{Int64: v.CategoryID, Valid: v.CategoryID != 0},
+		v.SortBy, v.SortOrder, strings.Join(v.Columns, "\n"), v.PageSize, v.IsDefault)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// setDefaultView makes the view with the given id the default, or leaves no
+// default when id is zero.
+func setDefaultView(id int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE saved_views SET is_default = 0 WHERE is_default"); err != nil {
+		return err
+	}
+	if id != 0 {
+		res, err := tx.Exec("UPDATE saved_views SET is_default = 1 WHERE id = ?", id)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return sql.ErrNoRows
+		}
+	}
+	return tx.Commit()
+}
+
+// viewsHandler lists the saved views. POST saves the product list posted by
+// the save form of the list page as a view, or, by action, deletes a view or
+// changes the default one.
+func viewsHandler(w http.ResponseWriter, r *http.Request) {
+	var formError string
+	status := http.StatusBadRequest
+	if r.Method == http.MethodPost {
+		id := parseOptionalID(r.FormValue("id")).Int64
+		var err error
+		redirect := "/views"
+		switch r.FormValue("action") {
+		case "save":
+			v := SavedView{
+				Name:       strings.TrimSpace(r.FormValue("name")),
+				Query:      strings.TrimSpace(r.FormValue("q")),
+				CategoryID: parseOptionalID(r.FormValue("category")).Int64,
+				SortBy:     r.FormValue("sort"),
+				SortOrder:  r.FormValue("order"),
+				Columns:    r.Form["columns"],
+				PageSize:   defaultProductPageSize,
+				IsDefault:  r.FormValue("default") != "",
+			}
+			if size := strings.TrimSpace(r.FormValue("pageSize")); size != "" {
+				if v.PageSize, err = strconv.Atoi(size); err != nil {
+					v.PageSize = 0
+				}
+			}
+			err = saveSavedView(v)
+			redirect = v.URL()
+		case "delete":
+			var res sql.Result
+			if res, err = db.Exec("DELETE FROM saved_views WHERE id = ?", id); err == nil {
+				if n, _ := res.RowsAffected(); n == 0 {
+					err = sql.ErrNoRows
+				}
+			}
+		case "default":
+			err = setDefaultView(id)
+		default:
+			err = errors.New("unknown action")
+		}
+		if err == sql.ErrNoRows {
+			err = errors.New("that view no longer exists")
+			status = http.StatusNotFound
+		}
+		if err == nil {
+			http.Redirect(w, r, redirect, http.StatusSeeOther)
+			return
+		}
+		formError = err.Error()
+		w.WriteHeader(status)
+	}
+
+	views, err := loadSavedViews()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	categories, err := loadCategories()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	categoryPaths := map[int64]string{}
+	for _, c := range categories {
+		categoryPaths[c.ID] = c.Path
+	}
+
+	tmpl := template.Must(template.New("views.html").Funcs(funcMap).ParseFiles("templates/views.html"))
+	err = tmpl.Execute(w, struct {
+		Views      []SavedView
+		Categories map[int64]string
+		Error      string
+	}{views, categoryPaths, formError})
+	if err != nil {
+		log.Printf("Error rendering views: %v", err)
+	}
+}